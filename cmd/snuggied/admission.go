@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/bmatsuo/matching-snuggies/mesh"
+)
+
+// defaultMaxUpload is the default limit on the size of a job request body.
+const defaultMaxUpload = 256 << 20
+
+// defaultMaxTriangles is the default limit on the triangles in a job's mesh.
+const defaultMaxTriangles = 5000000
+
+// maxFormMemory is the part of a multipart form held in memory.  The rest of
+// an uploaded mesh is stored in a temporary file while the form is parsed.
+const maxFormMemory = 32 << 20
+
+// admissionError is a rejected job request with the HTTP status returned to
+// the client.
+type admissionError struct {
+	Status int
+	Msg    string
+}
+
+func (err *admissionError) Error() string {
+	return err.Msg
+}
+
+// admitUpload parses the multipart form of a job request.  Requests with a
+// body larger than srv.MaxUpload are rejected with 413 Request Entity Too
+// Large, and requests which would leave less than srv.MinFree bytes free in
+// the data directory are rejected with 507 Insufficient Storage.
+func (srv *SnuggieServer) admitUpload(w http.ResponseWriter, r *http.Request) error {
+	if srv.MaxUpload > 0 && r.ContentLength > srv.MaxUpload {
+		return srv.errTooLarge()
+	}
+	size := r.ContentLength
+	if size < 0 {
+		size = srv.MaxUpload
+	}
+	free, err := diskFree(srv.DataDir)
+	if err == nil && free-size < srv.MinFree {
+		return &admissionError{
+			Status: http.StatusInsufficientStorage,
+			Msg:    fmt.Sprintf("insufficient storage: %d MB free, %d MB must remain after upload", free>>20, srv.MinFree>>20),
+		}
+	}
+
+	if srv.MaxUpload > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, srv.MaxUpload)
+	}
+	err = r.ParseMultipartForm(maxFormMemory)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return srv.errTooLarge()
+	}
+	if err != nil {
+		return &admissionError{http.StatusBadRequest, "invalid form: " + err.Error()}
+	}
+	return nil
+}
+
+func (srv *SnuggieServer) errTooLarge() error {
+	return &admissionError{
+		Status: http.StatusRequestEntityTooLarge,
+		Msg:    fmt.Sprintf("upload too large: limit is %d MB", srv.MaxUpload>>20),
+	}
+}
+
+// checkMesh counts the triangles in meshfile.  Meshes which cannot be read or
+// which have more than srv.MaxTriangles triangles are rejected with 422
+// Unprocessable Entity.  The file is rewound after it is read.
+func (srv *SnuggieServer) checkMesh(meshfile multipart.File, header *multipart.FileHeader) error {
+	if !mesh.IsMeshFile(header.Filename) {
+		return &admissionError{http.StatusUnprocessableEntity, "meshfile: unsupported format (must be stl or amf)"}
+	}
+	n, err := mesh.CountTriangles(meshfile, header.Filename, header.Size)
+	if err != nil {
+		return &admissionError{http.StatusUnprocessableEntity, "meshfile: " + err.Error()}
+	}
+	if srv.MaxTriangles > 0 && n > srv.MaxTriangles {
+		return &admissionError{
+			Status: http.StatusUnprocessableEntity,
+			Msg:    fmt.Sprintf("meshfile: %d triangles exceeds limit of %d", n, srv.MaxTriangles),
+		}
+	}
+	_, err = meshfile.Seek(0, 0)
+	return err
+}
+
+// writeAdmissionError responds to a rejected upload with its status.
+func writeAdmissionError(w http.ResponseWriter, err error) {
+	if uerr, ok := err.(*admissionError); ok {
+		http.Error(w, uerr.Msg, uerr.Status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func meshRequest(t *testing.T, filename string, content []byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("slicer", "slic3r")
+	fw, err := mw.CreateFormFile("meshfile", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(content)
+	mw.Close()
+	r := httptest.NewRequest("POST", "/slicer/jobs", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func admissionStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if aerr, ok := err.(*admissionError); ok {
+		return aerr.Status
+	}
+	return -1
+}
+
+func TestAdmitUpload(t *testing.T) {
+	cube, err := ioutil.ReadFile("../../testdata/FirstCube.stl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := &SnuggieServer{DataDir: dir, MaxUpload: int64(len(cube)) + 1024}
+	r := meshRequest(t, "cube.stl", cube)
+	err = srv.admitUpload(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("admit: %v", err)
+	}
+	f, header, err := r.FormFile("meshfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.checkMesh(f, header)
+	if err != nil {
+		t.Errorf("check mesh: %v", err)
+	}
+	srv.MaxTriangles = 11
+	err = srv.checkMesh(f, header)
+	if status := admissionStatus(err); status != http.StatusUnprocessableEntity {
+		t.Errorf("too many triangles: %d %v", status, err)
+	}
+
+	// the limit applies whether or not the client declares the length.
+	srv.MaxUpload = 1024
+	for _, length := range []bool{true, false} {
+		r := meshRequest(t, "cube.stl", cube)
+		if !length {
+			r.ContentLength = -1
+		}
+		err = srv.admitUpload(httptest.NewRecorder(), r)
+		if status := admissionStatus(err); status != http.StatusRequestEntityTooLarge {
+			t.Errorf("content length %v: %d %v", length, status, err)
+		}
+	}
+
+	srv.MaxUpload = 0
+	srv.MinFree = 1 << 62
+	err = srv.admitUpload(httptest.NewRecorder(), meshRequest(t, "cube.stl", cube))
+	if status := admissionStatus(err); status != http.StatusInsufficientStorage {
+		t.Errorf("insufficient storage: %d %v", status, err)
+	}
+
+	srv.MinFree = 0
+	r = meshRequest(t, "cube.stl", []byte("not a mesh"))
+	err = srv.admitUpload(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("admit: %v", err)
+	}
+	f, header, err = r.FormFile("meshfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.checkMesh(f, header)
+	if status := admissionStatus(err); status != http.StatusUnprocessableEntity {
+		t.Errorf("invalid mesh: %d %v", status, err)
+	}
+}
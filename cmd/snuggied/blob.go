@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BlobStore holds the mesh and g-code files of jobs under keys chosen by the
+// server.  Keys are slash separated paths.  BlobStore implementations are
+// safe for concurrent use.
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing any existing blob.
+	// A blob is not visible to Open until Put returns successfully.
+	Put(key string, r io.Reader) error
+
+	// Open returns the blob stored under key or ErrBlobNotFound.
+	Open(key string) (Blob, error)
+
+	// Delete removes the blob stored under key.  Deleting a blob which does
+	// not exist is not an error.
+	Delete(key string) error
+}
+
+// Blob is the contents of a stored file.
+type Blob interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+	Size() int64
+	ModTime() time.Time
+}
+
+var ErrBlobNotFound = fmt.Errorf("blob not found")
+
+// FileBlobs is a BlobStore keeping blobs as files in a local directory.
+type FileBlobs struct {
+	Dir string
+}
+
+var _ BlobStore = new(FileBlobs)
+
+// LocalBlobs returns a FileBlobs storing blobs in dir.
+func LocalBlobs(dir string) *FileBlobs {
+	return &FileBlobs{Dir: dir}
+}
+
+// path returns the location of the file for key.  Older versions recorded
+// absolute paths instead of keys and these are used as they are.
+func (fs *FileBlobs) path(key string) string {
+	if filepath.IsAbs(key) {
+		return key
+	}
+	return filepath.Join(fs.Dir, filepath.FromSlash(key))
+}
+
+func (fs *FileBlobs) Put(key string, r io.Reader) error {
+	path := fs.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (fs *FileBlobs) Open(key string) (Blob, error) {
+	f, err := os.Open(fs.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileBlob{f, info}, nil
+}
+
+func (fs *FileBlobs) Delete(key string) error {
+	err := os.Remove(fs.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+type fileBlob struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (b *fileBlob) Size() int64        { return b.info.Size() }
+func (b *fileBlob) ModTime() time.Time { return b.info.ModTime() }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cpuPeriod is the cgroup scheduling period, in microseconds, for the CPUs
+// limit.
+const cpuPeriod = 100000
+
+// jobCgroup is a cgroup v2 containing a single slicer and its children.
+type jobCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// CheckCgroup verifies that dir is a cgroup v2 directory in which the server
+// can create cgroups for slicers, and enables the memory and cpu controllers
+// for them as required by limits.
+func CheckCgroup(dir string, limits *Limits) error {
+	_, err := os.Stat(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("%s is not a cgroup v2 directory", dir)
+	}
+	var controllers []string
+	if limits.Memory > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if limits.CPUs > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if len(controllers) == 0 {
+		return nil
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0644)
+	if err != nil {
+		return fmt.Errorf("enable controllers: %v", err)
+	}
+	return nil
+}
+
+// newJobCgroup creates a cgroup named name beneath parent restricted by the
+// memory and CPUs limits.
+func newJobCgroup(parent, name string, limits *Limits) (*jobCgroup, error) {
+	cg := &jobCgroup{path: filepath.Join(parent, name)}
+	err := os.Mkdir(cg.path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if limits.Memory > 0 {
+		err = cg.write("memory.max", strconv.FormatInt(limits.Memory, 10))
+		if err == nil {
+			// swap would let the slicer exceed the limit slowly instead of
+			// failing.  the file is absent if swap accounting is disabled.
+			cg.write("memory.swap.max", "0")
+		}
+	}
+	if err == nil && limits.CPUs > 0 {
+		err = cg.write("cpu.max", fmt.Sprintf("%d %d", int(limits.CPUs*cpuPeriod), cpuPeriod))
+	}
+	if err == nil {
+		cg.dir, err = os.Open(cg.path)
+	}
+	if err != nil {
+		os.Remove(cg.path)
+		return nil, err
+	}
+	return cg, nil
+}
+
+func (cg *jobCgroup) write(name, value string) error {
+	return ioutil.WriteFile(filepath.Join(cg.path, name), []byte(value), 0644)
+}
+
+// Attach causes a process started with attr to begin in the cgroup.
+func (cg *jobCgroup) Attach(attr *syscall.SysProcAttr) {
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(cg.dir.Fd())
+}
+
+// OOMKilled returns true if a process in the cgroup was killed for exceeding
+// the memory limit.
+func (cg *jobCgroup) OOMKilled() bool {
+	f, err := os.Open(filepath.Join(cg.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, _ := strconv.Atoi(fields[1])
+			return n > 0
+		}
+	}
+	return false
+}
+
+// Kill kills every process in the cgroup.
+func (cg *jobCgroup) Kill() {
+	if cg.write("cgroup.kill", "1") == nil {
+		return
+	}
+	// cgroup.kill requires linux 5.14.
+	p, err := ioutil.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+	if err != nil {
+		return
+	}
+	for _, field := range strings.Fields(string(p)) {
+		pid, err := strconv.Atoi(field)
+		if err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// Remove deletes the cgroup once the processes in it have exited.
+func (cg *jobCgroup) Remove() error {
+	cg.dir.Close()
+	var err error
+	for i := 0; i < 50; i++ {
+		err = os.Remove(cg.path)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+var errCgroupUnsupported = fmt.Errorf("cgroups unsupported on this platform")
+
+// jobCgroup is unavailable on this platform.
+type jobCgroup struct{}
+
+// CheckCgroup returns an error because cgroups are unavailable.
+func CheckCgroup(dir string, limits *Limits) error {
+	return errCgroupUnsupported
+}
+
+func newJobCgroup(parent, name string, limits *Limits) (*jobCgroup, error) {
+	return nil, errCgroupUnsupported
+}
+
+func (cg *jobCgroup) Attach(attr *syscall.SysProcAttr) {}
+func (cg *jobCgroup) OOMKilled() bool                  { return false }
+func (cg *jobCgroup) Kill()                            {}
+func (cg *jobCgroup) Remove() error                    { return nil }
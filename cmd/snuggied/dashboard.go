@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"net/http"
+)
+
+//go:embed dashboard/index.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+// GetDashboard serves the web interface.  The interface is built entirely on
+// the HTTP API beneath srv.Prefix.
+func (srv *SnuggieServer) GetDashboard(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	err := dashboardTemplate.Execute(&buf, map[string]interface{}{
+		"Prefix": srv.Prefix,
+		"Node":   srv.NodeID,
+	})
+	if err != nil {
+		requestLogger(r).Errorf("dashboard: %v", err)
+		http.Error(w, "unable to render dashboard", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
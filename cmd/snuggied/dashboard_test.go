@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	srv := &SnuggieServer{Prefix: "/slicer", NodeID: "node0"}
+	mux := http.NewServeMux()
+	srv.RegisterHandlers(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/slicer/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status: %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `var prefix = "/slicer";`) {
+		t.Errorf("prefix not rendered")
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/slicer/unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown path status: %d", w.Code)
+	}
+}
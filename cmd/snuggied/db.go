@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/bmatsuo/matching-snuggies/gcode"
 	"github.com/bmatsuo/matching-snuggies/slicerjob"
 	"github.com/boltdb/bolt"
 )
@@ -15,52 +17,76 @@ func b(s string) []byte {
 	return []byte(s)
 }
 
-var DB *bolt.DB
-
 const (
 	dbJobs       = "jobs"
 	dbMeshFiles  = "meshFiles"
 	dbGCodeFiles = "gCodeFiles"
 	dbDelFiles   = "deleteFiles"
+	dbLayers     = "gCodeLayers"
+	dbHealth     = "health"
+	dbEvents     = "jobEvents"
 )
 
-func loadDB(path string) *bolt.DB {
+// BoltStore is a JobStore kept in a bolt database file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var _ JobStore = new(BoltStore)
+var _ StoreSizer = new(BoltStore)
+
+// OpenBoltStore opens the bolt database at path, creating it if it does not
+// exist.
+func OpenBoltStore(path string) (*BoltStore, error) {
 	db, err := bolt.Open(path, 0666, nil)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(b(dbDelFiles))
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists(b(dbMeshFiles))
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists(b(dbGCodeFiles))
-		if err != nil {
-			return err
-		}
-		_, err = tx.CreateBucketIfNotExists(b(dbJobs))
-		if err != nil {
-			return err
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{dbDelFiles, dbMeshFiles, dbGCodeFiles, dbJobs, dbLayers, dbHealth, dbEvents} {
+			_, err := tx.CreateBucketIfNotExists(b(bucket))
+			if err != nil {
+				return err
+			}
 		}
-		return nil
+		return createIndexes(tx)
 	})
-	return db
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db}, nil
 }
 
-func PutMeshFile(key string, path string) error {
-	return DB.Update(func(tx *bolt.Tx) error {
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// Size returns the size of the database file.
+func (s *BoltStore) Size() (int64, error) {
+	info, err := os.Stat(s.db.Path())
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *BoltStore) Ping() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPutString(tx, dbHealth, "ping", time.Now().Format(time.RFC3339Nano))
+	})
+}
+
+func (s *BoltStore) PutMeshFile(key string, path string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
 		return tx.Bucket(b(dbMeshFiles)).
 			Put(b(key), b(path))
 	})
 }
 
-func PutGCodeFile(key string, value string) error {
-	return DB.Update(func(tx *bolt.Tx) error {
+func (s *BoltStore) PutGCodeFile(key string, value string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(b(dbGCodeFiles))
 		if bucket == nil {
 			return fmt.Errorf("%v bucket doesn't exist!", dbGCodeFiles)
@@ -69,24 +95,24 @@ func PutGCodeFile(key string, value string) error {
 	})
 }
 
-func PutJob(key string, job *slicerjob.Job) error {
-	jsonJob, err := json.Marshal(job)
-	if err != nil {
-		return err
-	}
-
-	return DB.Update(func(tx *bolt.Tx) error {
-		bucketName := "jobs"
-		bucket := tx.Bucket(b(bucketName))
-		if bucket == nil {
-			return fmt.Errorf("%v bucket doesn't exist!", bucketName)
+func (s *BoltStore) InsertJob(job *slicerjob.Job, ev *slicerjob.Event) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if boltGet(tx, dbJobs, job.ID) != nil {
+			return fmt.Errorf("job exists")
+		}
+		err := putJob(tx, job)
+		if err != nil {
+			return err
+		}
+		if ev == nil {
+			return nil
 		}
-		return bucket.Put(b(key), jsonJob)
+		return putEvent(tx, job, ev)
 	})
 }
 
-func ViewMeshFile(key string) (path string, err error) {
-	err = DB.View(func(tx *bolt.Tx) error {
+func (s *BoltStore) ViewMeshFile(key string) (path string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
 		path = boltGetString(tx, dbMeshFiles, key)
 		return nil
 	})
@@ -96,8 +122,8 @@ func ViewMeshFile(key string) (path string, err error) {
 	return path, nil
 }
 
-func ViewGCodeFile(key string) (val string, err error) {
-	err = DB.View(func(tx *bolt.Tx) error {
+func (s *BoltStore) ViewGCodeFile(key string) (val string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
 		val = string(tx.Bucket(b(dbGCodeFiles)).Get(b(key)))
 		return nil
 	})
@@ -107,6 +133,22 @@ func ViewGCodeFile(key string) (val string, err error) {
 	return val, nil
 }
 
+func (s *BoltStore) PutLayerIndex(key string, idx *gcode.LayerIndex) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPutJSON(tx, dbLayers, key, idx)
+	})
+}
+
+func (s *BoltStore) ViewLayerIndex(key string) (idx *gcode.LayerIndex, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if boltGet(tx, dbLayers, key) == nil {
+			return nil
+		}
+		return boltGetJSON(tx, dbLayers, key, &idx)
+	})
+	return idx, err
+}
+
 func boltCopyKey(tx *bolt.Tx, srcBucket, srcKey, dstBucket, dstKey string) error {
 	val := boltGet(tx, srcBucket, srcKey)
 	if val == nil {
@@ -151,39 +193,107 @@ func boltPutJSON(tx *bolt.Tx, bucket, key string, v interface{}) error {
 	return tx.Bucket(b(bucket)).Put(b(key), js)
 }
 
-func ViewJob(key string) (*slicerjob.Job, error) {
-	var job = new(slicerjob.Job)
-	err := DB.View(func(tx *bolt.Tx) error {
-		return boltGetJSON(tx, dbJobs, key, job)
+func (s *BoltStore) ViewJob(key string) (*slicerjob.Job, error) {
+	var job *slicerjob.Job
+	err := s.db.View(func(tx *bolt.Tx) error {
+		job = viewJob(tx, key)
+		return nil
 	})
-	return job, err
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
 }
 
 func viewJob(tx *bolt.Tx, id string) (job *slicerjob.Job) {
-	err := boltGetJSON(tx, dbJobs, id, &job)
+	js := boltGet(tx, dbJobs, id)
+	if js == nil {
+		return nil
+	}
+	err := json.Unmarshal(js, &job)
 	if err != nil {
-		log.Printf("unmarshal job: %v", err)
+		logger.With("job", id).Errorf("unmarshal job: %v", err)
 		return nil
 	}
 	return job
 }
 
-func CancelJob(id string) error {
-	return DB.Update(func(tx *bolt.Tx) error {
-		now := time.Now()
+func (s *BoltStore) UpdateJob(id string, ev *slicerjob.Event, fn func(job *slicerjob.Job) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
 		job := viewJob(tx, id)
 		if job == nil {
-			return fmt.Errorf("job not found")
+			return ErrJobNotFound
 		}
-		job.Status = slicerjob.Cancelled
-		job.Terminated = &now
-		job.Updated = &now
-		return boltPutJSON(tx, dbJobs, id, job)
+		err := applyUpdate(job, fn)
+		if err != nil {
+			return err
+		}
+		err = putJob(tx, job)
+		if err != nil {
+			return err
+		}
+		if ev == nil {
+			return nil
+		}
+		return putEvent(tx, job, ev)
 	})
 }
 
-func DeleteJob(id string) error {
-	err := DB.Update(func(tx *bolt.Tx) error {
+// putEvent appends ev to the history of job.  Event keys are the job id
+// followed by a sequence number so a job's events are adjacent and ordered.
+func putEvent(tx *bolt.Tx, job *slicerjob.Job, ev *slicerjob.Event) error {
+	completeEvent(job, ev)
+	bucket := tx.Bucket(b(dbEvents))
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	return boltPutJSON(tx, dbEvents, fmt.Sprintf("%s/%016x", job.ID, seq), ev)
+}
+
+func (s *BoltStore) ViewHistory(id string) (*slicerjob.History, error) {
+	history := &slicerjob.History{JobID: id, Events: []*slicerjob.Event{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := b(id + "/")
+		cur := tx.Bucket(b(dbEvents)).Cursor()
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			var ev *slicerjob.Event
+			err := json.Unmarshal(v, &ev)
+			if err != nil {
+				return fmt.Errorf("event %s: %v", k, err)
+			}
+			history.Events = append(history.Events, ev)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// delEvents deletes the history of the job with the given id.
+func delEvents(tx *bolt.Tx, id string) error {
+	prefix := b(id + "/")
+	var keys [][]byte
+	cur := tx.Bucket(b(dbEvents)).Cursor()
+	for k, _ := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cur.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		err := tx.Bucket(b(dbEvents)).Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) DeleteJob(id string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		return deleteJob(tx, id)
 	})
 	return err
@@ -192,201 +302,199 @@ func DeleteJob(id string) error {
 func deleteJob(tx *bolt.Tx, id string) error {
 	_ = delMeshFile(tx, id)
 	_ = delGCodeFile(tx, id)
+	_ = boltDel(tx, dbLayers, id)
+	_ = delEvents(tx, id)
+	var job *slicerjob.Job
+	if boltGetJSON(tx, dbJobs, id, &job) == nil {
+		err := unindexJob(tx, job)
+		if err != nil {
+			return err
+		}
+	}
 	return boltDel(tx, dbJobs, id)
 }
 
-var ErrMaxDeleted = fmt.Errorf("maximum amount deleted")
-var ErrExceededMaxDur = fmt.Errorf("exceeded maximum duration")
-
-var ErrStop = fmt.Errorf("stop")
-var ErrSkip = fmt.Errorf("skip")
-
-func ListJobs(maxDur time.Duration, limit int, seek []byte, filter func(job *slicerjob.Job) error) ([]*slicerjob.Job, []byte, error) {
+func (s *BoltStore) ListJobs(maxDur time.Duration, limit int, cursor []byte, q *JobQuery) ([]*slicerjob.Job, []byte, error) {
+	if q == nil {
+		q = &JobQuery{}
+	}
 	var jobs []*slicerjob.Job
 	var timeout <-chan time.Time
 	var istimeout bool
 	if maxDur > 0 {
 		timeout = time.After(maxDur)
 	}
-	var key []byte
-	err := DB.View(func(tx *bolt.Tx) error {
-		cur := tx.Bucket(b(dbJobs)).Cursor()
-		var val []byte
-		defer func() {
-			if key != nil {
-				key = append([]byte(nil), key...)
-			}
-		}()
-		for key, val = cur.Seek(seek); key != nil; key, val = cur.Next() {
+	scan := &indexScan{after: cursor, reverse: q.Newest}
+	if !q.CreatedAfter.IsZero() {
+		scan.lo = timeKey(q.CreatedAfter)
+	}
+	if !q.CreatedBefore.IsZero() {
+		scan.hi = timeKey(q.CreatedBefore)
+	}
+	index := dbJobsCreated
+	if len(q.Status) == 1 {
+		index = dbJobsStatus
+		scan.prefix = []byte{byte(q.Status[0])}
+	}
+	var next []byte
+	var ferr error
+	err := s.db.View(func(tx *bolt.Tx) error {
+		scan.each(tx.Bucket(b(index)), func(created, v []byte) bool {
 			select {
 			case <-timeout:
 				istimeout = true
-				break
+				return false
 			default:
 			}
-			var job *slicerjob.Job
-			err := json.Unmarshal(val, &job)
-			if err != nil {
-				log.Printf("unmarshal job %q: %v", key, err)
-				continue
+			next = created
+			if index == dbJobsCreated && (len(v) != 1 || !q.hasStatus(slicerjob.Status(v[0]))) {
+				return true
 			}
-			err = filter(job)
-			if err == ErrSkip {
-				continue
-			}
-			if err == ErrStop {
-				return nil
+			job := viewJob(tx, createdKeyID(created))
+			if job == nil {
+				return true
 			}
-			if err != nil {
-				return err
+			if q.Filter != nil {
+				ferr = q.Filter(job)
+				if ferr == ErrSkip {
+					ferr = nil
+					return true
+				}
+				if ferr != nil {
+					return false
+				}
 			}
 			jobs = append(jobs, job)
-			if limit > 0 && len(jobs) >= limit {
-				break
-			}
-		}
+			return limit <= 0 || len(jobs) < limit
+		})
+		// index keys are only valid during the transaction.
+		next = copyBytes(next)
 		return nil
 	})
-	if key != nil {
-		seek = append(key, 0)
-	} else {
-		seek = nil
+	if err == nil && ferr != ErrStop {
+		err = ferr
 	}
 	if err != nil {
-		return jobs, seek, err
+		return jobs, nil, err
 	}
 	if istimeout {
-		return jobs, seek, ErrExceededMaxDur
+		return jobs, next, ErrExceededMaxDur
+	}
+	if ferr == ErrStop || limit <= 0 || len(jobs) < limit {
+		return jobs, nil, nil
+	}
+	return jobs, next, nil
+}
+
+func copyBytes(p []byte) []byte {
+	if p == nil {
+		return nil
 	}
-	return jobs, seek, err
+	return append([]byte(nil), p...)
 }
 
-func DeleteOldJobs(termBefore time.Time, maxDur time.Duration, maxDel int) error {
-	numDel := 0
+// DeleteOldJobs finds expired jobs by scanning the expiry indexes up to the
+// first job which has not expired, in a read-only transaction so job updates
+// are not blocked.  The jobs found are then deleted in a separate
+// transaction.
+func (s *BoltStore) DeleteOldJobs(r *Retention, now time.Time, maxDur time.Duration, maxDel int) ([]*slicerjob.Job, error) {
 	var timeout <-chan time.Time
 	var istimeout bool
 	if maxDur > 0 {
 		timeout = time.After(maxDur)
 	}
-	err := DB.Update(func(tx *bolt.Tx) (err error) {
-		curs := tx.Bucket(b(dbJobs)).Cursor()
-
-		for k, v := curs.First(); k != nil; k, v = curs.Next() {
-			select {
-			case <-timeout:
-				istimeout = true
+	var ids []string
+	collect := func(key, v []byte) bool {
+		select {
+		case <-timeout:
+			istimeout = true
+			return false
+		default:
+		}
+		ids = append(ids, createdKeyID(key))
+		return len(ids) < maxDel
+	}
+	// jobs expire at the end of the nanosecond they are kept until.
+	end := now.Add(time.Nanosecond)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, status := range terminalStatuses {
+			scan := &indexScan{prefix: []byte{byte(status)}, hi: timeKey(end.Add(-r.Keep(status)))}
+			scan.each(tx.Bucket(b(dbJobsTerminated)), collect)
+			if istimeout || len(ids) >= maxDel {
 				return nil
-			default:
-			}
-			var job *slicerjob.Job
-			err := json.Unmarshal(v, &job)
-			if err != nil {
-				log.Printf("%q: %v", k, err)
-				continue
-			}
-			if job.Terminated == nil {
-				if job.Created == nil {
-					log.Printf("job has nil created_time: %v", job.ID)
-				} else if termBefore.After(*job.Created) {
-					log.Printf("job created %v ago without being terminated: %v", time.Now().Sub(*job.Created), job.ID)
-				}
-				continue
 			}
-			if job.Terminated.After(termBefore) {
+		}
+		scan := &indexScan{hi: timeKey(end)}
+		scan.each(tx.Bucket(b(dbJobsTTL)), collect)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []*slicerjob.Job
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			// the job may have been deleted since it was found.
+			job := viewJob(tx, id)
+			if job == nil || !job.Status.IsTerminal() || job.Terminated == nil || r.Expires(job).After(now) {
 				continue
 			}
-			if err := deleteJob(tx, string(k)); err != nil {
-				log.Printf("%q: %v", k, err)
+			if err := deleteJob(tx, id); err != nil {
+				logger.With("job", id).Errorf("delete job: %v", err)
 				continue
 			}
-			numDel++
-			if numDel >= maxDel {
-				return nil
-			}
+			deleted = append(deleted, job)
 		}
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if numDel > 0 {
-		log.Printf("deleted %d jobs", numDel)
-	}
-	if numDel >= maxDel {
-		return ErrMaxDeleted
+	if len(deleted) >= maxDel {
+		return deleted, ErrMaxDeleted
 	}
 	if istimeout {
-		return ErrExceededMaxDur
+		return deleted, ErrExceededMaxDur
 	}
-	return nil
+	return deleted, nil
 }
 
-func RemoveFiles(maxDur time.Duration, maxDel int) error {
-	numDel := 0
-	var timeout <-chan time.Time
-	var istimeout bool
-	if maxDur > 0 {
-		timeout = time.After(maxDur)
-	}
-	err := DB.Update(func(tx *bolt.Tx) (err error) {
-		curs := tx.Bucket(b(dbDelFiles)).Cursor()
-
-		for k, v := curs.First(); k != nil; k, v = curs.Next() {
-			select {
-			case <-timeout:
-				istimeout = true
-				return nil
-			default:
-			}
-			path := string(v)
-			if err := os.Remove(path); err != nil {
-				log.Printf("%q: %v", k, err)
-				if !os.IsNotExist(err) {
-					continue
-				}
-			}
-			if err := curs.Delete(); err != nil {
-				log.Printf("%q: %v", k, err)
-				continue
-			}
-			numDel++
-			if numDel >= maxDel {
-				return nil
+func (s *BoltStore) DeletedFiles(limit int) ([]*DeletedFile, error) {
+	var files []*DeletedFile
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cur := tx.Bucket(b(dbDelFiles)).Cursor()
+		for k, v := cur.First(); k != nil; k, v = cur.Next() {
+			if limit > 0 && len(files) >= limit {
+				break
 			}
+			files = append(files, &DeletedFile{
+				Key:  string(k),
+				Path: string(v),
+				Mesh: strings.Contains(string(k), "/meshes/"),
+			})
 		}
 		return nil
 	})
-	if err != nil {
-		return err
-	}
-	if numDel > 0 {
-		log.Printf("removed %d files", numDel)
-	}
-	if numDel >= maxDel {
-		return ErrMaxDeleted
-	}
-	if istimeout {
-		return ErrExceededMaxDur
-	}
-	return nil
+	return files, err
+}
+
+func (s *BoltStore) FileRemoved(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltDel(tx, dbDelFiles, key)
+	})
 }
 
 func delMeshFile(tx *bolt.Tx, id string) error {
-	err := boltCopyKey(tx,
-		dbMeshFiles, id,
-		dbDelFiles, fmt.Sprintf("%s/meshes/%s", time.Now().Format(time.RFC3339), id),
-	)
+	err := boltCopyKey(tx, dbMeshFiles, id, dbDelFiles, deletedFileKey("meshes", id))
 	if err != nil {
 		return err
 	}
-	return boltDel(tx, dbGCodeFiles, id)
+	return boltDel(tx, dbMeshFiles, id)
 }
 
 func delGCodeFile(tx *bolt.Tx, id string) error {
-	err := boltCopyKey(tx,
-		dbGCodeFiles, id,
-		dbDelFiles, fmt.Sprintf("%s/gcodes/%s", time.Now().Format(time.RFC3339), id),
-	)
+	err := boltCopyKey(tx, dbGCodeFiles, id, dbDelFiles, deletedFileKey("gcodes", id))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+	"github.com/boltdb/bolt"
+)
+
+func TestBoltStoreReindex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snuggied.boltdb")
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := putListJobs(t, store, time.Now().Add(-24*time.Hour))
+	old := slicerjob.New()
+	terminated := time.Now().Add(-2 * time.Hour)
+	old.Status, old.Terminated = slicerjob.Complete, &terminated
+	err = store.InsertJob(old, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// databases created before the indexes are indexed when opened.
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		for _, index := range []string{dbJobsCreated, dbJobsStatus, dbJobsTerminated, dbJobsTTL} {
+			err := tx.DeleteBucket(b(index))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, err = OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	jobs, _, err := store.ListJobs(0, 0, nil, &JobQuery{Newest: true, Status: terminalStatuses})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the terminated job was created last.
+	expect := []int{8, 7, 5, 4, 2, 1}
+	if len(jobs) != len(expect)+1 || jobs[0].ID != old.ID {
+		t.Fatalf("reindexed: %d jobs (expected %d)", len(jobs), len(expect)+1)
+	}
+	for i, j := range expect {
+		if jobs[i+1].ID != ids[j] {
+			t.Errorf("reindexed: job %d is not %d", i, j)
+		}
+	}
+
+	deleted, err := store.DeleteOldJobs(&Retention{Complete: time.Hour}, time.Now(), 0, 10)
+	if err != nil || len(deleted) != 1 || deleted[0].ID != old.ID {
+		t.Errorf("reindexed: deleted %d: %v", len(deleted), err)
+	}
+}
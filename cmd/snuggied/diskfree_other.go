@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+// diskFree is not supported on this platform.
+func diskFree(path string) (int64, error) {
+	return 0, errDiskFreeUnsupported
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Artifacts (mesh and gcode files) are stored gzip compressed in the
+// server's BlobStore.  Keys without the gzipExt suffix were written by older
+// versions and are stored uncompressed.
+const gzipExt = ".gz"
+
+// artifactReader reads the uncompressed contents of an artifact.
+type artifactReader interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// putArtifact stores the contents of r compressed under key.
+func putArtifact(blobs BlobStore, key string, r io.Reader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		z := gzip.NewWriter(pw)
+		_, err := io.Copy(z, r)
+		if err == nil {
+			err = z.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	err := blobs.Put(key, pr)
+	// unblock the compressor if the store stopped reading early.
+	pr.CloseWithError(err)
+	return err
+}
+
+// putArtifactFile stores the contents of the file at path compressed under
+// key and removes the file.
+func putArtifactFile(blobs BlobStore, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = putArtifact(blobs, key, f)
+	if err != nil {
+		return err
+	}
+	os.Remove(path)
+	return nil
+}
+
+// openArtifact opens the artifact stored under key for reading,
+// decompressing it if necessary.
+func openArtifact(blobs BlobStore, key string) (artifactReader, error) {
+	b, err := blobs.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(key, gzipExt) {
+		return b, nil
+	}
+	z, err := newGzipFile(b)
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	return z, nil
+}
+
+// extractArtifact decompresses the artifact stored under key into the file
+// dst.
+func extractArtifact(blobs BlobStore, dst, key string) error {
+	r, err := openArtifact(blobs, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(dst)
+		return err
+	}
+	return f.Close()
+}
+
+// serveArtifact writes the artifact stored under key to w.  Compressed
+// artifacts are sent without modification to clients that accept gzip
+// encoding and are decompressed for all other clients.  Range requests are
+// supported in either case.
+func serveArtifact(w http.ResponseWriter, r *http.Request, blobs BlobStore, key string) {
+	b, err := blobs.Open(key)
+	if err == ErrBlobNotFound {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).With("blob", key).Errorf("open: %v", err)
+		http.Error(w, "unable to read file", http.StatusInternalServerError)
+		return
+	}
+	defer b.Close()
+	name := path.Base(strings.TrimSuffix(key, gzipExt))
+	if !strings.HasSuffix(key, gzipExt) {
+		http.ServeContent(w, r, name, b.ModTime(), b)
+		return
+	}
+	ctype := mime.TypeByExtension(filepath.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		// ServeContent omits the length of encoded content, which is known
+		// for the whole blob.
+		if r.Header.Get("Range") == "" {
+			w.Header().Set("Content-Length", strconv.FormatInt(b.Size(), 10))
+		}
+		http.ServeContent(w, r, name, b.ModTime(), b)
+		return
+	}
+
+	z, err := newGzipFile(b)
+	if err != nil {
+		requestLogger(r).With("blob", key).Errorf("open: %v", err)
+		http.Error(w, "unable to read file", http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, name, b.ModTime(), z)
+}
+
+// acceptsGzip returns true if the client accepts gzip content encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.Index(enc, ";"); i >= 0 {
+			if strings.Replace(enc[i+1:], " ", "", -1) == "q=0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:i])
+		}
+		if enc == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipFile reads the uncompressed contents of a gzip blob and implements
+// io.Seeker so that it can be served with http.ServeContent.  Seeking
+// backwards restarts decompression from the beginning of the blob.
+//
+// The uncompressed size is read from the gzip trailer, which stores it modulo
+// 2^32, so artifacts must be smaller than 4 GiB uncompressed.  Seeking
+// relative to the end of a larger artifact, as for suffix range requests,
+// uses the wrong offset.
+type gzipFile struct {
+	f    Blob
+	z    *gzip.Reader
+	size int64 // uncompressed size
+	off  int64 // uncompressed offset of z
+	pos  int64 // offset requested by Seek
+}
+
+// newGzipFile returns a gzipFile reading f.  Closing the gzipFile closes f.
+func newGzipFile(f Blob) (*gzipFile, error) {
+	// the uncompressed size (mod 2^32) is stored in the last four bytes of
+	// the blob.
+	var isize [4]byte
+	_, err := f.Seek(-4, 2)
+	if err == nil {
+		_, err = io.ReadFull(f, isize[:])
+	}
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipFile{
+		f:    f,
+		z:    z,
+		size: int64(binary.LittleEndian.Uint32(isize[:])),
+	}, nil
+}
+
+func (g *gzipFile) Read(p []byte) (int, error) {
+	if g.pos < g.off {
+		_, err := g.f.Seek(0, 0)
+		if err != nil {
+			return 0, err
+		}
+		err = g.z.Reset(g.f)
+		if err != nil {
+			return 0, err
+		}
+		g.off = 0
+	}
+	if g.pos > g.off {
+		n, err := io.CopyN(ioutil.Discard, g.z, g.pos-g.off)
+		g.off += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := g.z.Read(p)
+	g.off += int64(n)
+	g.pos = g.off
+	return n, err
+}
+
+func (g *gzipFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += g.pos
+	case 2:
+		offset += g.size
+	default:
+		return g.pos, fmt.Errorf("seek: invalid whence")
+	}
+	if offset < 0 {
+		return g.pos, fmt.Errorf("seek: negative position")
+	}
+	g.pos = offset
+	return offset, nil
+}
+
+func (g *gzipFile) Close() error {
+	g.z.Close()
+	return g.f.Close()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestServeArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobs := LocalBlobs(dir)
+	gcode := strings.Repeat("G1 X10 Y10\n", 1000)
+	key := "job.gcode" + gzipExt
+	err = putArtifact(blobs, key, strings.NewReader(gcode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := blobs.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := ioutil.ReadAll(b)
+	b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, rng string, gzip bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/slicer/gcodes/job", nil)
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		if gzip {
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+		}
+		w := httptest.NewRecorder()
+		serveArtifact(w, req, blobs, key)
+		return w
+	}
+
+	// ranges of the uncompressed content are served to clients which do not
+	// accept gzip, including ranges requiring backward seeks.
+	w := serve("GET", "bytes=11-20", false)
+	if w.Code != http.StatusPartialContent || w.Body.String() != gcode[11:21] ||
+		w.Header().Get("Content-Encoding") != "" ||
+		w.Header().Get("Content-Range") != "bytes 11-20/"+strconv.Itoa(len(gcode)) {
+		t.Errorf("range: %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	w = serve("GET", "bytes=-11", false)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "G1 X10 Y10\n" {
+		t.Errorf("suffix range: %d %q", w.Code, w.Body.String())
+	}
+	w = serve("GET", "bytes=5000-5009,0-9", false)
+	if w.Code != http.StatusPartialContent || !strings.Contains(w.Body.String(), gcode[5000:5010]) ||
+		!strings.Contains(w.Body.String(), gcode[:10]) {
+		t.Errorf("multiple ranges: %d %q", w.Code, w.Body.String())
+	}
+
+	// ranges of the compressed blob are served to clients which accept gzip.
+	w = serve("GET", "bytes=0-9", true)
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "gzip" ||
+		!bytes.Equal(w.Body.Bytes(), compressed[:10]) ||
+		w.Header().Get("Content-Range") != "bytes 0-9/"+strconv.Itoa(len(compressed)) {
+		t.Errorf("gzip range: %d %v", w.Code, w.Header())
+	}
+	w = serve("GET", "", true)
+	z, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadAll(z)
+	if err != nil || string(p) != gcode {
+		t.Errorf("gzip: %d bytes %v", len(p), err)
+	}
+
+	// HEAD requests give the length of the content as it would be sent.
+	w = serve("HEAD", "", false)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 ||
+		w.Header().Get("Content-Length") != strconv.Itoa(len(gcode)) {
+		t.Errorf("head: %d %v", w.Code, w.Header())
+	}
+	w = serve("HEAD", "", true)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 ||
+		w.Header().Get("Content-Length") != strconv.Itoa(len(compressed)) {
+		t.Errorf("gzip head: %d %v", w.Code, w.Header())
+	}
+}
+
+func TestGzipFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobs := LocalBlobs(dir)
+	content := "0123456789abcdefghijklmnopqrstuvwxyz"
+	err = putArtifact(blobs, "a.gz", strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := blobs.Open("a.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newGzipFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	if g.size != int64(len(content)) {
+		t.Errorf("size: %d", g.size)
+	}
+	read := func(n int) string {
+		p := make([]byte, n)
+		n, err := io.ReadFull(g, p)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Errorf("read: %v", err)
+		}
+		return string(p[:n])
+	}
+	for _, test := range []struct {
+		offset int64
+		whence int
+		expect string
+	}{
+		{20, 0, "klmn"},
+		{2, 1, "qrst"},
+		{5, 0, "5678"},
+		{-3, 2, "xyz"},
+		{0, 0, "0123"},
+	} {
+		_, err := g.Seek(test.offset, test.whence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := read(4); s != test.expect {
+			t.Errorf("seek %d %d: %q", test.offset, test.whence, s)
+		}
+	}
+	_, err = g.Seek(-1, 0)
+	if err == nil {
+		t.Errorf("negative seek")
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for enc, expect := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip;q=0.5": true,
+		"gzip;q=0":            false,
+		"gzip; q=0, deflate":  false,
+		"br, x-gzip":          false,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", enc)
+		if acceptsGzip(r) != expect {
+			t.Errorf("%q: %v", enc, !expect)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// Retention is how long jobs are kept after they terminate, by terminal
+// status.  Jobs created with a TTL are kept for their TTL instead.
+type Retention struct {
+	Complete  time.Duration
+	Failed    time.Duration
+	Cancelled time.Duration
+}
+
+// Expires returns the time after which job may be deleted.  The zero time is
+// returned if job has not terminated.
+func (r *Retention) Expires(job *slicerjob.Job) time.Time {
+	if job.Terminated == nil {
+		return time.Time{}
+	}
+	keep := r.Keep(job.Status)
+	if job.TTL > 0 {
+		keep = time.Duration(job.TTL * float64(time.Second))
+	}
+	return job.Terminated.Add(keep)
+}
+
+// Keep returns the time jobs which terminated with status are kept if they
+// were created without a TTL.
+func (r *Retention) Keep(status slicerjob.Status) time.Duration {
+	switch status {
+	case slicerjob.Complete:
+		return r.Complete
+	case slicerjob.Failed:
+		return r.Failed
+	default:
+		return r.Cancelled
+	}
+}
+
+// gcLoop runs the garbage collector every interval, and whenever trigger
+// receives, until stop is closed.
+func (srv *SnuggieServer) gcLoop(interval time.Duration, trigger, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-trigger:
+		case <-stop:
+			return
+		}
+		srv.collect(interval / 2)
+	}
+}
+
+// collect deletes expired jobs and, if the server's files exceed its quota,
+// evicts terminated jobs until they do not.  The files of deleted jobs are
+// removed.  Each phase is limited to maxDur.
+func (srv *SnuggieServer) collect(maxDur time.Duration) {
+	var decisions []*slicerjob.GCDecision
+	now := time.Now()
+	expired, err := srv.Store.DeleteOldJobs(&srv.Retention, now, maxDur, 1000)
+	if err != nil {
+		logger.Warnf("gc: %v", err)
+	}
+	if len(expired) > 0 {
+		logger.Infof("deleted %d jobs", len(expired))
+	}
+	for _, job := range expired {
+		decisions = append(decisions, &slicerjob.GCDecision{
+			Time:   now,
+			JobID:  job.ID,
+			Status: job.Status,
+			Reason: slicerjob.GCExpired,
+		})
+	}
+
+	nfiles, err := srv.removeFiles(maxDur, 1000)
+	if err != nil {
+		logger.Warnf("gc remove: %v", err)
+		// don't do anything special about errors removing files the
+		// logging is specific enough for the user to handle anything.
+	}
+
+	var usage int64
+	du, err := srv.diskUsage()
+	if err != nil {
+		logger.Warnf("gc disk usage: %v", err)
+	} else {
+		usage = du.Files
+	}
+	if srv.Quota > 0 && usage > srv.Quota {
+		evicted, err := srv.evict(usage-srv.Quota, maxDur)
+		if err != nil {
+			logger.Warnf("gc evict: %v", err)
+		}
+		decisions = append(decisions, evicted...)
+		n, err := srv.removeFiles(maxDur, 1000)
+		if err != nil {
+			logger.Warnf("gc remove: %v", err)
+		}
+		nfiles += n
+		du, err = srv.diskUsage()
+		if err == nil {
+			usage = du.Files
+		}
+		if usage > srv.Quota {
+			logger.Warnf("gc: %d MB of files exceeds quota of %d MB", usage>>20, srv.Quota>>20)
+		}
+	}
+
+	for _, d := range decisions {
+		logger.With("job", d.JobID, "status", d.Status, "reason", d.Reason).Debugf("gc deleted job")
+	}
+	srv.Stats.GCRun(nfiles, decisions, usage, srv.Quota)
+}
+
+// evictCandidate is a terminated job which may be evicted to free space.
+type evictCandidate struct {
+	Job   *slicerjob.Job
+	Bytes int64
+}
+
+// evictOrder sorts completed jobs before others, and older jobs first.
+type evictOrder []*evictCandidate
+
+func (o evictOrder) Len() int      { return len(o) }
+func (o evictOrder) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o evictOrder) Less(i, j int) bool {
+	ci := o[i].Job.Status == slicerjob.Complete
+	cj := o[j].Job.Status == slicerjob.Complete
+	if ci != cj {
+		return ci
+	}
+	return o[i].Job.Terminated.Before(*o[j].Job.Terminated)
+}
+
+// evict deletes terminated jobs, the oldest completed jobs first, until the
+// jobs deleted account for at least excess bytes of files.  Waiting jobs are
+// never evicted.
+func (srv *SnuggieServer) evict(excess int64, maxDur time.Duration) ([]*slicerjob.GCDecision, error) {
+	jobs, _, err := srv.Store.ListJobs(maxDur, 0, nil, &JobQuery{
+		Status: terminalStatuses,
+		Filter: func(job *slicerjob.Job) error {
+			if job.Terminated == nil {
+				return ErrSkip
+			}
+			return nil
+		},
+	})
+	if err != nil && err != ErrExceededMaxDur {
+		return nil, err
+	}
+	var candidates []*evictCandidate
+	for _, job := range jobs {
+		candidates = append(candidates, &evictCandidate{job, srv.jobFilesSize(job.ID)})
+	}
+	sort.Sort(evictOrder(candidates))
+
+	var decisions []*slicerjob.GCDecision
+	var freed int64
+	for _, c := range candidates {
+		if freed >= excess {
+			break
+		}
+		if c.Bytes == 0 {
+			continue
+		}
+		err := srv.Store.DeleteJob(c.Job.ID)
+		if err != nil {
+			logger.With("job", c.Job.ID).Errorf("evict: %v", err)
+			continue
+		}
+		freed += c.Bytes
+		decisions = append(decisions, &slicerjob.GCDecision{
+			Time:   time.Now(),
+			JobID:  c.Job.ID,
+			Status: c.Job.Status,
+			Reason: slicerjob.GCQuota,
+			Bytes:  c.Bytes,
+		})
+	}
+	if len(decisions) > 0 {
+		logger.Infof("evicted %d jobs freeing %d MB", len(decisions), freed>>20)
+	}
+	return decisions, nil
+}
+
+// jobFilesSize returns the bytes used by the mesh, thumbnails, and g-code of
+// job id.
+func (srv *SnuggieServer) jobFilesSize(id string) int64 {
+	var keys []string
+	var thumbs []string
+	if key, err := srv.Store.ViewMeshFile(id); err == nil && key != "" {
+		keys = append(keys, key)
+		thumbs, _ = filepath.Glob(thumbnailGlob(srv.DataDir, key))
+	}
+	if key, err := srv.Store.ViewGCodeFile(id); err == nil && key != "" {
+		keys = append(keys, key)
+	}
+	var size int64
+	for _, key := range keys {
+		b, err := srv.Blobs.Open(key)
+		if err == nil {
+			size += b.Size()
+			b.Close()
+		}
+	}
+	for _, path := range thumbs {
+		info, err := os.Stat(path)
+		if err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// removeFiles removes up to maxDel files belonging to deleted jobs and
+// returns the number removed.
+func (srv *SnuggieServer) removeFiles(maxDur time.Duration, maxDel int) (int, error) {
+	files, err := srv.Store.DeletedFiles(maxDel)
+	if err != nil {
+		return 0, err
+	}
+	numDel := 0
+	var timeout <-chan time.Time
+	if maxDur > 0 {
+		timeout = time.After(maxDur)
+	}
+	for _, f := range files {
+		select {
+		case <-timeout:
+			return numDel, ErrExceededMaxDur
+		default:
+		}
+		log := logger.With("file", f.Key)
+		if err := srv.Blobs.Delete(f.Path); err != nil {
+			log.Warnf("remove: %v", err)
+			continue
+		}
+		if f.Mesh {
+			removeThumbnails(srv.DataDir, f.Path)
+		}
+		if err := srv.Store.FileRemoved(f.Key); err != nil {
+			log.Errorf("delete: %v", err)
+			continue
+		}
+		numDel++
+	}
+	if numDel > 0 {
+		logger.Infof("removed %d files", numDel)
+	}
+	if numDel >= maxDel {
+		return numDel, ErrMaxDeleted
+	}
+	return numDel, nil
+}
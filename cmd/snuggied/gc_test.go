@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+func TestRetentionExpires(t *testing.T) {
+	r := &Retention{Complete: time.Hour, Failed: 2 * time.Hour, Cancelled: time.Minute}
+	term := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, test := range []struct {
+		Status  slicerjob.Status
+		TTL     float64
+		Expires time.Time
+	}{
+		{slicerjob.Complete, 0, term.Add(time.Hour)},
+		{slicerjob.Failed, 0, term.Add(2 * time.Hour)},
+		{slicerjob.Cancelled, 0, term.Add(time.Minute)},
+		{slicerjob.Complete, 30, term.Add(30 * time.Second)},
+	} {
+		job := &slicerjob.Job{Status: test.Status, TTL: test.TTL, Terminated: &term}
+		if exp := r.Expires(job); !exp.Equal(test.Expires) {
+			t.Errorf("test %d: expires %v (expected %v)", i, exp, test.Expires)
+		}
+	}
+	if exp := r.Expires(&slicerjob.Job{Status: slicerjob.Accepted}); !exp.IsZero() {
+		t.Errorf("waiting job expires %v", exp)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := MemoryStore()
+	files := filepath.Join(dir, "files")
+	err = os.Mkdir(files, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]string)
+	var paths []string
+	putJob := func(name string, status slicerjob.Status, age time.Duration, ttl float64, size int) {
+		job := slicerjob.New()
+		job.Status = status
+		job.TTL = ttl
+		if !status.IsWaiting() {
+			term := time.Now().Add(-age)
+			job.Terminated = &term
+		}
+		err := store.InsertJob(job, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name] = job.ID
+		mesh := filepath.Join(files, job.ID+".stl")
+		gcode := filepath.Join(files, job.ID+".gcode")
+		for _, path := range []string{mesh, gcode} {
+			err = ioutil.WriteFile(path, []byte(strings.Repeat("x", size/2)), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		paths = append(paths, mesh, gcode)
+		store.PutMeshFile(job.ID, job.ID+".stl")
+		store.PutGCodeFile(job.ID, job.ID+".gcode")
+	}
+	putJob("expired", slicerjob.Complete, 2*time.Hour, 0, 100)
+	putJob("ttl", slicerjob.Complete, 10*time.Minute, 60, 100)
+	putJob("complete", slicerjob.Complete, 30*time.Minute, 0, 1000)
+	putJob("failed", slicerjob.Failed, 40*time.Minute, 0, 1000)
+	putJob("waiting", slicerjob.Accepted, 0, 0, 1000)
+
+	srv := &SnuggieServer{
+		DataDir:   files,
+		Blobs:     LocalBlobs(files),
+		Stats:     NewStats(),
+		Store:     store,
+		Retention: Retention{Complete: time.Hour, Failed: time.Hour, Cancelled: time.Hour},
+		Quota:     2100,
+	}
+	srv.collect(time.Minute)
+
+	for name, deleted := range map[string]bool{
+		"expired":  true,
+		"ttl":      true,
+		"complete": true,
+		"failed":   false,
+		"waiting":  false,
+	} {
+		_, err := store.ViewJob(ids[name])
+		if deleted && err == nil {
+			t.Errorf("%s job not deleted", name)
+		}
+		if !deleted && err != nil {
+			t.Errorf("%s job: %v", name, err)
+		}
+	}
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		id := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		removed := id == ids["expired"] || id == ids["ttl"] || id == ids["complete"]
+		if removed != os.IsNotExist(err) {
+			t.Errorf("%s: removed=%v stat=%v", filepath.Base(path), removed, err)
+		}
+	}
+
+	gc := srv.Stats.Snapshot().GC
+	if gc == nil {
+		t.Fatalf("no gc stats")
+	}
+	if gc.ExpiredJobs != 2 || gc.EvictedJobs != 1 || gc.EvictedBytes != 1000 || gc.RemovedFiles != 6 {
+		t.Errorf("gc stats: %+v", gc)
+	}
+	if gc.Usage != 2000 || gc.Quota != 2100 {
+		t.Errorf("usage %d of %d", gc.Usage, gc.Quota)
+	}
+	if len(gc.Recent) != 3 || gc.Recent[0].JobID != ids["complete"] || gc.Recent[0].Reason != slicerjob.GCQuota {
+		t.Errorf("recent decisions: %+v", gc.Recent)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bmatsuo/matching-snuggies/gcode"
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// Filament properties assumed when a preset does not specify them.  Slic3r
+// presets always specify a diameter but not all versions support a density.
+const (
+	defaultFilamentDiameter = 1.75 // mm
+	defaultFilamentDensity  = 1.24 // g/cm^3, PLA
+)
+
+// analyzeGCode computes statistics for the gcode stored under key using the
+// filament properties of the slic3r preset.
+func (srv *SnuggieServer) analyzeGCode(key, preset string) (*slicerjob.GCodeStats, error) {
+	opt := &gcode.Options{
+		FilamentDiameter: defaultFilamentDiameter,
+		FilamentDensity:  defaultFilamentDensity,
+	}
+	if configPath := srv.Slic3rPresets[preset]; configPath != "" {
+		config, err := ReadConfigSlic3r(configPath)
+		if err != nil {
+			return nil, err
+		}
+		opt.FilamentDiameter = configFloat(config, "filament_diameter", opt.FilamentDiameter)
+		opt.FilamentDensity = configFloat(config, "filament_density", opt.FilamentDensity)
+	}
+
+	r, err := openArtifact(srv.Blobs, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	stats, err := gcode.Analyze(r, opt)
+	if err != nil {
+		return nil, err
+	}
+	return &slicerjob.GCodeStats{
+		PrintTime:      stats.PrintTime.Seconds(),
+		FilamentLength: stats.FilamentLength,
+		FilamentVolume: stats.FilamentVolume,
+		FilamentWeight: stats.FilamentWeight,
+		Layers:         stats.Layers,
+		MaxZ:           stats.MaxZ,
+	}, nil
+}
+
+// configFloat returns the numeric value of key in a slic3r config.  Settings
+// with per-extruder values, like "1.75,1.75", return the first extruder's
+// value.  If key is not a positive number def is returned.
+func configFloat(config map[string]string, key string, def float64) float64 {
+	v := config[key]
+	if i := strings.Index(v, ","); i >= 0 {
+		v = v[:i]
+	}
+	x, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || x <= 0 {
+		return def
+	}
+	return x
+}
+
+// parsePostProcess parses post-processor specifications of the form
+// "name:arg" and ensures that each is valid.
+func parsePostProcess(specs []string) ([]slicerjob.PostProcessor, error) {
+	var pp []slicerjob.PostProcessor
+	for _, spec := range specs {
+		p := slicerjob.PostProcessor{Name: spec}
+		if i := strings.Index(spec, ":"); i >= 0 {
+			p.Name, p.Arg = spec[:i], spec[i+1:]
+		}
+		_, err := gcode.NewProcessor(p.Name, p.Arg)
+		if err != nil {
+			return nil, err
+		}
+		pp = append(pp, p)
+	}
+	return pp, nil
+}
+
+// gcodeProcessors returns the processors to apply to the output of job.  The
+// uncompressed mesh for job is located at meshPath.
+func (srv *SnuggieServer) gcodeProcessors(job *Job, meshPath string) ([]gcode.Processor, error) {
+	opts := job.Options
+	if opts == nil {
+		opts = &SliceOptions{}
+	}
+	var procs []gcode.Processor
+
+	// thumbnails are written first so they are located in the program's
+	// header.
+	spec := opts.Thumbnails
+	if spec == "" {
+		config, err := ReadConfigSlic3r(srv.Slic3rPresets[job.Preset])
+		if err != nil {
+			return nil, err
+		}
+		spec = config["thumbnails"]
+	}
+	sizes, err := parseThumbnailSizes(spec)
+	if err != nil {
+		return nil, fmt.Errorf("thumbnails: %v", err)
+	}
+	if len(sizes) > 0 {
+		thumbs, err := gcodeThumbnails(meshPath, sizes)
+		if err != nil {
+			return nil, fmt.Errorf("thumbnails: %v", err)
+		}
+		procs = append(procs, gcode.EmbedThumbnails(thumbs))
+	}
+
+	for _, p := range opts.PostProcess {
+		proc, err := gcode.NewProcessor(p.Name, p.Arg)
+		if err != nil {
+			return nil, err
+		}
+		procs = append(procs, proc)
+	}
+	return procs, nil
+}
+
+// postProcessGCode applies the processors to the gcode at path, replacing its
+// contents.
+func postProcessGCode(path string, procs []gcode.Processor) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gcode.PostProcess(out, f, procs)
+	if err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("close: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+var errLayerRange = fmt.Errorf("layer out of range")
+
+// readGCodeLayer reads layer n from the gcode of job id stored under key.
+// The gcode is indexed the first time one of its layers is read.
+func (srv *SnuggieServer) readGCodeLayer(id, key string, n int) (*gcode.Layer, error) {
+	r, err := openArtifact(srv.Blobs, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	idx, err := srv.Store.ViewLayerIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	if idx == nil {
+		idx, err = gcode.IndexLayers(r)
+		if err != nil {
+			return nil, err
+		}
+		err = srv.Store.PutLayerIndex(id, idx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if n < 1 || n > len(idx.Layers) {
+		return nil, errLayerRange
+	}
+	return gcode.ReadLayer(r, idx, n)
+}
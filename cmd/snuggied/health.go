@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMinFree is the free space, in bytes, required in the data directory
+// for the server to be ready.
+const defaultMinFree = 512 << 20
+
+// versionTimeout limits the time taken by the slicer to report its version.
+const versionTimeout = 10 * time.Second
+
+// versionCacheDur is how long the slicer version check is cached so that
+// frequent readiness probes do not start a process each time.
+const versionCacheDur = time.Minute
+
+var errDiskFreeUnsupported = fmt.Errorf("free space unavailable on this platform")
+
+// CheckResult is the outcome of a single readiness check.
+type CheckResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Health reports whether the server is able to slice.
+type Health struct {
+	Status string         `json:"status"`
+	Checks []*CheckResult `json:"checks,omitempty"`
+}
+
+// readiness checks the dependencies of a server.
+type readiness struct {
+	mu          sync.Mutex
+	version     string
+	versionErr  error
+	versionTime time.Time
+}
+
+// slicerVersion runs bin to determine its version.  The result is cached for
+// versionCacheDur.
+func (rd *readiness) slicerVersion(bin string) (string, error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if !rd.versionTime.IsZero() && time.Since(rd.versionTime) < versionCacheDur {
+		return rd.version, rd.versionErr
+	}
+	rd.version, rd.versionErr = runVersion(bin)
+	rd.versionTime = time.Now()
+	return rd.version, rd.versionErr
+}
+
+func runVersion(bin string) (string, error) {
+	if bin == "" {
+		bin = "slic3r"
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(bin, "--version")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Start()
+	if err != nil {
+		return "", err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(versionTimeout):
+		cmd.Process.Kill()
+		<-done
+		return "", fmt.Errorf("timeout after %v", versionTimeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, trimOutput(out.String()))
+	}
+	version := trimOutput(out.String())
+	if version == "" {
+		return "", fmt.Errorf("no version reported")
+	}
+	return version, nil
+}
+
+// trimOutput returns the first line of process output.
+func trimOutput(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s
+}
+
+// ReadyChecks runs the readiness checks for srv.
+func (srv *SnuggieServer) ReadyChecks() *Health {
+	health := &Health{Status: "ready"}
+	check := func(name string, fn func() (string, error)) {
+		detail, err := fn()
+		result := &CheckResult{Name: name, OK: err == nil, Detail: detail}
+		if err != nil {
+			result.Error = err.Error()
+			health.Status = "unready"
+		}
+		health.Checks = append(health.Checks, result)
+	}
+	check("accepting", func() (string, error) {
+		if srv.Draining() {
+			return "", errShutdown
+		}
+		return "accepting jobs", nil
+	})
+	check("slic3r", func() (string, error) {
+		return srv.ready.slicerVersion(srv.Slic3r)
+	})
+	check("presets", func() (string, error) {
+		n := len(srv.Slic3rPresets)
+		if n == 0 {
+			return "", fmt.Errorf("no presets loaded")
+		}
+		return fmt.Sprintf("%d presets", n), nil
+	})
+	check("database", func() (string, error) {
+		if srv.Store == nil {
+			return "", fmt.Errorf("database not open")
+		}
+		err := srv.Store.Ping()
+		if err != nil {
+			return "", err
+		}
+		return "writable", nil
+	})
+	check("disk", func() (string, error) {
+		free, err := diskFree(srv.DataDir)
+		if err == errDiskFreeUnsupported {
+			return err.Error(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		detail := fmt.Sprintf("%d MB free", free>>20)
+		if free < srv.MinFree {
+			return detail, fmt.Errorf("less than %d MB free", srv.MinFree>>20)
+		}
+		return detail, nil
+	})
+	return health
+}
+
+// GetHealth responds successfully whenever the server is able to handle
+// requests.
+func (srv *SnuggieServer) GetHealth(w http.ResponseWriter, r *http.Request) {
+	srv.writeHealth(w, r, &Health{Status: "ok"}, http.StatusOK)
+}
+
+// GetReady responds with the result of each readiness check.  The response
+// status is 503 if any check fails.
+func (srv *SnuggieServer) GetReady(w http.ResponseWriter, r *http.Request) {
+	health := srv.ReadyChecks()
+	status := http.StatusOK
+	if health.Status != "ready" {
+		status = http.StatusServiceUnavailable
+	}
+	srv.writeHealth(w, r, health, status)
+}
+
+func (srv *SnuggieServer) writeHealth(w http.ResponseWriter, r *http.Request, health *Health, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(health)
+	if err != nil {
+		requestLogger(r).Warnf("http response: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadyChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := filepath.Join(dir, "slic3r")
+	err = ioutil.WriteFile(bin, []byte("#!/bin/sh\necho 1.2.9\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &SnuggieServer{
+		Slic3r:        bin,
+		Slic3rPresets: map[string]string{"hq": "hq.ini"},
+		DataDir:       dir,
+		Store:         MemoryStore(),
+	}
+	health := srv.ReadyChecks()
+	if health.Status != "ready" {
+		t.Errorf("status: %v", health.Status)
+	}
+	for _, c := range health.Checks {
+		if !c.OK {
+			t.Errorf("check %s: %s", c.Name, c.Error)
+		}
+		if c.Name == "slic3r" && c.Detail != "1.2.9" {
+			t.Errorf("slic3r version: %q", c.Detail)
+		}
+	}
+
+	srv = &SnuggieServer{
+		Slic3r:  filepath.Join(dir, "missing"),
+		DataDir: dir,
+		MinFree: 1 << 62,
+		Store:   MemoryStore(),
+	}
+	health = srv.ReadyChecks()
+	if health.Status != "unready" {
+		t.Errorf("status: %v", health.Status)
+	}
+	failed := make(map[string]bool)
+	for _, c := range health.Checks {
+		failed[c.Name] = !c.OK
+	}
+	if !failed["slic3r"] || !failed["presets"] || failed["database"] {
+		t.Errorf("checks: %v", failed)
+	}
+	if _, err := diskFree(dir); err == nil && !failed["disk"] {
+		t.Errorf("disk check passed")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+	"github.com/boltdb/bolt"
+)
+
+// Jobs are indexed by creation time, and by status followed by creation
+// time, so listings can be ordered and restricted to a range of creation
+// times or a status without decoding every job.  Index keys end with a
+// creation key, the creation time in big-endian nanoseconds followed by the
+// job id.  The value of a creation index entry is the job's status.
+//
+// Terminated jobs are also indexed by the time they may be deleted so the
+// garbage collector only visits expired jobs.  Jobs without a TTL are indexed
+// by status followed by termination time, as their retention depends on
+// their status.  Jobs with a TTL are indexed by the time their TTL ends.
+// Both keys end with the time and the job id, like a creation key.
+const (
+	dbJobsCreated    = "jobsByCreated"
+	dbJobsStatus     = "jobsByStatus"
+	dbJobsTerminated = "jobsByTerminated"
+	dbJobsTTL        = "jobsByTTL"
+)
+
+// timeKey returns the index key prefix for jobs created at t.
+func timeKey(t time.Time) []byte {
+	p := make([]byte, 8)
+	if !t.IsZero() {
+		binary.BigEndian.PutUint64(p, uint64(t.UnixNano()))
+	}
+	return p
+}
+
+// createdKey returns the creation key of job.
+func createdKey(job *slicerjob.Job) []byte {
+	var t time.Time
+	if job.Created != nil {
+		t = *job.Created
+	}
+	return append(timeKey(t), job.ID...)
+}
+
+// createdKeyID returns the job id in a creation key.
+func createdKeyID(key []byte) string {
+	if len(key) < 8 {
+		return ""
+	}
+	return string(key[8:])
+}
+
+func statusKey(status slicerjob.Status, created []byte) []byte {
+	return append([]byte{byte(status)}, created...)
+}
+
+// expiryKey returns the index and key locating job by the time it may be
+// deleted.  Jobs which have not terminated are not indexed and nil is
+// returned.
+func expiryKey(job *slicerjob.Job) (index string, key []byte) {
+	if !job.Status.IsTerminal() || job.Terminated == nil {
+		return "", nil
+	}
+	if job.TTL > 0 {
+		t := job.Terminated.Add(time.Duration(job.TTL * float64(time.Second)))
+		return dbJobsTTL, append(timeKey(t), job.ID...)
+	}
+	return dbJobsTerminated, statusKey(job.Status, append(timeKey(*job.Terminated), job.ID...))
+}
+
+// putJob stores job and updates the indexes.
+func putJob(tx *bolt.Tx, job *slicerjob.Job) error {
+	ck := createdKey(job)
+	var prev *slicerjob.Job
+	if js := boltGet(tx, dbJobs, job.ID); js != nil && json.Unmarshal(js, &prev) == nil {
+		if prev.Status != job.Status {
+			err := tx.Bucket(b(dbJobsStatus)).Delete(statusKey(prev.Status, createdKey(prev)))
+			if err != nil {
+				return err
+			}
+		}
+		index, key := expiryKey(prev)
+		if newIndex, newKey := expiryKey(job); key != nil && (index != newIndex || !bytes.Equal(key, newKey)) {
+			err := tx.Bucket(b(index)).Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := boltPutJSON(tx, dbJobs, job.ID, job)
+	if err != nil {
+		return err
+	}
+	return indexJob(tx, job, ck)
+}
+
+func indexJob(tx *bolt.Tx, job *slicerjob.Job, ck []byte) error {
+	err := tx.Bucket(b(dbJobsCreated)).Put(ck, []byte{byte(job.Status)})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(b(dbJobsStatus)).Put(statusKey(job.Status, ck), []byte{})
+	if err != nil {
+		return err
+	}
+	if index, key := expiryKey(job); key != nil {
+		return tx.Bucket(b(index)).Put(key, []byte{})
+	}
+	return nil
+}
+
+// unindexJob removes job from the indexes.
+func unindexJob(tx *bolt.Tx, job *slicerjob.Job) error {
+	ck := createdKey(job)
+	err := tx.Bucket(b(dbJobsCreated)).Delete(ck)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(b(dbJobsStatus)).Delete(statusKey(job.Status, ck))
+	if err != nil {
+		return err
+	}
+	if index, key := expiryKey(job); key != nil {
+		return tx.Bucket(b(index)).Delete(key)
+	}
+	return nil
+}
+
+// createIndexes creates the job indexes if they do not exist, indexing any
+// jobs stored before the indexes were introduced.
+func createIndexes(tx *bolt.Tx) error {
+	var missing bool
+	for _, index := range []string{dbJobsCreated, dbJobsStatus, dbJobsTerminated, dbJobsTTL} {
+		if tx.Bucket(b(index)) != nil {
+			continue
+		}
+		missing = true
+		_, err := tx.CreateBucket(b(index))
+		if err != nil {
+			return err
+		}
+	}
+	if !missing {
+		return nil
+	}
+	return tx.Bucket(b(dbJobs)).ForEach(func(k, v []byte) error {
+		var job *slicerjob.Job
+		err := json.Unmarshal(v, &job)
+		if err != nil {
+			logger.With("job", string(k)).Errorf("unmarshal job: %v", err)
+			return nil
+		}
+		return indexJob(tx, job, createdKey(job))
+	})
+}
+
+// indexScan iterates over the entries of an index which begin with prefix
+// and are followed by a creation key in the range [lo, hi).  Nil bounds are
+// unlimited.  Entries are visited in order of creation, or the reverse, and
+// start after the creation key after, if it is not nil.  The scan stops when
+// fn returns false.
+type indexScan struct {
+	prefix  []byte
+	lo, hi  []byte
+	after   []byte
+	reverse bool
+}
+
+func (s *indexScan) each(bucket *bolt.Bucket, fn func(created, v []byte) bool) {
+	cur := bucket.Cursor()
+	var k, v []byte
+	if s.reverse {
+		upper := s.hi
+		if s.after != nil && (upper == nil || bytes.Compare(s.after, upper) < 0) {
+			upper = s.after
+		}
+		var end []byte
+		if upper != nil {
+			end = concat(s.prefix, upper)
+		} else {
+			end = prefixEnd(s.prefix)
+		}
+		if end == nil {
+			k, v = cur.Last()
+		} else if k, v = cur.Seek(end); k == nil {
+			k, v = cur.Last()
+		} else {
+			k, v = cur.Prev()
+		}
+	} else {
+		lower := s.lo
+		skip := false
+		if s.after != nil && (lower == nil || bytes.Compare(s.after, lower) >= 0) {
+			lower = s.after
+			skip = true
+		}
+		k, v = cur.Seek(concat(s.prefix, lower))
+		if skip && k != nil && bytes.Equal(k, concat(s.prefix, lower)) {
+			k, v = cur.Next()
+		}
+	}
+	for k != nil && bytes.HasPrefix(k, s.prefix) {
+		created := k[len(s.prefix):]
+		if s.reverse && s.lo != nil && bytes.Compare(created, s.lo) < 0 {
+			return
+		}
+		if !s.reverse && s.hi != nil && bytes.Compare(created, s.hi) >= 0 {
+			return
+		}
+		if !fn(created, v) {
+			return
+		}
+		if s.reverse {
+			k, v = cur.Prev()
+		} else {
+			k, v = cur.Next()
+		}
+	}
+}
+
+func concat(p, q []byte) []byte {
+	return append(append([]byte(nil), p...), q...)
+}
+
+// prefixEnd returns the least key greater than every key beginning with
+// prefix, or nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// errShutdown is given to slicing jobs which are interrupted because the
+// server is shutting down.
+var errShutdown = fmt.Errorf("server shutting down")
+
+// lifecycle tracks the goroutines which must finish before the server exits.
+type lifecycle struct {
+	mu         sync.Mutex
+	draining   bool
+	consumers  sync.WaitGroup
+	background sync.WaitGroup
+}
+
+// Draining returns true once the server has begun shutting down and will not
+// accept new jobs.
+func (srv *SnuggieServer) Draining() bool {
+	srv.life.mu.Lock()
+	defer srv.life.mu.Unlock()
+	return srv.life.draining
+}
+
+// StartConsumers runs srv.Workers consumers in the background.
+func (srv *SnuggieServer) StartConsumers() {
+	for i := 0; i < srv.Workers; i++ {
+		srv.life.consumers.Add(1)
+		go func() {
+			defer srv.life.consumers.Done()
+			srv.RunConsumer()
+		}()
+	}
+}
+
+// goBackground runs fn in a goroutine which is waited on during shutdown.
+func (srv *SnuggieServer) goBackground(fn func()) {
+	srv.life.background.Add(1)
+	go func() {
+		defer srv.life.background.Done()
+		fn()
+	}()
+}
+
+// RequeueJobs schedules the jobs which were waiting to be sliced when the
+// server last stopped.  RequeueJobs must be called before consumers are
+// started.
+func (srv *SnuggieServer) RequeueJobs() error {
+	var n int
+	var seek []byte
+	for {
+		var jobs []*slicerjob.Job
+		var err error
+		jobs, seek, err = srv.Store.ListJobs(0, 100, seek, &JobQuery{
+			Status: []slicerjob.Status{slicerjob.Accepted, slicerjob.Processing},
+		})
+		if err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			err := srv.requeueJob(job)
+			if err != nil {
+				logger.With("job", job.ID).Errorf("requeue: %v", err)
+				continue
+			}
+			n++
+		}
+		if len(jobs) == 0 || seek == nil {
+			break
+		}
+	}
+	if n > 0 {
+		logger.Infof("requeued %d jobs", n)
+	}
+	return nil
+}
+
+func (srv *SnuggieServer) requeueJob(job *slicerjob.Job) error {
+	key, err := srv.Store.ViewMeshFile(job.ID)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf("mesh file not found")
+	}
+	opts := &SliceOptions{
+		PostProcess: job.PostProcess,
+		Thumbnails:  job.Thumbnails,
+	}
+	return srv.S.ScheduleSliceJob(job.ID, srv.url("/meshes/"+job.ID), job.Slicer, job.Preset, opts)
+}
+
+// Drain stops the server from accepting jobs and waits for running slices to
+// finish.  Slices still running after timeout are cancelled and their jobs
+// are left waiting, to be requeued when the server restarts.  Drain also
+// waits, for the remainder of timeout, on background deliveries.
+func (srv *SnuggieServer) Drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	srv.life.mu.Lock()
+	srv.life.draining = true
+	srv.life.mu.Unlock()
+
+	q, _ := srv.C.(QueueCloser)
+	if q != nil {
+		q.Close()
+	}
+	if !waitTimeout(&srv.life.consumers, timeout) {
+		logger.Warnf("cancelling slices still running after %v", timeout)
+		if q != nil {
+			q.CancelRunning(errShutdown)
+		}
+		srv.life.consumers.Wait()
+	}
+	if !waitTimeout(&srv.life.background, deadline.Sub(time.Now())) {
+		logger.Warnf("abandoning background tasks still running after %v", timeout)
+	}
+}
+
+// waitTimeout waits for wg and returns false if it did not finish within
+// timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	if timeout <= 0 {
+		timeout = time.Millisecond
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// rejectDraining responds 503 Service Unavailable and returns true if the
+// server is shutting down.
+func (srv *SnuggieServer) rejectDraining(w http.ResponseWriter) bool {
+	if !srv.Draining() {
+		return false
+	}
+	w.Header().Set("Retry-After", "30")
+	http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+	return true
+}
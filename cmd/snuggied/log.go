@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// Messages below the level of a Logger are discarded.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelStrings = []string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelStrings) {
+		return fmt.Sprintf("level%d", int(l))
+	}
+	return levelStrings[l]
+}
+
+// ParseLevel returns the Level named by s.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelStrings {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %q", s)
+}
+
+// logger is used by the server and its background processes.  It is
+// configured by flags in main.
+var logger = NewLogger(os.Stderr, LevelInfo, false)
+
+// Logger writes messages annotated with fields identifying the node, job, or
+// request they concern.  Messages are written as text, or one JSON object
+// per line.  Loggers created with With share the output of their parent.
+type Logger struct {
+	out    *logOutput
+	fields []logField
+}
+
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+}
+
+type logField struct {
+	Key   string
+	Value interface{}
+}
+
+// NewLogger returns a Logger that writes messages of at least the given level
+// to w.
+func NewLogger(w io.Writer, level Level, asJSON bool) *Logger {
+	return &Logger{out: &logOutput{w: w, level: level, json: asJSON}}
+}
+
+// With returns a Logger which adds fields to every message.  Fields are given
+// as alternating keys and values.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]logField, len(l.fields), len(l.fields)+len(kv)/2)
+	copy(fields, l.fields)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields = append(fields, logField{fmt.Sprint(kv[i]), kv[i+1]})
+	}
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled returns true if messages at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) { l.logf(LevelDebug, format, v...) }
+func (l *Logger) Infof(format string, v ...interface{})  { l.logf(LevelInfo, format, v...) }
+func (l *Logger) Warnf(format string, v ...interface{})  { l.logf(LevelWarn, format, v...) }
+func (l *Logger) Errorf(format string, v ...interface{}) { l.logf(LevelError, format, v...) }
+
+// Fatalf writes an error message and exits the process.
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.logf(LevelError, format, v...)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(level Level, format string, v ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.write(time.Now(), level, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) write(t time.Time, level Level, msg string) {
+	var buf bytes.Buffer
+	if l.out.json {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, t.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for _, f := range l.fields {
+			buf.WriteString(",")
+			writeJSON(&buf, f.Key)
+			buf.WriteString(":")
+			writeJSON(&buf, f.Value)
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s %s", t.Format("2006/01/02 15:04:05.000"), strings.ToUpper(level.String()), msg)
+		for _, f := range l.fields {
+			fmt.Fprintf(&buf, " %s=%s", f.Key, formatValue(f.Value))
+		}
+		buf.WriteString("\n")
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		js, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(js)
+}
+
+// formatValue quotes field values in text output when they contain spaces
+// or quotes.
+func formatValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// Writer returns a writer which logs each line written to it as a message
+// at level.  Close waits for all lines, including a final incomplete line,
+// to be logged.
+func (l *Logger) Writer(level Level) io.WriteCloser {
+	r, w := io.Pipe()
+	lw := &lineWriter{PipeWriter: w, done: make(chan struct{})}
+	go func() {
+		defer close(lw.done)
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			l.logf(level, "%s", s.Text())
+		}
+		// drain the pipe if a line was too long to scan.
+		io.Copy(ioutil.Discard, r)
+	}()
+	return lw
+}
+
+type lineWriter struct {
+	*io.PipeWriter
+	done chan struct{}
+}
+
+func (w *lineWriter) Close() error {
+	err := w.PipeWriter.Close()
+	<-w.done
+	return err
+}
+
+// newRequestID returns a random identifier for an HTTP request.
+func newRequestID() string {
+	p := make([]byte, 8)
+	_, err := rand.Read(p)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(p)
+}
+
+const requestIDHeader = "X-Request-Id"
+
+// requestLogger returns a logger for messages about r.
+func requestLogger(r *http.Request) *Logger {
+	return logger.With("request", r.Header.Get(requestIDHeader))
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// logRequests assigns each request an identifier, unless the client provided
+// one in the X-Request-Id header, and logs the request after it is served.
+// The identifier is returned to the client in the response headers.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		level := LevelDebug
+		if sw.status >= 500 {
+			level = LevelWarn
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		requestLogger(r).logf(level, "%s %s %d %v", r.Method, r.URL.Path, sw.status, time.Since(start))
+	})
+}
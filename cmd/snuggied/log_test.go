@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewLogger(&buf, LevelInfo, false).With("node", "n0")
+	log.Debugf("hidden")
+	log.With("job", "abc", "mesh", "my part.stl").Infof("job %s", "created")
+	line := strings.TrimSpace(buf.String())
+	if !strings.HasSuffix(line, `INFO  job created node=n0 job=abc mesh="my part.stl"`) {
+		t.Errorf("text: %q", line)
+	}
+
+	buf.Reset()
+	log = NewLogger(&buf, LevelDebug, true).With("node", "n0")
+	w := log.With("job", "abc").Writer(LevelWarn)
+	io.WriteString(w, "line one\nline ")
+	io.WriteString(w, "two")
+	w.Close()
+	var msgs []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var m map[string]interface{}
+		err := dec.Decode(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, m)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("messages: %d", len(msgs))
+	}
+	for i, m := range msgs {
+		want := map[string]interface{}{
+			"level": "warn",
+			"msg":   []string{"line one", "line two"}[i],
+			"node":  "n0",
+			"job":   "abc",
+		}
+		for k, v := range want {
+			if fmt.Sprint(m[k]) != fmt.Sprint(v) {
+				t.Errorf("message %d: %s=%v (!= %v)", i, k, m[k], v)
+			}
+		}
+	}
+}
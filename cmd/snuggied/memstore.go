@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/gcode"
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// MemStore is a JobStore held in memory, for servers which do not need jobs
+// to outlive the process and for tests.  Jobs are copied when they are
+// stored and retrieved.  Operations on a MemStore are fast enough that their
+// maximum durations are ignored.
+type MemStore struct {
+	mu      sync.Mutex
+	jobs    map[string][]byte
+	created map[string][]byte // creation keys of jobs
+	events  map[string][]*slicerjob.Event
+	meshes  map[string]string
+	gcodes  map[string]string
+	layers  map[string]*gcode.LayerIndex
+	deleted []*DeletedFile
+	closed  bool
+}
+
+var _ JobStore = new(MemStore)
+
+// MemoryStore allocates and initializes a new MemStore.
+func MemoryStore() *MemStore {
+	return &MemStore{
+		jobs:    make(map[string][]byte),
+		created: make(map[string][]byte),
+		events:  make(map[string][]*slicerjob.Event),
+		meshes:  make(map[string]string),
+		gcodes:  make(map[string]string),
+		layers:  make(map[string]*gcode.LayerIndex),
+	}
+}
+
+var errStoreClosed = fmt.Errorf("store closed")
+
+func (s *MemStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *MemStore) Ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	return nil
+}
+
+// job decodes the stored copy of job id.
+func (s *MemStore) job(id string) *slicerjob.Job {
+	js := s.jobs[id]
+	if js == nil {
+		return nil
+	}
+	var job *slicerjob.Job
+	err := json.Unmarshal(js, &job)
+	if err != nil {
+		logger.With("job", id).Errorf("unmarshal job: %v", err)
+		return nil
+	}
+	return job
+}
+
+func (s *MemStore) putJob(job *slicerjob.Job) error {
+	js, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	s.jobs[job.ID] = js
+	s.created[job.ID] = createdKey(job)
+	return nil
+}
+
+func (s *MemStore) putEvent(job *slicerjob.Job, ev *slicerjob.Event) {
+	completeEvent(job, ev)
+	cp := *ev
+	s.events[job.ID] = append(s.events[job.ID], &cp)
+}
+
+func (s *MemStore) InsertJob(job *slicerjob.Job, ev *slicerjob.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jobs[job.ID] != nil {
+		return fmt.Errorf("job exists")
+	}
+	err := s.putJob(job)
+	if err != nil {
+		return err
+	}
+	if ev != nil {
+		s.putEvent(job, ev)
+	}
+	return nil
+}
+
+func (s *MemStore) ViewJob(id string) (*slicerjob.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.job(id)
+	if job == nil {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+func (s *MemStore) UpdateJob(id string, ev *slicerjob.Event, fn func(job *slicerjob.Job) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := s.job(id)
+	if job == nil {
+		return ErrJobNotFound
+	}
+	err := applyUpdate(job, fn)
+	if err != nil {
+		return err
+	}
+	err = s.putJob(job)
+	if err != nil {
+		return err
+	}
+	if ev != nil {
+		s.putEvent(job, ev)
+	}
+	return nil
+}
+
+func (s *MemStore) DeleteJob(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteJob(id)
+	return nil
+}
+
+func (s *MemStore) deleteJob(id string) {
+	if path, ok := s.meshes[id]; ok {
+		s.deleted = append(s.deleted, &DeletedFile{Key: deletedFileKey("meshes", id), Path: path, Mesh: true})
+		delete(s.meshes, id)
+	}
+	if path, ok := s.gcodes[id]; ok {
+		s.deleted = append(s.deleted, &DeletedFile{Key: deletedFileKey("gcodes", id), Path: path})
+		delete(s.gcodes, id)
+	}
+	delete(s.layers, id)
+	delete(s.events, id)
+	delete(s.created, id)
+	delete(s.jobs, id)
+}
+
+// ordered returns the ids of jobs in order of creation.
+func (s *MemStore) ordered() []string {
+	ids := make([]string, 0, len(s.created))
+	for id := range s.created {
+		ids = append(ids, id)
+	}
+	sort.Sort(&createdOrder{ids, s.created})
+	return ids
+}
+
+type createdOrder struct {
+	ids  []string
+	keys map[string][]byte
+}
+
+func (o *createdOrder) Len() int      { return len(o.ids) }
+func (o *createdOrder) Swap(i, j int) { o.ids[i], o.ids[j] = o.ids[j], o.ids[i] }
+func (o *createdOrder) Less(i, j int) bool {
+	return bytes.Compare(o.keys[o.ids[i]], o.keys[o.ids[j]]) < 0
+}
+
+func (s *MemStore) ListJobs(maxDur time.Duration, limit int, cursor []byte, q *JobQuery) ([]*slicerjob.Job, []byte, error) {
+	if q == nil {
+		q = &JobQuery{}
+	}
+	var lo, hi []byte
+	if !q.CreatedAfter.IsZero() {
+		lo = timeKey(q.CreatedAfter)
+	}
+	if !q.CreatedBefore.IsZero() {
+		hi = timeKey(q.CreatedBefore)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := s.ordered()
+	if q.Newest {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+	var jobs []*slicerjob.Job
+	for _, id := range ids {
+		ck := s.created[id]
+		if cursor != nil {
+			c := bytes.Compare(ck, cursor)
+			if c == 0 || (c < 0) != q.Newest {
+				continue
+			}
+		}
+		if (lo != nil && bytes.Compare(ck, lo) < 0) || (hi != nil && bytes.Compare(ck, hi) >= 0) {
+			continue
+		}
+		job := s.job(id)
+		if job == nil || !q.hasStatus(job.Status) {
+			continue
+		}
+		if q.Filter != nil {
+			err := q.Filter(job)
+			if err == ErrSkip {
+				continue
+			}
+			if err == ErrStop {
+				return jobs, nil, nil
+			}
+			if err != nil {
+				return jobs, nil, err
+			}
+		}
+		jobs = append(jobs, job)
+		if limit > 0 && len(jobs) >= limit {
+			return jobs, copyBytes(ck), nil
+		}
+	}
+	return jobs, nil, nil
+}
+
+func (s *MemStore) DeleteOldJobs(r *Retention, now time.Time, maxDur time.Duration, maxDel int) ([]*slicerjob.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted []*slicerjob.Job
+	for _, id := range s.ordered() {
+		job := s.job(id)
+		if job == nil || !job.Status.IsTerminal() || job.Terminated == nil {
+			continue
+		}
+		if r.Expires(job).After(now) {
+			continue
+		}
+		s.deleteJob(id)
+		deleted = append(deleted, job)
+		if len(deleted) >= maxDel {
+			return deleted, ErrMaxDeleted
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemStore) ViewHistory(id string) (*slicerjob.History, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := &slicerjob.History{JobID: id, Events: []*slicerjob.Event{}}
+	for _, ev := range s.events[id] {
+		cp := *ev
+		history.Events = append(history.Events, &cp)
+	}
+	return history, nil
+}
+
+func (s *MemStore) PutMeshFile(id, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meshes[id] = path
+	return nil
+}
+
+func (s *MemStore) ViewMeshFile(id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meshes[id], nil
+}
+
+func (s *MemStore) PutGCodeFile(id, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gcodes[id] = path
+	return nil
+}
+
+func (s *MemStore) ViewGCodeFile(id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gcodes[id], nil
+}
+
+func (s *MemStore) PutLayerIndex(id string, idx *gcode.LayerIndex) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.layers[id] = idx
+	return nil
+}
+
+func (s *MemStore) ViewLayerIndex(id string) (*gcode.LayerIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.layers[id], nil
+}
+
+func (s *MemStore) DeletedFiles(limit int) ([]*DeletedFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []*DeletedFile
+	for _, f := range s.deleted {
+		if limit > 0 && len(files) >= limit {
+			break
+		}
+		cp := *f
+		files = append(files, &cp)
+	}
+	return files, nil
+}
+
+func (s *MemStore) FileRemoved(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.deleted {
+		if f.Key == key {
+			s.deleted = append(s.deleted[:i], s.deleted[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
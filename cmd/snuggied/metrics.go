@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the histogram buckets
+// for slicing times and queue waits.
+var durationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// histogram counts observations in durationBuckets.  Counts are not
+// cumulative; the Prometheus representation is computed when written.
+type histogram struct {
+	Counts []int
+	Sum    float64
+	Count  int
+}
+
+// observe adds d to the histogram for label in hists, creating it if
+// necessary.
+func observe(hists map[string]*histogram, label string, d time.Duration) {
+	h := hists[label]
+	if h == nil {
+		h = &histogram{Counts: make([]int, len(durationBuckets))}
+		hists[label] = h
+	}
+	v := d.Seconds()
+	for i, le := range durationBuckets {
+		if v <= le {
+			h.Counts[i]++
+			break
+		}
+	}
+	h.Sum += v
+	h.Count++
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (m *metricsWriter) printf(format string, v ...interface{}) {
+	if m.err != nil {
+		return
+	}
+	_, m.err = fmt.Fprintf(m.w, format, v...)
+}
+
+// header writes the HELP and TYPE lines of a metric.
+func (m *metricsWriter) header(name, typ, help string) {
+	m.printf("# HELP %s %s\n", name, help)
+	m.printf("# TYPE %s %s\n", name, typ)
+}
+
+// sample writes a single value.  Labels are given as alternating names and
+// values.
+func (m *metricsWriter) sample(name string, v float64, labels ...string) {
+	m.printf("%s%s %s\n", name, formatLabels(labels), strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// histograms writes a histogram metric with a sample set for each label
+// value in hists.
+func (m *metricsWriter) histograms(name, help, label string, hists map[string]*histogram) {
+	m.header(name, "histogram", help)
+	var keys []string
+	for k := range hists {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := hists[k]
+		n := 0
+		for i, le := range durationBuckets {
+			n += h.Counts[i]
+			m.sample(name+"_bucket", float64(n), label, k, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		m.sample(name+"_bucket", float64(h.Count), label, k, "le", "+Inf")
+		m.sample(name+"_sum", h.Sum, label, k)
+		m.sample(name+"_count", float64(h.Count), label, k)
+	}
+}
+
+type jobsKeys []jobsKey
+
+func (k jobsKeys) Len() int      { return len(k) }
+func (k jobsKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k jobsKeys) Less(i, j int) bool {
+	if k[i].Slicer != k[j].Slicer {
+		return k[i].Slicer < k[j].Slicer
+	}
+	return k[i].Status < k[j].Status
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var parts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// WriteMetrics writes the totals collected by s along with the queue state
+// of q and the size of db (any of which may be nil) for a server with the
+// given number of workers.
+func (s *Stats) WriteMetrics(w io.Writer, q QueueStater, db StoreSizer, workers int) error {
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+
+	s.writeTotals(m)
+
+	if q != nil {
+		running, queued := q.QueueStats()
+		m.header("snuggied_queue_length", "gauge", "Jobs waiting to be sliced.")
+		m.sample("snuggied_queue_length", float64(queued))
+		m.header("snuggied_jobs_running", "gauge", "Jobs being sliced.")
+		m.sample("snuggied_jobs_running", float64(running))
+		if workers > 0 {
+			m.header("snuggied_worker_occupancy", "gauge", "Fraction of slicing workers which are busy.")
+			m.sample("snuggied_worker_occupancy", float64(running)/float64(workers))
+		}
+	}
+	m.header("snuggied_workers", "gauge", "Slicing workers run by the server.")
+	m.sample("snuggied_workers", float64(workers))
+
+	if db != nil {
+		size, err := db.Size()
+		if err == nil {
+			m.header("snuggied_db_size_bytes", "gauge", "Size of the job database.")
+			m.sample("snuggied_db_size_bytes", float64(size))
+		}
+	}
+
+	if m.err != nil {
+		return m.err
+	}
+	return m.w.Flush()
+}
+
+// writeTotals writes the totals collected by s.  Nothing is written if s is
+// nil.
+func (s *Stats) writeTotals(m *metricsWriter) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []jobsKey
+	for k := range s.jobs {
+		keys = append(keys, k)
+	}
+	sort.Sort(jobsKeys(keys))
+	m.header("snuggied_jobs_total", "counter", "Jobs which entered each status, by slicer backend.")
+	for _, k := range keys {
+		m.sample("snuggied_jobs_total", float64(s.jobs[k]), "backend", k.Slicer, "status", k.Status.String())
+	}
+	var slicers []string
+	for slicer := range s.retries {
+		slicers = append(slicers, slicer)
+	}
+	sort.Strings(slicers)
+	m.header("snuggied_jobs_retried_total", "counter", "Failed slices which were retried, by slicer backend.")
+	for _, slicer := range slicers {
+		m.sample("snuggied_jobs_retried_total", float64(s.retries[slicer]), "backend", slicer)
+	}
+	m.histograms("snuggied_slice_duration_seconds", "Time spent slicing completed jobs.", "preset", s.sliceTimes)
+	m.histograms("snuggied_queue_wait_seconds", "Time jobs spent queued before slicing began.", "preset", s.queueWaits)
+	m.header("snuggied_gc_files_removed_total", "counter", "Files removed by the garbage collector.")
+	m.sample("snuggied_gc_files_removed_total", float64(s.gcFiles))
+	m.header("snuggied_gc_jobs_deleted_total", "counter", "Jobs deleted by the garbage collector.")
+	m.sample("snuggied_gc_jobs_deleted_total", float64(s.gcJobs))
+	m.header("snuggied_gc_jobs_evicted_total", "counter", "Jobs deleted by the garbage collector to enforce the disk quota.")
+	m.sample("snuggied_gc_jobs_evicted_total", float64(s.gc.EvictedJobs))
+}
+
+// GetMetrics responds with server metrics in the Prometheus text format.
+func (srv *SnuggieServer) GetMetrics(w http.ResponseWriter, r *http.Request) {
+	q, _ := srv.S.(QueueStater)
+	db, _ := srv.Store.(StoreSizer)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := srv.Stats.WriteMetrics(w, q, db, srv.Workers)
+	if err != nil {
+		requestLogger(r).Warnf("http response: %v", err)
+	}
+}
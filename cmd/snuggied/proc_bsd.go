@@ -0,0 +1,21 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package main
+
+import "fmt"
+
+var errLimitsUnsupported = fmt.Errorf("cpu and memory limits unsupported on this platform")
+
+// setLimits applies the priority of the slicer process pid.  Processor time
+// and memory limits are not supported.
+func setLimits(pid int, limits *Limits, cgroupMemory bool) error {
+	err := setNice(pid, limits.Nice)
+	if err != nil {
+		return err
+	}
+	if limits.CPUTime > 0 || limits.Memory > 0 {
+		return errLimitsUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// setLimits applies the processor time, memory, and priority limits to the
+// slicer process pid after it has started.  The memory limit is not applied
+// if it is enforced by a cgroup.
+func setLimits(pid int, limits *Limits, cgroupMemory bool) error {
+	if limits.CPUTime > 0 {
+		// the process receives SIGXCPU at the soft limit and is killed one
+		// second later if it handles the signal.
+		sec := uint64((limits.CPUTime + time.Second - 1) / time.Second)
+		err := prlimit(pid, syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: sec, Max: sec + 1})
+		if err != nil {
+			return fmt.Errorf("cpu: %v", err)
+		}
+	}
+	if limits.Memory > 0 && !cgroupMemory {
+		n := uint64(limits.Memory)
+		err := prlimit(pid, syscall.RLIMIT_AS, &syscall.Rlimit{Cur: n, Max: n})
+		if err != nil {
+			return fmt.Errorf("memory: %v", err)
+		}
+	}
+	return setNice(pid, limits.Nice)
+}
+
+func prlimit(pid int, resource int, limit *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64,
+		uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
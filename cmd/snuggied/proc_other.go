@@ -0,0 +1,42 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// newProcAttr returns default process attributes.  Process groups are not
+// supported on this platform.
+func newProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
+
+// killGroup kills p.  Its children are not killed.
+func killGroup(p *os.Process) error {
+	err := p.Kill()
+	if err == os.ErrProcessDone {
+		return nil
+	}
+	return err
+}
+
+// setLimits returns an error if any limits are given because they are not
+// supported on this platform.
+func setLimits(pid int, limits *Limits, cgroupMemory bool) error {
+	if limits.CPUTime > 0 || limits.Memory > 0 || limits.Nice != 0 {
+		return fmt.Errorf("process limits unsupported on this platform")
+	}
+	return nil
+}
+
+func cpuLimitSignaled(state *os.ProcessState) bool {
+	return false
+}
+
+func crashSignaled(state *os.ProcessState) bool {
+	return false
+}
@@ -0,0 +1,53 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// newProcAttr starts the slicer in a new process group.
+func newProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killGroup kills the process group led by p.
+func killGroup(p *os.Process) error {
+	err := syscall.Kill(-p.Pid, syscall.SIGKILL)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
+
+// setNice sets the scheduling priority of the process group led by pid.
+func setNice(pid, nice int) error {
+	if nice == 0 {
+		return nil
+	}
+	return syscall.Setpriority(syscall.PRIO_PGRP, pid, nice)
+}
+
+// cpuLimitSignaled returns true if the process was terminated by the signal
+// sent when it exceeds its processor time limit.
+func cpuLimitSignaled(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGXCPU
+}
+
+// crashSignaled returns true if the process was terminated by a signal sent
+// when it crashes or is killed by the kernel, as happens when it cannot
+// allocate memory.
+func crashSignaled(state *os.ProcessState) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	switch status.Signal() {
+	case syscall.SIGSEGV, syscall.SIGBUS, syscall.SIGABRT, syscall.SIGKILL:
+		return true
+	}
+	return false
+}
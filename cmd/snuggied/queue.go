@@ -2,15 +2,17 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"sync"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
 )
 
 // Scheduler is the write-end of a job queue.  It takes a mesh file url, the
-// name of a slicer and a preset for that slicer.  Scheduler is responsible for
-// routing the job to a machine capable of servicing the request.
+// name of a slicer, a preset for that slicer, and any additional options.
+// Scheduler is responsible for routing the job to a machine capable of
+// servicing the request.
 type Scheduler interface {
-	ScheduleSliceJob(id, meshurl, slicer, preset string) error
+	ScheduleSliceJob(id, meshurl, slicer, preset string, opts *SliceOptions) error
 	CancelSliceJob(id string)
 }
 
@@ -20,6 +22,22 @@ type Consumer interface {
 	NextSliceJob() (*Job, error)
 }
 
+// SliceOptions are settings for a job beyond the slicer preset.
+type SliceOptions struct {
+	// PostProcess lists built-in G-code processors to apply, in order, to
+	// the slicer output.
+	PostProcess []slicerjob.PostProcessor
+
+	// Thumbnails lists the dimensions of images to embed in the G-code, like
+	// "16x16,220x124", overriding the preset's "thumbnails" setting.  The
+	// value "none" disables thumbnails.
+	Thumbnails string
+
+	// RequestID identifies the HTTP request which created the job so that
+	// messages logged while processing the job can be correlated with it.
+	RequestID string
+}
+
 type Job struct {
 	// NodeID is the job's originating node.
 	NodeID  string
@@ -27,6 +45,7 @@ type Job struct {
 	MeshURL string
 	Slicer  string
 	Preset  string
+	Options *SliceOptions
 
 	// Cancel receives a value if the job has been cancelled by the scheduling
 	// process.
@@ -38,6 +57,15 @@ type Job struct {
 	Done func(path string, err error)
 }
 
+// Logger returns a logger for messages about j.
+func (j *Job) Logger() *Logger {
+	log := logger.With("job", j.ID)
+	if j.Options != nil && j.Options.RequestID != "" {
+		log = log.With("request", j.Options.RequestID)
+	}
+	return log
+}
+
 // MemQueue is an in memory database and job queue that implements the
 // Scheduler and Consumer interfaces.  MemQueue is safe for many producers and
 // consumers to be calling interface methods simultaneously.
@@ -48,10 +76,28 @@ type MemQueue struct {
 	cond    sync.Cond
 	jobs    []*memJob
 	db      map[string]*memJob
+	closed  bool
 }
 
 var _ Scheduler = new(MemQueue)
 var _ Consumer = new(MemQueue)
+var _ QueueStater = new(MemQueue)
+var _ QueueCloser = new(MemQueue)
+
+// ErrQueueClosed is returned by a Consumer which will not hand out more jobs.
+var ErrQueueClosed = fmt.Errorf("queue closed")
+
+// QueueCloser is implemented by queues which can be stopped when the server
+// shuts down.
+type QueueCloser interface {
+	// Close causes consumers to receive ErrQueueClosed instead of further
+	// jobs.  Jobs which have not been dequeued remain in the queue.
+	Close()
+
+	// CancelRunning cancels the jobs which have been dequeued but have not
+	// terminated, passing err to their Cancel channels.
+	CancelRunning(err error)
+}
 
 // MemoryQueue allocates and initializes a new MemQueue.  The function argument
 // is called when consumers finish work on a job.
@@ -63,27 +109,32 @@ func MemoryQueue(done func(id, path string, err error)) *MemQueue {
 	}
 }
 
-func (q *MemQueue) jobTerminated(id string) {
+func (q *MemQueue) jobTerminated(j *memJob) {
 	q.cond.L.Lock()
-	delete(q.db, id)
+	delete(q.db, j.ID)
 	qlen := len(q.jobs)
 	dblen := len(q.db)
 	q.cond.L.Unlock()
-	log.Printf("jobs running:%d queued:%d", dblen-qlen, qlen)
+	j.Job().Logger().With("running", dblen-qlen, "queued", qlen).Debugf("job left queue")
 }
 
 // ScheduleSliceJob enqueues a job in q.
-func (q *MemQueue) ScheduleSliceJob(id, meshurl, slicer, preset string) error {
-	j := &memJob{
+func (q *MemQueue) ScheduleSliceJob(id, meshurl, slicer, preset string, opts *SliceOptions) error {
+	if opts == nil {
+		opts = &SliceOptions{}
+	}
+	var j *memJob
+	j = &memJob{
 		ID:       id,
 		NodeID:   q.NodeID,
 		Location: meshurl,
 		Slicer:   slicer,
 		Preset:   preset,
+		Options:  opts,
 		Cancel:   make(chan error, 1),
 		Done:     make(chan struct{}),
 		Fin: func(id, path string, err error) {
-			q.jobTerminated(id)
+			q.jobTerminated(j)
 			if q.Done != nil {
 				q.Done(id, path, err)
 			}
@@ -99,18 +150,64 @@ func (q *MemQueue) ScheduleSliceJob(id, meshurl, slicer, preset string) error {
 	dblen := len(q.db)
 	q.cond.Signal()
 	q.cond.L.Unlock()
-	log.Printf("jobs running:%d queued:%d", dblen-qlen, qlen)
+	j.Job().Logger().With("running", dblen-qlen, "queued", qlen).Infof("job queued")
 
 	return nil
 }
 
+// QueueStats returns the number of jobs being sliced and the number waiting
+// to be sliced.  Unlike the logged counts, cancelled jobs which have not been
+// dequeued are excluded.
+func (q *MemQueue) QueueStats() (running, queued int) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for _, j := range q.jobs {
+		if q.db[j.ID] != nil {
+			queued++
+		}
+	}
+	return len(q.db) - queued, queued
+}
+
+// Close implements QueueCloser.
+func (q *MemQueue) Close() {
+	q.cond.L.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.cond.L.Unlock()
+}
+
+// CancelRunning implements QueueCloser.
+func (q *MemQueue) CancelRunning(err error) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	queued := make(map[string]bool, len(q.jobs))
+	for _, j := range q.jobs {
+		queued[j.ID] = true
+	}
+	for id, j := range q.db {
+		if queued[id] {
+			continue
+		}
+		select {
+		case j.Cancel <- err:
+		default:
+			// the job has already been cancelled.
+		}
+	}
+}
+
 // BUG:
 // CancelSliceJob can temporarily skew the count of queued jobs because pending
 // jobs are not removed from the queue immediately on cancellation.
 func (q *MemQueue) CancelSliceJob(id string) {
 	q.cond.L.Lock()
 	if j := q.db[id]; j != nil {
-		j.Cancel <- fmt.Errorf("the job was cancelled")
+		select {
+		case j.Cancel <- fmt.Errorf("the job was cancelled"):
+		default:
+			// the job has already been cancelled.
+		}
 		delete(q.db, id)
 	}
 	q.cond.L.Unlock()
@@ -119,9 +216,13 @@ func (q *MemQueue) CancelSliceJob(id string) {
 // NextSliceJob dequeues a job from q or blocks until one is available.
 func (q *MemQueue) NextSliceJob() (*Job, error) {
 	q.cond.L.Lock()
-	for len(q.jobs) == 0 {
+	for len(q.jobs) == 0 && !q.closed {
 		q.cond.Wait()
 	}
+	if q.closed {
+		q.cond.L.Unlock()
+		return nil, ErrQueueClosed
+	}
 	j := q.jobs[0]
 	q.jobs = q.jobs[1:]
 	qlen := len(q.jobs)
@@ -140,9 +241,10 @@ func (q *MemQueue) NextSliceJob() (*Job, error) {
 			q.Started(j.ID)
 		}
 	}()
-	log.Printf("jobs running:%d queued:%d", dblen-qlen, qlen)
+	job := j.Job()
+	job.Logger().With("running", dblen-qlen, "queued", qlen).Infof("job dequeued")
 
-	return j.Job(), nil
+	return job, nil
 }
 
 type memJob struct {
@@ -151,6 +253,7 @@ type memJob struct {
 	Location string
 	Slicer   string
 	Preset   string
+	Options  *SliceOptions
 	Cancel   chan error
 	Done     chan struct{}
 	Fin      func(string, string, error)
@@ -163,6 +266,7 @@ func (m *memJob) Job() *Job {
 		MeshURL: m.Location,
 		Slicer:  m.Slicer,
 		Preset:  m.Preset,
+		Options: m.Options,
 		Cancel:  m.Cancel,
 		Done: func(path string, err error) {
 			close(m.Done)
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemQueueClose(t *testing.T) {
+	q := MemoryQueue(nil)
+	q.ScheduleSliceJob("a", "file:///a.stl", "slic3r", "hq", nil)
+	q.ScheduleSliceJob("b", "file:///b.stl", "slic3r", "hq", nil)
+
+	job, err := q.NextSliceJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "a" {
+		t.Fatalf("job: %v", job.ID)
+	}
+
+	q.Close()
+	_, err = q.NextSliceJob()
+	if err != ErrQueueClosed {
+		t.Fatalf("closed queue: %v", err)
+	}
+	if running, queued := q.QueueStats(); running != 1 || queued != 1 {
+		t.Errorf("running:%d queued:%d", running, queued)
+	}
+
+	// only the dequeued job is cancelled.
+	q.CancelRunning(errShutdown)
+	select {
+	case err := <-job.Cancel:
+		if err != errShutdown {
+			t.Errorf("cancel: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("running job not cancelled")
+	}
+	if len(q.db["b"].Cancel) != 0 {
+		t.Errorf("queued job cancelled")
+	}
+}
+
+func TestMemQueueCancelTwice(t *testing.T) {
+	q := MemoryQueue(nil)
+	q.ScheduleSliceJob("a", "file:///a.stl", "slic3r", "hq", nil)
+	job, err := q.NextSliceJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelling a job whose cancellation has not been received must not
+	// block the queue.
+	q.CancelRunning(errShutdown)
+	done := make(chan struct{})
+	go func() {
+		q.CancelSliceJob("a")
+		q.QueueStats()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("queue blocked by cancellation")
+	}
+	if err := <-job.Cancel; err != errShutdown {
+		t.Errorf("cancel: %v", err)
+	}
+}
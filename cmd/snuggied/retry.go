@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// RetryPolicy determines whether and when a job whose slicer failed is
+// sliced again.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a job may be sliced, including the
+	// first.  Values less than two disable retries.
+	MaxAttempts int
+
+	// Backoff is the delay before the second attempt.  The delay doubles
+	// after each attempt, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Delay returns the time to wait before the attempt following attempt n,
+// numbered from 1.
+func (p *RetryPolicy) Delay(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return d
+}
+
+// retryableError is a slicing failure which may not recur if the job is
+// sliced again.
+type retryableError struct {
+	err error
+}
+
+func (err *retryableError) Error() string {
+	return err.err.Error()
+}
+
+// isRetryableSlice returns true if a slice failing with err should be
+// retried.
+func isRetryableSlice(err error) bool {
+	_, ok := err.(*retryableError)
+	return ok
+}
+
+// isTransientRunError returns true if err, returned by Run, is unrelated to
+// the mesh being sliced.  A slicer killed by a signal it did not send itself,
+// such as by the kernel when memory is exhausted, may succeed later, as may
+// one which could not be started for lack of resources.  A slicer which exits
+// with an error status or exceeds its limits is expected to fail again.
+func isTransientRunError(err error) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		return ok && status.Signaled() && status.Signal() != syscall.SIGABRT
+	}
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOMEM)
+}
+
+// jobFailed records the failure of the current attempt to slice job id.  If
+// the failure is retryable and attempts remain the job is sliced again after
+// a delay.  Otherwise the job fails.  Cancelled jobs are not modified.
+func (srv *SnuggieServer) jobFailed(id string, err error) {
+	log := logger.With("job", id)
+	var job *slicerjob.Job
+	var retry time.Duration
+	ev := srv.event(slicerjob.EventFailed, err.Error())
+	uerr := srv.Store.UpdateJob(id, ev, func(j *slicerjob.Job) error {
+		if !j.Status.IsWaiting() {
+			return errNotWaiting
+		}
+		now := time.Now()
+		j.Updated = &now
+		var attempt *slicerjob.Attempt
+		if n := len(j.Attempts); n > 0 {
+			attempt = j.Attempts[n-1]
+		} else {
+			attempt = &slicerjob.Attempt{Number: 1, Node: srv.NodeID, Started: &now}
+			j.Attempts = append(j.Attempts, attempt)
+		}
+		attempt.Ended = &now
+		attempt.Error = err.Error()
+		attempt.Retryable = isRetryableSlice(err)
+		if attempt.Retryable && attempt.Number < srv.Retry.MaxAttempts {
+			retry = srv.Retry.Delay(attempt.Number)
+			at := now.Add(retry)
+			attempt.RetryAt = &at
+			if j.Status != slicerjob.Accepted {
+				j.SetStatus(slicerjob.Accepted, now)
+			}
+			j.Progress = 0
+			ev.Type = slicerjob.EventRetrying
+		} else {
+			j.SetStatus(slicerjob.Failed, now)
+			j.Error = err.Error()
+		}
+		job = j
+		return nil
+	})
+	if uerr == errNotWaiting {
+		return
+	}
+	if uerr != nil {
+		log.Errorf("update job: %v", uerr)
+		return
+	}
+	if job.Status == slicerjob.Failed {
+		log.Errorf("slicing failed: %v", err)
+		srv.Stats.JobTerminated(id, job.Slicer, job.Preset, slicerjob.Failed)
+		return
+	}
+	log.Warnf("slicing attempt %d failed: %v; retrying in %v", len(job.Attempts), err, retry)
+	srv.Stats.JobRetried(job.Slicer)
+	time.AfterFunc(retry, func() { srv.retryJob(id) })
+}
+
+var errNotWaiting = fmt.Errorf("job not waiting")
+
+// retryJob schedules job id to be sliced again.  Jobs cancelled while waiting
+// to be retried are ignored, and jobs waiting when the server shuts down are
+// requeued when it restarts.
+func (srv *SnuggieServer) retryJob(id string) {
+	if srv.Draining() {
+		return
+	}
+	job, err := srv.Store.ViewJob(id)
+	if err != nil || !job.Status.IsWaiting() {
+		return
+	}
+	err = srv.requeueJob(job)
+	if err != nil {
+		srv.jobFailed(id, err)
+	}
+}
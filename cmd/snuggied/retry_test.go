@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 5, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for i, d := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if delay := p.Delay(i + 1); delay != d {
+			t.Errorf("attempt %d: delay %v (expected %v)", i+1, delay, d)
+		}
+	}
+}
+
+func TestJobFailed(t *testing.T) {
+	srv := &SnuggieServer{
+		NodeID: "node0",
+		Store:  MemoryStore(),
+		Retry:  RetryPolicy{MaxAttempts: 2, Backoff: time.Hour},
+	}
+	job := slicerjob.New()
+	job.Status = slicerjob.Accepted
+	err := srv.Store.InsertJob(job, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qjob := &Job{ID: job.ID}
+
+	// the first transient failure is retried after the backoff.
+	srv.jobStarted(qjob)
+	srv.jobFailed(job.ID, &retryableError{fmt.Errorf("signal: killed")})
+	job, err = srv.Store.ViewJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != slicerjob.Accepted || len(job.Attempts) != 1 {
+		t.Fatalf("job %v with %d attempts", job.Status, len(job.Attempts))
+	}
+	a := job.Attempts[0]
+	if a.Number != 1 || a.Node != "node0" || a.Ended == nil || !a.Retryable || a.RetryAt == nil {
+		t.Errorf("attempt: %+v", a)
+	}
+	if d := a.RetryAt.Sub(*a.Ended); d != time.Hour {
+		t.Errorf("retry after %v", d)
+	}
+
+	// the job fails when attempts are exhausted.
+	srv.jobStarted(qjob)
+	srv.jobFailed(job.ID, &retryableError{fmt.Errorf("signal: killed")})
+	job, err = srv.Store.ViewJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != slicerjob.Failed || len(job.Attempts) != 2 || job.Error != "signal: killed" {
+		t.Errorf("job %v with %d attempts: %q", job.Status, len(job.Attempts), job.Error)
+	}
+	if a := job.Attempts[1]; a.Number != 2 || a.RetryAt != nil {
+		t.Errorf("attempt: %+v", a)
+	}
+
+	// errors which are not transient are not retried.
+	job = slicerjob.New()
+	srv.Store.InsertJob(job, nil)
+	srv.jobStarted(&Job{ID: job.ID})
+	srv.jobFailed(job.ID, &LimitError{"time", "1s"})
+	job, _ = srv.Store.ViewJob(job.ID)
+	if job.Status != slicerjob.Failed || job.Attempts[0].Retryable {
+		t.Errorf("job %v: %+v", job.Status, job.Attempts[0])
+	}
+}
+
+func TestJobDoneDraining(t *testing.T) {
+	srv := &SnuggieServer{
+		NodeID: "node0",
+		Store:  MemoryStore(),
+	}
+	srv.life.draining = true
+	var ids []string
+	for i := 0; i < 2; i++ {
+		job := slicerjob.New()
+		job.Status = slicerjob.Accepted
+		err := srv.Store.InsertJob(job, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.jobStarted(&Job{ID: job.ID})
+		ids = append(ids, job.ID)
+	}
+
+	// jobs interrupted by the shutdown are left to be requeued while jobs
+	// which fail during the shutdown are still failed.
+	srv.JobDone(ids[0], "", errShutdown)
+	srv.JobDone(ids[1], "", fmt.Errorf("run: exit status 1"))
+	for i, status := range []slicerjob.Status{slicerjob.Processing, slicerjob.Failed} {
+		job, err := srv.Store.ViewJob(ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != status {
+			t.Errorf("job %d: %v (expected %v)", i, job.Status, status)
+		}
+	}
+}
+
+// gcodeFailStore is a JobStore which cannot record the gcode of jobs.
+type gcodeFailStore struct {
+	JobStore
+}
+
+func (s gcodeFailStore) PutGCodeFile(id, key string) error {
+	return fmt.Errorf("store is full")
+}
+
+func TestJobDoneStoreFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := &SnuggieServer{
+		NodeID: "node0",
+		Store:  gcodeFailStore{MemoryStore()},
+		Blobs:  LocalBlobs(dir),
+	}
+	job := slicerjob.New()
+	job.Status = slicerjob.Accepted
+	err = srv.Store.InsertJob(job, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.jobStarted(&Job{ID: job.ID})
+	key := job.ID + ".gcode" + gzipExt
+	err = srv.Blobs.Put(key, strings.NewReader("G28\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the job fails rather than being left processing, and the gcode which
+	// could not be recorded is removed.
+	srv.JobDone(job.ID, key, nil)
+	job, err = srv.Store.ViewJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != slicerjob.Failed || job.Error != "put gcode file: store is full" || !job.Attempts[0].Retryable {
+		t.Errorf("job %v: %q %+v", job.Status, job.Error, job.Attempts[0])
+	}
+	_, err = srv.Blobs.Open(key)
+	if err != ErrBlobNotFound {
+		t.Errorf("gcode blob: %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Blobs is a BlobStore keeping blobs as objects in a bucket of an
+// S3-compatible service.  Buckets are addressed by path, as
+// Endpoint/Bucket/Prefix+key, so services other than AWS need no DNS
+// configuration.  Requests are signed with AWS signature version 4.
+type S3Blobs struct {
+	Endpoint  string // like "https://s3.us-east-1.amazonaws.com"
+	Region    string
+	Bucket    string
+	Prefix    string // prepended to keys, like "snuggied/"
+	AccessKey string
+	SecretKey string
+
+	// Client sends requests to the service.  If nil http.DefaultClient is
+	// used.
+	Client *http.Client
+}
+
+var _ BlobStore = new(S3Blobs)
+
+// s3EmptyHash is the SHA-256 hash of an empty request body.
+const s3EmptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3Blobs) Put(key string, r io.Reader) error {
+	// the length and hash of the body are signed so it is spooled to a
+	// temporary file first.
+	f, err := ioutil.TempFile("", "snuggied-s3-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	req, err := s.request("PUT", key)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = n
+	req.Body = ioutil.NopCloser(f)
+	if n == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := s.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Blobs) Open(key string) (Blob, error) {
+	req, err := s.request("HEAD", key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, s3EmptyHash)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	mod, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3Blob{s: s, key: key, size: resp.ContentLength, mod: mod}, nil
+}
+
+func (s *S3Blobs) Delete(key string) error {
+	req, err := s.request("DELETE", key)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, s3EmptyHash)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// request returns an unsigned request for the object holding key.
+func (s *S3Blobs) request(method, key string) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %v", err)
+	}
+	u.Path += "/" + s.Bucket + "/" + s.Prefix + key
+	u.RawPath = s3EscapePath(u.Path)
+	return http.NewRequest(method, u.String(), nil)
+}
+
+// do signs and sends req, whose body has the given SHA-256 hash.  Responses
+// other than 2xx are returned as errors, with 404 Not Found returned as
+// ErrBlobNotFound.
+func (s *S3Blobs) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", time.Now().UTC().Format(s3TimeFormat))
+	s.sign(req)
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	serr := &S3Error{Op: req.Method, Path: req.URL.Path, StatusCode: resp.StatusCode}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(serr)
+	return nil, serr
+}
+
+// S3Error is an error response from an S3-compatible service.  Code and
+// Message are empty if the response had no body, as for HEAD requests.
+type S3Error struct {
+	Op         string `xml:"-"`
+	Path       string `xml:"-"`
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (err *S3Error) Error() string {
+	msg := fmt.Sprintf("s3 %s %s: %d %s", err.Op, err.Path, err.StatusCode, http.StatusText(err.StatusCode))
+	if err.Code != "" {
+		msg += ": " + err.Code
+	}
+	if err.Message != "" {
+		msg += ": " + err.Message
+	}
+	return msg
+}
+
+const s3TimeFormat = "20060102T150405Z"
+
+// sign adds an Authorization header to req using AWS signature version 4.
+// The Host header, Range header, and any X-Amz-* headers are signed.  The
+// X-Amz-Date and X-Amz-Content-Sha256 headers must already be set.
+func (s *S3Blobs) sign(req *http.Request) {
+	amzdate := req.Header.Get("X-Amz-Date")
+	scope := strings.Join([]string{amzdate[:8], s.Region, "s3", "aws4_request"}, "/")
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders []string
+	for _, name := range names {
+		value := strings.Join(strings.Fields(headers[name]), " ")
+		canonHeaders = append(canonHeaders, name+":"+value+"\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		strings.Join(canonHeaders, ""),
+		signed,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzdate,
+		scope,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{amzdate[:8], s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery returns the query string of a request as it is signed,
+// sorted by name and value.
+func s3CanonicalQuery(q url.Values) string {
+	var params []string
+	for name, values := range q {
+		for _, v := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3EscapePath escapes each segment of path as required for signing.
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+// s3Escape percent-encodes every byte of s except unreserved characters and,
+// if path is true, slashes.
+func s3Escape(s string, path bool) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			buf = append(buf, c)
+		default:
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
+
+// s3Blob reads an object with ranged GET requests.  Seeking discards the
+// current response and the next Read requests the object from the new
+// offset.
+type s3Blob struct {
+	s    *S3Blobs
+	key  string
+	size int64
+	mod  time.Time
+	pos  int64
+	body io.ReadCloser
+}
+
+func (b *s3Blob) Size() int64        { return b.size }
+func (b *s3Blob) ModTime() time.Time { return b.mod }
+
+func (b *s3Blob) Read(p []byte) (int, error) {
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		req, err := b.s.request("GET", b.key)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.pos))
+		resp, err := b.s.do(req, s3EmptyHash)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && b.pos > 0 {
+			resp.Body.Close()
+			return 0, fmt.Errorf("s3 GET %s: range not supported", req.URL.Path)
+		}
+		b.body = resp.Body
+	}
+	n, err := b.body.Read(p)
+	b.pos += int64(n)
+	if err == io.EOF && b.pos < b.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *s3Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += b.pos
+	case 2:
+		offset += b.size
+	default:
+		return b.pos, fmt.Errorf("seek: invalid whence")
+	}
+	if offset < 0 {
+		return b.pos, fmt.Errorf("seek: negative position")
+	}
+	if offset != b.pos && b.body != nil {
+		b.body.Close()
+		b.body = nil
+	}
+	b.pos = offset
+	return offset, nil
+}
+
+func (b *s3Blob) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	err := b.body.Close()
+	b.body = nil
+	return err
+}
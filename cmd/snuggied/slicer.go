@@ -1,14 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type SlicerCmd struct {
@@ -22,34 +23,175 @@ type Slicer interface {
 	SlicerCmd() *SlicerCmd
 }
 
-func Run(s Slicer, kill <-chan error) error {
+// Limits restricts the resources used by a slicer process.  Zero values are
+// unlimited.
+type Limits struct {
+	// Timeout is the wall-clock time the slicer may run.
+	Timeout time.Duration
+
+	// Memory is the number of bytes of memory the slicer may use.  The limit
+	// is enforced by a cgroup if one is configured.  Otherwise the address
+	// space of the process is limited.
+	Memory int64
+
+	// CPUTime is the processor time the slicer may consume.
+	CPUTime time.Duration
+
+	// CPUs is the number of processors the slicer may use concurrently.  It
+	// is enforced only by a cgroup.
+	CPUs float64
+
+	// Nice is the scheduling priority adjustment for the slicer.
+	Nice int
+
+	// Cgroup is a cgroup v2 directory delegated to the server.  Each slicer
+	// runs in a new cgroup created beneath it.
+	Cgroup string
+}
+
+// LimitError is returned by Run when the slicer is stopped for exceeding one
+// of its limits.
+type LimitError struct {
+	Limit string
+	Value string
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("slicer exceeded %s limit of %s", err.Limit, err.Value)
+}
+
+// waitDelay is the time allowed for the slicer's output to be closed after it
+// exits.  Orphaned children may keep it open.
+const waitDelay = time.Second
+
+// Run executes the slicer, killing it if a value is received from kill or if
+// it exceeds limits, which may be nil.  The slicer runs in its own process
+// group and the group is killed when the slicer terminates so that children
+// it started do not outlive it.  Slicer output which is not directed
+// elsewhere by the SlicerCmd is written to log line by line.
+func Run(s Slicer, limits *Limits, kill <-chan error, log *Logger) error {
+	if limits == nil {
+		limits = new(Limits)
+	}
 	scmd := s.SlicerCmd()
-	log.Printf("slicing with %s %v", scmd.Bin, scmd.Args)
+	log.Infof("slicing with %s %v", scmd.Bin, scmd.Args)
 	cmd := exec.Command(scmd.Bin, scmd.Args...)
 	cmd.Stdout = scmd.OutLog
 	cmd.Stderr = scmd.ErrLog
+	cmd.WaitDelay = waitDelay
+	if cmd.Stdout == nil {
+		w := log.With("stream", "stdout").Writer(LevelInfo)
+		defer w.Close()
+		cmd.Stdout = w
+	}
+	if cmd.Stderr == nil {
+		w := log.With("stream", "stderr").Writer(LevelWarn)
+		defer w.Close()
+		cmd.Stderr = w
+	}
+	cmd.SysProcAttr = newProcAttr()
+
+	var cg *jobCgroup
+	if limits.Cgroup != "" {
+		var err error
+		cg, err = newJobCgroup(limits.Cgroup, "slicer-"+newRequestID(), limits)
+		if err != nil {
+			log.Warnf("cgroup: %v", err)
+		} else {
+			defer func() {
+				if err := cg.Remove(); err != nil {
+					log.Warnf("cgroup: %v", err)
+				}
+			}()
+			cg.Attach(cmd.SysProcAttr)
+		}
+	}
+
 	err := cmd.Start()
 	if err != nil {
-		return fmt.Errorf("%s: %v", scmd.Bin, err)
+		return fmt.Errorf("%s: %w", scmd.Bin, err)
+	}
+	pid := cmd.Process.Pid
+	err = setLimits(pid, limits, cg != nil)
+	if err != nil {
+		log.Warnf("limits: %v", err)
+	}
+
+	// killAll stops the slicer and any children remaining in its process
+	// group or cgroup.
+	killAll := func() error {
+		if cg != nil {
+			cg.Kill()
+		}
+		return killGroup(cmd.Process)
+	}
+	var timeout <-chan time.Time
+	if limits.Timeout > 0 {
+		timer := time.NewTimer(limits.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 	done := make(chan error, 1)
 	go func() { done <- cmd.Wait() }()
 	for {
 		select {
 		case err := <-done:
+			killAll()
+			if err == exec.ErrWaitDelay {
+				log.Warnf("slicer output held open after exit")
+				err = nil
+			}
+			if lerr := limitExceeded(cmd.ProcessState, limits, cg); lerr != nil {
+				return lerr
+			}
 			return err
 		case err := <-kill:
-			log.Printf("killing process %v", cmd.Process.Pid)
-			if errkill := cmd.Process.Kill(); errkill != nil {
+			log.Infof("killing process %v", pid)
+			if errkill := killAll(); errkill != nil {
 				// we couldn't kill the process. don't exit the loop.
-				log.Printf("kill: %v", errkill)
+				log.Errorf("kill: %v", errkill)
 				continue
 			}
+			<-done
 			return err
+		case <-timeout:
+			log.Warnf("killing process %v after %v", pid, limits.Timeout)
+			if errkill := killAll(); errkill != nil {
+				log.Errorf("kill: %v", errkill)
+				continue
+			}
+			<-done
+			return &LimitError{"time", limits.Timeout.String()}
 		}
 	}
 }
 
+// limitExceeded returns a LimitError if the slicer, which exited with state,
+// was stopped because it exceeded its memory or processor time limits.
+// Without a cgroup the memory limit only causes allocations to fail, so a
+// slicer which crashes is assumed to have exceeded it.  A slicer which
+// instead exits with an error status is not distinguished from one which
+// failed for another reason.
+func limitExceeded(state *os.ProcessState, limits *Limits, cg *jobCgroup) *LimitError {
+	if cg != nil && limits.Memory > 0 && cg.OOMKilled() {
+		return &LimitError{"memory", formatMB(limits.Memory)}
+	}
+	if state == nil || state.Success() {
+		return nil
+	}
+	if limits.CPUTime > 0 && (cpuLimitSignaled(state) || state.UserTime()+state.SystemTime() >= limits.CPUTime) {
+		return &LimitError{"CPU time", limits.CPUTime.String()}
+	}
+	if cg == nil && limits.Memory > 0 && crashSignaled(state) {
+		return &LimitError{"memory", formatMB(limits.Memory)}
+	}
+	return nil
+}
+
+func formatMB(n int64) string {
+	return fmt.Sprintf("%d MB", n>>20)
+}
+
 func ReadPresetsDirSlic3r(dir string) (map[string]string, error) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -67,6 +209,30 @@ func ReadPresetsDirSlic3r(dir string) (map[string]string, error) {
 	return m, nil
 }
 
+// ReadConfigSlic3r reads the settings from a Slic3r INI configuration file.
+func ReadConfigSlic3r(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:i])
+		config[key] = strings.TrimSpace(line[i+1:])
+	}
+	return config, s.Err()
+}
+
 type Slic3r struct {
 	Bin        string
 	ConfigPath string
@@ -93,9 +259,7 @@ func (s *Slic3r) SlicerCmd() *SlicerCmd {
 		args = append(args, in)
 	}
 	return &SlicerCmd{
-		Bin:    bin,
-		Args:   args,
-		OutLog: os.Stderr,
-		ErrLog: os.Stderr,
+		Bin:  bin,
+		Args: args,
 	}
 }
@@ -0,0 +1,196 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shellSlicer runs a shell script in place of a slicer.
+type shellSlicer string
+
+func (s shellSlicer) SlicerCmd() *SlicerCmd {
+	return &SlicerCmd{
+		Bin:    "/bin/sh",
+		Args:   []string{"-c", string(s)},
+		OutLog: ioutil.Discard,
+		ErrLog: ioutil.Discard,
+	}
+}
+
+var testLogger = NewLogger(ioutil.Discard, LevelError, false)
+
+func TestRunTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidfile := filepath.Join(dir, "child.pid")
+
+	// the child started by the slicer is killed along with it.
+	start := time.Now()
+	err = Run(shellSlicer("sleep 30 & echo $! > "+pidfile+"; wait"), &Limits{Timeout: 200 * time.Millisecond}, nil, testLogger)
+	lerr, ok := err.(*LimitError)
+	if !ok || lerr.Limit != "time" {
+		t.Fatalf("error: %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("killed after %v", time.Since(start))
+	}
+	p, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(p)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if state := procState(pid); state != "" && state != "Z" {
+		t.Errorf("child %d still running: state %s", pid, state)
+	}
+}
+
+// procState returns the state of process pid, or an empty string if it does
+// not exist.  Killed orphans may remain as zombies if nothing reaps them.
+func procState(pid int) string {
+	p, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(p[strings.LastIndex(string(p), ")")+1:]))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func TestRunCPUTime(t *testing.T) {
+	err := Run(shellSlicer("while :; do :; done"), &Limits{CPUTime: time.Second, Timeout: 30 * time.Second}, nil, testLogger)
+	lerr, ok := err.(*LimitError)
+	if !ok || lerr.Limit != "CPU time" {
+		t.Fatalf("error: %v", err)
+	}
+}
+
+func TestRunMemory(t *testing.T) {
+	limits := &Limits{Memory: 64 << 20, Timeout: 30 * time.Second}
+
+	// the address space is limited shortly after the process starts.
+	err := Run(shellSlicer("sleep 0.2; x=$(head -c 200000000 /dev/zero | tr '\\0' a); echo ${#x}"), limits, nil, testLogger)
+	if err == nil {
+		t.Errorf("allocation beyond the memory limit succeeded")
+	}
+
+	// without a cgroup a crash is attributed to the memory limit but an
+	// error exit status is not.
+	for script, memory := range map[string]bool{
+		"kill -SEGV $$": true,
+		"kill -ABRT $$": true,
+		"exit 1":        false,
+	} {
+		err := Run(shellSlicer(script), limits, nil, testLogger)
+		lerr, ok := err.(*LimitError)
+		if ok != memory || ok && (lerr.Limit != "memory" || lerr.Value != "64 MB") {
+			t.Errorf("%q: %v", script, err)
+		}
+	}
+	err = Run(shellSlicer("kill -SEGV $$"), nil, nil, testLogger)
+	if _, ok := err.(*LimitError); ok {
+		t.Errorf("crash without a memory limit: %v", err)
+	}
+}
+
+func TestRunNice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "stat")
+
+	// the priority is applied shortly after the process starts.
+	err = Run(shellSlicer("sleep 0.2; cat /proc/self/stat > "+out), &Limits{Nice: 5}, nil, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the nice value is the 19th field, after the parenthesized command.
+	fields := strings.Fields(string(p[strings.LastIndex(string(p), ")")+1:]))
+	if len(fields) < 17 || fields[16] != "5" {
+		t.Errorf("nice: %v", fields)
+	}
+}
+
+func TestIsTransientRunError(t *testing.T) {
+	for script, transient := range map[string]bool{
+		"kill -KILL $$": true,
+		"exit 1":        false,
+	} {
+		err := Run(shellSlicer(script), nil, nil, testLogger)
+		if err == nil {
+			t.Errorf("%q: no error", script)
+			continue
+		}
+		if isTransientRunError(err) != transient {
+			t.Errorf("%q: transient=%v (%v)", script, !transient, err)
+		}
+	}
+}
+
+// loggedShellSlicer runs a shell script in place of a slicer and logs its
+// output.
+type loggedShellSlicer string
+
+func (s loggedShellSlicer) SlicerCmd() *SlicerCmd {
+	return &SlicerCmd{Bin: "/bin/sh", Args: []string{"-c", string(s)}}
+}
+
+func TestRunKill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidfile := filepath.Join(dir, "slicer.pid")
+
+	var buf bytes.Buffer
+	log := NewLogger(&buf, LevelInfo, false)
+	kill := make(chan error, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		kill <- errShutdown
+	}()
+	err = Run(loggedShellSlicer("echo $$ > "+pidfile+"; echo started; exec sleep 30"), nil, kill, log)
+	if err != errShutdown {
+		t.Fatalf("error: %v", err)
+	}
+
+	// the slicer has exited and its output has been logged when Run returns.
+	p, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(p)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := procState(pid); state != "" {
+		t.Errorf("slicer %d not reaped: state %s", pid, state)
+	}
+	if !strings.Contains(buf.String(), "started") {
+		t.Errorf("output not logged:\n%s", buf.String())
+	}
+}
@@ -15,6 +15,10 @@ snuggied with the -h flag.
 
 	snuggied -h
 
+Every response carries an X-Request-Id header.  Clients may supply their own
+identifier in the request header to correlate the server's log messages with
+their own.
+
 
 Create a job
 
@@ -24,15 +28,52 @@ slice.
 	POST /slicer/jobs
 	Content-Type: muiltpart/form-data
 
-		meshfile  3D mesh file (stl or amf)
-		slicer    backend slicer program (only "slic3r" supported currently)
-		preset    name of a preset backend configuration
+		meshfile     3D mesh file (stl or amf)
+		slicer       backend slicer program (only "slic3r" supported currently)
+		preset       name of a preset backend configuration
+		postprocess  (optional, repeatable) a G-code post-processor as "name:arg"
+		thumbnails   (optional) image sizes to embed in the G-code, like "16x16,220x124"
+		target       (optional) name of an output target to receive the G-code
+		print        (optional) start printing after delivery to the target (true/false)
+		ttl          (optional) time to keep the job after it terminates, like "72h"
+
+Post-processors are applied to the g-code in the order given.  The available
+processors are
+
+		pause:{layer}            filament change (M600) before a layer
+		temp_ramp:{start}:{end}  hotend temperature ramp over all layers
+		start_gcode:{gcode}      g-code inserted before the first layer
+		end_gcode:{gcode}        g-code appended to the program
+
+When a target is given the completed g-code is uploaded to the printer host
+(OctoPrint or Moonraker) and the progress of the upload is reported in the
+job's delivery field.  Targets are configured by the -targets flag.
+
+Thumbnails of the mesh are embedded in the header of the g-code for display
+by printers that support them.  Sizes default to the "thumbnails" setting of
+the preset and the value "none" disables thumbnails for the job.
+
+Terminated jobs and their files are deleted after the job's ttl or, without
+one, after the period configured for the job's status by the -retain.complete,
+-retain.failed, and -retain.cancelled flags.  If files exceed the -data.quota
+flag, terminated jobs are deleted early, the oldest completed jobs first.
+
+Meshes and g-code are stored in the data directory unless the -s3.bucket flag
+names a bucket of an S3-compatible service, configured by the other -s3.*
+flags.  Thumbnails and files being sliced are always kept in the data
+directory, and only files there count toward -data.quota.
 
 	201 Created
 	Content-Type: application/json
 
 		slicerjob.Job
 
+Uploads are limited by the -upload.maxsize and -upload.maxtriangles flags.
+Requests larger than the limit are rejected with 413 Request Entity Too
+Large, meshes which cannot be read or have too many triangles with 422
+Unprocessable Entity, and uploads which would leave less than -data.minfree
+space in the data directory with 507 Insufficient Storage.
+
 
 List jobs
 
@@ -45,6 +86,19 @@ The client may use this if interested in the status of multiple jobs.
 
 		slicerjob.Page of []slicerjob.Job
 
+Jobs are listed in the order they were created, or most recent first with
+order=newest.  The listing may be restricted with the query parameters
+
+	status=complete,failed                   any of the given statuses
+	created_after, created_before            creation time range (RFC 3339)
+	terminated_after, terminated_before      termination time range (RFC 3339)
+	slicer, preset                           the job's slicer and preset
+	node                                     a node which attempted the job
+
+Lower bounds are inclusive and upper bounds exclusive.  Each page has at most
+limit jobs, and its cursor is given as the cursor parameter to retrieve the
+next page with the same parameters.
+
 
 Get a job's status
 
@@ -58,6 +112,35 @@ progress.
 
 		slicerjob.Job
 
+Each attempt to slice the job is listed in its attempts field.  A slicer
+which is killed by a signal, such as by the kernel when memory is exhausted,
+is retried after a delay up to the number of attempts given by the -retry.*
+flags.  Failures caused by the mesh, like an error exit status or an exceeded
+limit, are not retried.
+
+Slicers run with the limits set by the -slicer.* flags on wall-clock time,
+memory, processor time, and priority.  On Linux a cgroup v2 directory
+delegated to the server may be given with -slicer.cgroup to enforce memory
+and processor limits more precisely.  Without a cgroup the memory limit
+restricts the slicer's address space, and a slicer which crashes is reported
+as exceeding it.  A slicer which exits with an error status when it cannot
+allocate memory is reported as an ordinary failure.  A job whose slicer
+exceeds a limit fails and its error names the limit.
+
+
+Get a job's history
+
+Every change to a job is recorded: acceptance, the start of each attempt and
+the node running it, progress milestones, retries, and the final outcome.
+Events are listed oldest first and are deleted along with the job.
+
+	GET /slicer/jobs/{id}/history
+
+	200 OK
+	Content-Type: application/json
+
+		slicerjob.History
+
 
 Cancel a job
 
@@ -68,6 +151,9 @@ slicing procedure if it has already begun.
 
 	200 OK
 
+Jobs which have already completed, failed, or been cancelled cannot be
+cancelled and the server responds 409 Conflict.
+
 
 Retrieve final g-code
 
@@ -79,6 +165,42 @@ key.
 	200 OK
 	Content-Type: application/octet-stream
 
+G-code is stored compressed.  Clients sending the header "Accept-Encoding:
+gzip" receive the compressed content with "Content-Encoding: gzip".  Range
+requests are supported for resuming downloads.
+
+
+Retrieve g-code statistics
+
+Estimated print time, filament usage, and layer information computed from a
+completed job's g-code.  The statistics are also included in the job.
+
+	GET /slicer/gcodes/{id}/stats
+
+	200 OK
+	Content-Type: application/json
+
+		slicerjob.GCodeStats
+
+
+Preview a g-code layer
+
+Tool paths for a single layer of a completed job's g-code, numbered from 1.
+The SVG image draws extrusions as solid lines and travel moves as thin dashed
+lines.  The JSON representation contains the same polylines in millimeters.
+
+	GET /slicer/gcodes/{id}/layers/{n}.svg
+
+	200 OK
+	Content-Type: image/svg+xml
+
+	GET /slicer/gcodes/{id}/layers/{n}.json
+
+	200 OK
+	Content-Type: application/json
+
+		gcode.Layer
+
 
 Retrieve an original mesh file
 
@@ -93,6 +215,21 @@ The contents of the original 3D mesh file are returned.  The content-type may
 be more specific when the file has a known media type.
 
 
+Retrieve a mesh thumbnail
+
+A shaded isometric rendering of a job's mesh.  The optional size parameter is
+the width and height of the image in pixels, one of 64, 128, 256 (default),
+512, or 1024.
+Thumbnails are rendered in the background.  If the thumbnail is not ready
+shortly after it is requested the server responds 202 Accepted and the client
+should retry after the number of seconds in the Retry-After header.
+
+	GET /slicer/meshes/{id}/thumbnail.png?size=128
+
+	200 OK
+	Content-Type: image/png
+
+
 List backend presets
 
 Clients may provide a level of dynamic discovery by detecting presets for the
@@ -105,22 +242,85 @@ slicer.
 
 		slicerjob.SlicerPresets
 
+
+Server statistics
+
+Queue depth, counts of jobs terminated over recent windows of time (1m, 5m,
+1h, 24h), mean queue wait and slicing time for each preset, disk usage of the
+data directory, and the jobs recently deleted by the garbage collector along
+with the reason for each deletion.  Counts and timings are reset when the
+server restarts.
+
+	GET /slicer/stats
+
+	200 OK
+	Content-Type: application/json
+
+		slicerjob.ServerStats
+
+
+Metrics
+
+Metrics for Prometheus are served in the text exposition format at a path
+outside of the API prefix.  They include counts of jobs entering each status
+by backend, histograms of slicing time and queue wait by preset, the queue
+length, worker occupancy, database size, and garbage collector removals.
+
+	GET /metrics
+
+	200 OK
+	Content-Type: text/plain; version=0.0.4
+
+
+Dashboard
+
+A web interface for uploading meshes, following the progress of jobs, and
+downloading g-code is served at the root of the API.  The interface uses only
+the endpoints documented here.
+
+	GET /slicer/
+
+	200 OK
+	Content-Type: text/html
+
+
+Health checks
+
+Liveness and readiness are reported at paths outside of the API prefix for
+load balancers.  The liveness check succeeds whenever the server is handling
+requests.  The readiness check verifies that the slicer runs and reports its
+version, that presets are loaded, that the database is writable, and that the
+data directory has free space above the -data.minfree threshold.  The result
+of each check is given in the response.
+
+	GET /healthz
+
+	200 OK
+	Content-Type: application/json
+
+	GET /readyz
+
+	200 OK (or 503 Service Unavailable)
+	Content-Type: application/json
+
 */
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"flag"
@@ -131,17 +331,53 @@ import (
 
 type SnuggieServer struct {
 	Config map[string]string
+	NodeID string
 
 	// Prefix should not end in a slash '/'.
 	BaseURL       string
 	Prefix        string
 	Slic3r        string
 	Slic3rPresets map[string]string
-	DataDir       string
-
-	LocalConsumer bool
-	S             Scheduler
-	C             Consumer
+	Thumbnails    *Thumbnailer
+	Targets       map[string]*OutputTarget
+	Stats         *Stats
+	Store         JobStore
+
+	// Blobs holds the mesh and g-code files of jobs.  DataDir is a local
+	// directory for files being sliced and cached thumbnails, and for blobs
+	// when Blobs is a FileBlobs.
+	Blobs   BlobStore
+	DataDir string
+
+	// Workers is the number of goroutines running RunConsumer.
+	Workers int
+
+	// MinFree is the free space in bytes required in DataDir for the server
+	// to be ready.
+	MinFree int64
+	ready   readiness
+	life    lifecycle
+
+	// Retention determines when terminated jobs are deleted.  Quota limits
+	// the bytes used by files in DataDir, evicting terminated jobs when it is
+	// exceeded.  A zero Quota is unlimited.
+	Retention Retention
+	Quota     int64
+
+	// Limits restricts the resources used by each slicer process.
+	Limits Limits
+
+	// Retry determines whether jobs are sliced again after transient
+	// failures.
+	Retry RetryPolicy
+
+	// MaxUpload limits the size in bytes of job requests and MaxTriangles
+	// limits the complexity of their meshes.  Zero values are unlimited.
+	MaxUpload    int64
+	MaxTriangles int
+
+	S Scheduler
+	C Consumer
 }
 
 func (srv *SnuggieServer) RegisterHandlers(mux *http.ServeMux) http.Handler {
@@ -159,7 +395,20 @@ func (srv *SnuggieServer) RegisterHandlers(mux *http.ServeMux) http.Handler {
 	})
 	mux.HandleFunc(srv.route("/jobs/"), func(w http.ResponseWriter, r *http.Request) {
 		// the request has an ID suffix on the url path so we are showing a
-		// single job resource.
+		// single job resource or its history.
+		_, sub := srv.pathID(r.URL.Path, "/jobs/")
+		if sub == "history" {
+			if r.Method != "GET" {
+				http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			srv.GetJobHistory(w, r)
+			return
+		}
+		if sub != "" {
+			http.NotFound(w, r)
+			return
+		}
 		switch r.Method {
 		case "GET":
 			srv.GetJob(w, r)
@@ -171,23 +420,83 @@ func (srv *SnuggieServer) RegisterHandlers(mux *http.ServeMux) http.Handler {
 	})
 	mux.HandleFunc(srv.route("/gcodes/"), func(w http.ResponseWriter, r *http.Request) {
 		// the only operation allowed on a gcode resource is to get the gcode
-		// content for a job.
-		switch r.Method {
-		case "GET":
+		// content for a job, or information about it.
+		if r.Method != "GET" {
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		_, sub := srv.pathID(r.URL.Path, "/gcodes/")
+		switch sub {
+		case "":
 			srv.GetGCode(w, r)
+		case "stats":
+			srv.GetGCodeStats(w, r)
 		default:
-			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			if strings.HasPrefix(sub, "layers/") {
+				srv.GetGCodeLayer(w, r)
+				return
+			}
+			http.NotFound(w, r)
 		}
 	})
 	mux.HandleFunc(srv.route("/meshes/"), func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
+		if r.Method != "GET" {
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		_, sub := srv.pathID(r.URL.Path, "/meshes/")
+		switch sub {
+		case "":
 			srv.GetMesh(w, r)
+		case "thumbnail.png":
+			srv.GetThumbnail(w, r)
 		default:
-			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			http.NotFound(w, r)
 		}
 	})
 
+	mux.HandleFunc(srv.route("/stats"), func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		srv.GetStats(w, r)
+	})
+	mux.HandleFunc(srv.route("/"), func(w http.ResponseWriter, r *http.Request) {
+		// the dashboard is only served at the root of the api.  other paths
+		// beneath the prefix are unknown.
+		if r.URL.Path != srv.route("/") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "GET" {
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		srv.GetDashboard(w, r)
+	})
+	if srv.Prefix != "" {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			http.Redirect(w, r, srv.route("/"), http.StatusFound)
+		})
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		srv.GetHealth(w, r)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		srv.GetReady(w, r)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		srv.GetMetrics(w, r)
+	})
 	mux.HandleFunc(srv.route("/presets/"), func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
@@ -221,29 +530,151 @@ func (srv *SnuggieServer) trimPath(path, route string) (suffix, prefix string) {
 	return suffix, prefix
 }
 
+// pathID splits the suffix of path following route into a resource id and an
+// optional sub-resource.  The path /gcodes/{id}/stats has the sub-resource
+// "stats".
+func (srv *SnuggieServer) pathID(path, route string) (id, sub string) {
+	suffix, _ := srv.trimPath(path, route)
+	i := strings.Index(suffix, "/")
+	if i < 0 {
+		return suffix, ""
+	}
+	return suffix[:i], suffix[i+1:]
+}
+
 func (srv *SnuggieServer) GetGCode(w http.ResponseWriter, r *http.Request) {
-	id, _ := srv.trimPath(r.URL.Path, "/gcodes/")
-	path, err := ViewGCodeFile(id)
+	id, _ := srv.pathID(r.URL.Path, "/gcodes/")
+	key, err := srv.Store.ViewGCodeFile(id)
+	if err != nil || key == "" {
+		http.Error(w, "unknown id", http.StatusNotFound)
+		return
+	}
+	serveArtifact(w, r, srv.Blobs, key)
+}
+
+func (srv *SnuggieServer) GetGCodeStats(w http.ResponseWriter, r *http.Request) {
+	id, _ := srv.pathID(r.URL.Path, "/gcodes/")
+	job, err := srv.Store.ViewJob(id)
 	if err != nil {
 		http.Error(w, "unknown id", http.StatusNotFound)
 		return
 	}
-	http.ServeFile(w, r, path)
+	stats := job.GCodeStats
+	if stats == nil {
+		// jobs completed before statistics were collected.
+		key, err := srv.Store.ViewGCodeFile(id)
+		if err != nil || key == "" {
+			http.Error(w, "unknown id", http.StatusNotFound)
+			return
+		}
+		stats, err = srv.analyzeGCode(key, job.Preset)
+		if err != nil {
+			requestLogger(r).With("job", id).Errorf("gcode stats: %v", err)
+			http.Error(w, "unable to analyze gcode", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = json.NewEncoder(w).Encode(stats)
+	if err != nil {
+		requestLogger(r).Warnf("http response: %v", err)
+	}
 }
 
-func (srv *SnuggieServer) GetMesh(w http.ResponseWriter, r *http.Request) {
-	id, _ := srv.trimPath(r.URL.Path, "/meshes/")
-	path, err := ViewGCodeFile(id)
+func (srv *SnuggieServer) GetGCodeLayer(w http.ResponseWriter, r *http.Request) {
+	id, sub := srv.pathID(r.URL.Path, "/gcodes/")
+	name := strings.TrimPrefix(sub, "layers/")
+	ext := filepath.Ext(name)
+	if ext != ".svg" && ext != ".json" {
+		http.Error(w, "layer format must be svg or json", http.StatusNotFound)
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(name, ext))
 	if err != nil {
+		http.Error(w, "invalid layer number", http.StatusNotFound)
+		return
+	}
+	key, err := srv.Store.ViewGCodeFile(id)
+	if err != nil || key == "" {
+		http.Error(w, "unknown id", http.StatusNotFound)
+		return
+	}
+	layer, err := srv.readGCodeLayer(id, key, n)
+	if err == errLayerRange {
+		http.Error(w, "layer not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		requestLogger(r).With("job", id).Errorf("gcode layer: %v", err)
+		http.Error(w, "unable to read gcode", http.StatusInternalServerError)
+		return
+	}
+
+	if ext == ".svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		err = layer.WriteSVG(w)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(layer)
+	}
+	if err != nil {
+		requestLogger(r).Warnf("http response: %v", err)
+	}
+}
+
+func (srv *SnuggieServer) GetMesh(w http.ResponseWriter, r *http.Request) {
+	id, _ := srv.pathID(r.URL.Path, "/meshes/")
+	key, err := srv.Store.ViewMeshFile(id)
+	if err != nil || key == "" {
+		http.Error(w, "unknown id", http.StatusNotFound)
+		return
+	}
+	serveArtifact(w, r, srv.Blobs, key)
+}
+
+func (srv *SnuggieServer) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	id, _ := srv.pathID(r.URL.Path, "/meshes/")
+	size := defaultThumbnailSize
+	if sizestr := r.URL.Query().Get("size"); sizestr != "" {
+		var err error
+		size, err = strconv.Atoi(sizestr)
+		if err != nil || !isThumbnailSize(size) {
+			http.Error(w, fmt.Sprintf("size: must be one of %v", thumbnailSizes), http.StatusBadRequest)
+			return
+		}
+	}
+	key, err := srv.Store.ViewMeshFile(id)
+	if err != nil || key == "" {
 		http.Error(w, "unknown id", http.StatusNotFound)
 		return
 	}
-	http.ServeFile(w, r, path)
+	if srv.Thumbnails == nil {
+		http.Error(w, "thumbnails are not enabled", http.StatusNotFound)
+		return
+	}
+
+	job, err := srv.Thumbnails.Render(key, size)
+	if err != nil {
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case <-job.Done:
+	case <-time.After(2 * time.Second):
+		w.Header().Set("Retry-After", "2")
+		http.Error(w, "thumbnail is being rendered", http.StatusAccepted)
+		return
+	}
+	if job.Err != nil {
+		http.Error(w, "unable to render thumbnail", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeFile(w, r, job.Path)
 }
 
 func (srv *SnuggieServer) GetPresets(w http.ResponseWriter, r *http.Request) {
 	id, _ := srv.trimPath(r.URL.Path, "/presets/")
-	log.Println(id)
 	if id != "slic3r" {
 		http.Error(w, "only slic3r is supported at this time", http.StatusNotFound)
 		return
@@ -290,32 +721,79 @@ func (srv *SnuggieServer) ListJobs(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var filters []func(job *slicerjob.Job) error
-	var status slicerjob.Status
+	query := &JobQuery{}
 	if statstr := q.Get("status"); statstr != "" {
-		status, err = slicerjob.ParseStatus(statstr)
-		if err != nil {
-			http.Error(w, "status: "+err.Error(), http.StatusBadRequest)
-			return
+		for _, name := range strings.Split(statstr, ",") {
+			status, err := slicerjob.ParseStatus(name)
+			if err != nil {
+				http.Error(w, "status: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			query.Status = append(query.Status, status)
 		}
-		filters = append(filters, func(job *slicerjob.Job) error {
-			if job.Status != status {
-				return ErrSkip
+	}
+	switch q.Get("order") {
+	case "", "oldest":
+	case "newest":
+		query.Newest = true
+	default:
+		http.Error(w, "order: must be oldest or newest", http.StatusBadRequest)
+		return
+	}
+	var times [4]time.Time
+	for i, name := range []string{"created_after", "created_before", "terminated_after", "terminated_before"} {
+		if v := q.Get(name); v != "" {
+			times[i], err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, name+": "+err.Error(), http.StatusBadRequest)
+				return
 			}
-			return nil
-		})
+		}
 	}
+	query.CreatedAfter, query.CreatedBefore = times[0], times[1]
+	terminatedAfter, terminatedBefore := times[2], times[3]
 
-	filter := func(job *slicerjob.Job) error {
+	var filters []func(job *slicerjob.Job) bool
+	if slicer := q.Get("slicer"); slicer != "" {
+		filters = append(filters, func(job *slicerjob.Job) bool {
+			return job.Slicer == slicer
+		})
+	}
+	if preset := q.Get("preset"); preset != "" {
+		filters = append(filters, func(job *slicerjob.Job) bool {
+			return job.Preset == preset
+		})
+	}
+	if node := q.Get("node"); node != "" {
+		filters = append(filters, func(job *slicerjob.Job) bool {
+			for _, a := range job.Attempts {
+				if a.Node == node {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if !terminatedAfter.IsZero() || !terminatedBefore.IsZero() {
+		filters = append(filters, func(job *slicerjob.Job) bool {
+			if job.Terminated == nil {
+				return false
+			}
+			if !terminatedAfter.IsZero() && job.Terminated.Before(terminatedAfter) {
+				return false
+			}
+			return terminatedBefore.IsZero() || job.Terminated.Before(terminatedBefore)
+		})
+	}
+	query.Filter = func(job *slicerjob.Job) error {
 		for _, fn := range filters {
-			err := fn(job)
-			if err != nil {
-				return err
+			if !fn(job) {
+				return ErrSkip
 			}
 		}
 		return nil
 	}
-	jobs, cursor, err := ListJobs(100*time.Millisecond, limit, cursor, filter)
+	jobs, cursor, err := srv.Store.ListJobs(100*time.Millisecond, limit, cursor, query)
 	if err == ErrExceededMaxDur {
 		err = nil
 	} else if err != nil {
@@ -325,7 +803,7 @@ func (srv *SnuggieServer) ListJobs(w http.ResponseWriter, r *http.Request) {
 	page := slicerjob.JobPage(cursor, jobs)
 	err = json.NewEncoder(w).Encode(page)
 	if err != nil {
-		log.Printf("encode: %v", err)
+		requestLogger(r).Warnf("http response: %v", err)
 	}
 }
 
@@ -338,13 +816,23 @@ func (srv *SnuggieServer) GetJob(w http.ResponseWriter, r *http.Request) {
 	}
 	err = json.NewEncoder(w).Encode(job)
 	if err != nil {
-		log.Printf("http response: %v", err)
+		requestLogger(r).Warnf("http response: %v", err)
 	}
 }
 
 func (srv *SnuggieServer) CreateJob(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
+	if srv.rejectDraining(w) {
+		return
+	}
+	err := srv.admitUpload(w, r)
+	if err != nil {
+		requestLogger(r).Warnf("upload rejected: %v", err)
+		writeAdmissionError(w, err)
+		return
+	}
+
 	slicerBackend := r.FormValue("slicer")
 	if slicerBackend != "slic3r" {
 		http.Error(w, "slicer not supported", http.StatusBadRequest)
@@ -365,19 +853,84 @@ func (srv *SnuggieServer) CreateJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//TODO make sure meshfile is at least .stl
 	meshfile, fileheader, err := r.FormFile("meshfile")
 	if err != nil {
 		http.Error(w, "bad meshfile, or 'meshfile' field not present", http.StatusBadRequest)
 		return
 	}
+	defer meshfile.Close()
+	err = srv.checkMesh(meshfile, fileheader)
+	if err != nil {
+		requestLogger(r).Warnf("upload rejected: %v", err)
+		writeAdmissionError(w, err)
+		return
+	}
 
-	job, err := srv.registerJob(meshfile, fileheader, slicerBackend, preset)
+	postprocess, err := parsePostProcess(r.Form["postprocess"])
+	if err != nil {
+		http.Error(w, "postprocess: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	thumbnails := r.FormValue("thumbnails")
+	_, err = parseThumbnailSizes(thumbnails)
+	if err != nil {
+		http.Error(w, "thumbnails: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts := &SliceOptions{
+		PostProcess: postprocess,
+		Thumbnails:  thumbnails,
+		RequestID:   r.Header.Get(requestIDHeader),
+	}
+
+	job := slicerjob.New()
+	job.Slicer = slicerBackend
+	job.Preset = preset
+	job.PostProcess = postprocess
+	job.Thumbnails = thumbnails
+	job.MeshName = filepath.Base(fileheader.Filename)
+	if ttlstr := r.FormValue("ttl"); ttlstr != "" {
+		ttl, err := time.ParseDuration(ttlstr)
+		if err != nil {
+			http.Error(w, "ttl: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ttl <= 0 {
+			http.Error(w, "ttl: must be positive", http.StatusBadRequest)
+			return
+		}
+		job.TTL = ttl.Seconds()
+	}
+
+	if name := r.FormValue("target"); name != "" {
+		target := srv.Targets[name]
+		if target == nil {
+			http.Error(w, "unknown target: "+name, http.StatusBadRequest)
+			return
+		}
+		delivery := &slicerjob.Delivery{
+			Target: name,
+			Print:  target.Print,
+			Status: slicerjob.DeliveryPending,
+		}
+		if printstr := r.FormValue("print"); printstr != "" {
+			delivery.Print, err = strconv.ParseBool(printstr)
+			if err != nil {
+				http.Error(w, "print: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		job.Delivery = delivery
+	}
+
+	err = srv.registerJob(job, meshfile, fileheader, opts)
 	if err != nil {
 		// TODO: distinguish unknown preset (Bad Request) from backend failure.
+		requestLogger(r).Errorf("registration failed: %v", err)
 		http.Error(w, "registration failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	requestLogger(r).With("job", job.ID, "preset", preset, "mesh", job.MeshName).Infof("job created")
 
 	jsonJob, err := json.Marshal(job)
 	if err != nil {
@@ -389,53 +942,76 @@ func (srv *SnuggieServer) CreateJob(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonJob)
 }
 
-func (srv *SnuggieServer) registerJob(meshfile multipart.File, header *multipart.FileHeader, slicerBackend string, preset string) (*slicerjob.Job, error) {
-	job := slicerjob.New()
-
+// registerJob stores meshfile and job, which must be created with
+// slicerjob.New, and schedules the job to be sliced.
+func (srv *SnuggieServer) registerJob(job *slicerjob.Job, meshfile multipart.File, header *multipart.FileHeader, opts *SliceOptions) error {
 	//do stuff to the job.
 	job.Status = slicerjob.Accepted
 	job.Progress = 0.0
 	job.URL = srv.url("/jobs/" + job.ID)
 
-	// if DataDir is empty the file will be in the working directory.
 	ext := filepath.Ext(header.Filename)
-	path := filepath.Join(srv.DataDir, job.ID+ext)
-	f, err := os.Create(path)
+	key := job.ID + ext + gzipExt
+	err := putArtifact(srv.Blobs, key, meshfile)
 	if err != nil {
-		return nil, fmt.Errorf("meshfile create: %v", err)
+		return fmt.Errorf("meshfile write: %v", err)
 	}
-	_, err = io.Copy(f, meshfile)
+
+	err = srv.Store.InsertJob(job, srv.event(slicerjob.EventAccepted, ""))
 	if err != nil {
-		f.Close()
-		return nil, fmt.Errorf("meshfile write: %v", err)
+		srv.Blobs.Delete(key)
+		return err
 	}
-
-	err = PutMeshFile(job.ID, path)
+	srv.Stats.JobAccepted(job.Slicer)
+	// cleanup removes a job which could not be scheduled along with its mesh.
+	cleanup := func() {
+		srv.Blobs.Delete(key)
+		srv.Store.DeleteJob(job.ID)
+	}
+	err = srv.Store.PutMeshFile(job.ID, key)
 	if err != nil {
-		return nil, fmt.Errorf("meshfile: %v", err)
+		cleanup()
+		return fmt.Errorf("meshfile: %v", err)
 	}
 
-	err = PutJob(job.ID, job)
+	err = srv.S.ScheduleSliceJob(job.ID, srv.url("/meshes/"+job.ID), job.Slicer, job.Preset, opts)
 	if err != nil {
-		return nil, err
+		cleanup()
+		return err
+	}
+
+	if srv.Thumbnails != nil {
+		_, err := srv.Thumbnails.Render(key, defaultThumbnailSize)
+		if err != nil {
+			logger.With("job", job.ID).Warnf("thumbnail: %v", err)
+		}
 	}
+	return nil
+}
 
-	url := srv.url("/meshes/" + job.ID)
-	if srv.LocalConsumer {
-		url = "file://" + path
+// GetJobHistory responds with the events recorded for a job, oldest first.
+func (srv *SnuggieServer) GetJobHistory(w http.ResponseWriter, r *http.Request) {
+	id, _ := srv.pathID(r.URL.Path, "/jobs/")
+	_, err := srv.lookupJob(id)
+	if err != nil {
+		http.Error(w, "lookup: "+err.Error(), http.StatusNotFound)
+		return
 	}
-	err = srv.S.ScheduleSliceJob(job.ID, url, slicerBackend, preset)
+	history, err := srv.Store.ViewHistory(id)
 	if err != nil {
-		os.Remove(path)
-		DeleteJob(job.ID)
-		return nil, err
+		requestLogger(r).With("job", id).Errorf("history: %v", err)
+		http.Error(w, "history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(history)
+	if err != nil {
+		requestLogger(r).Warnf("http response: %v", err)
 	}
-
-	return job, nil
 }
 
 func (srv *SnuggieServer) lookupJob(id string) (*slicerjob.Job, error) {
-	job, err := ViewJob(id)
+	job, err := srv.Store.ViewJob(id)
 	if err != nil {
 		err := fmt.Errorf("Job not found with id: %v", id)
 		return nil, err
@@ -450,56 +1026,101 @@ func (srv *SnuggieServer) lookupJob(id string) (*slicerjob.Job, error) {
 
 func (srv *SnuggieServer) DeleteJob(w http.ResponseWriter, r *http.Request) {
 	id, _ := srv.trimPath(r.URL.Path, "/jobs/")
-	_, err := srv.lookupJob(id)
+	job, err := srv.lookupJob(id)
 	if err != nil {
 		http.Error(w, "lookup: "+err.Error(), http.StatusNotFound)
 		return
 	}
-	srv.S.CancelSliceJob(id)
-	CancelJob(id)
-
+	// mark the job cancelled before interrupting the slicer so JobDone does
+	// not see the job as failed.
+	err = srv.Store.UpdateJob(id, srv.event(slicerjob.EventCancelled, ""), func(j *slicerjob.Job) error {
+		return j.SetStatus(slicerjob.Cancelled, time.Now())
+	})
+	if _, ok := err.(*slicerjob.TransitionError); ok {
+		http.Error(w, "job "+job.Status.String()+": cannot cancel", http.StatusConflict)
+		return
+	}
 	if err != nil {
-		log.Printf("http response: %v", err)
+		requestLogger(r).With("job", id).Errorf("cancel: %v", err)
+		http.Error(w, "cancel: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
+	srv.S.CancelSliceJob(id)
+	srv.Stats.JobTerminated(id, job.Slicer, job.Preset, slicerjob.Cancelled)
+	requestLogger(r).With("job", id).Infof("job cancelled")
 }
 
 func (srv *SnuggieServer) url(pathquery string) string {
 	return srv.BaseURL + srv.Prefix + pathquery
 }
 
-// JobDone stores the location of the successful output g-code for job id
-func (srv *SnuggieServer) JobDone(id, path string, err error) {
+// JobDone stores the key of the successful output g-code for job id
+func (srv *SnuggieServer) JobDone(id, key string, err error) {
+	log := logger.With("job", id)
+	if err == errShutdown {
+		// the job is still waiting and will be requeued when the server
+		// restarts.
+		log.Warnf("slicing interrupted: %v", err)
+		return
+	}
 	if err != nil {
-		log.Printf("FIXME -- failed job:%v err:%v", id, err)
+		srv.jobFailed(id, err)
 		return
 	}
 
 	now := time.Now()
 
-	err = PutGCodeFile(id, path)
+	// the gcode was produced, so failures to record it are unrelated to the
+	// mesh and the job may be sliced again.
+	err = srv.Store.PutGCodeFile(id, key)
 	if err != nil {
-		log.Printf("can't put gcode file path into database: %v", err)
+		// nothing refers to the gcode for it to be collected later.
+		srv.Blobs.Delete(key)
+		srv.jobFailed(id, &retryableError{fmt.Errorf("put gcode file: %v", err)})
 		return
 	}
 
-	job, err := ViewJob(id)
+	job, err := srv.Store.ViewJob(id)
 	if err != nil {
-		log.Printf("Can't view job from database:%v err:%v", id, err)
+		srv.jobFailed(id, &retryableError{fmt.Errorf("view job: %v", err)})
 		return
 	}
-	job.Status = slicerjob.Complete
-	job.GCodeURL = srv.url("/gcodes/" + id)
-	job.Progress = 1.0
-	job.Updated = &now
-	job.Terminated = &now
+	stats, err := srv.analyzeGCode(key, job.Preset)
+	if err != nil {
+		// the gcode is still usable without statistics.
+		log.Warnf("gcode stats: %v", err)
+	}
 
-	err = PutJob(id, job)
+	err = srv.Store.UpdateJob(id, srv.event(slicerjob.EventComplete, ""), func(j *slicerjob.Job) error {
+		err := j.SetStatus(slicerjob.Complete, now)
+		if err != nil {
+			return err
+		}
+		j.GCodeURL = srv.url("/gcodes/" + id)
+		j.Progress = 1.0
+		j.GCodeStats = stats
+		if n := len(j.Attempts); n > 0 {
+			j.Attempts[n-1].Ended = &now
+		}
+		job = j
+		return nil
+	})
+	if _, ok := err.(*slicerjob.TransitionError); ok {
+		// the job was cancelled as the slicer finished.
+		log.Warnf("update job: %v", err)
+		return
+	}
 	if err != nil {
-		log.Printf("Can't put job to database:%v err:%v", id, err)
+		srv.jobFailed(id, &retryableError{fmt.Errorf("update job: %v", err)})
 		return
 	}
 
-	log.Printf("completed job:%v gcode:%v", id, path)
+	srv.Stats.JobTerminated(id, job.Slicer, job.Preset, slicerjob.Complete)
+	log.With("gcode", key).Infof("job complete")
+
+	if job.Delivery != nil {
+		srv.goBackground(func() { srv.deliver(id, key) })
+	}
 }
 
 // RunConsumers pops jobs off the queue, fetches remote mesh files, slices
@@ -507,17 +1128,81 @@ func (srv *SnuggieServer) JobDone(id, path string, err error) {
 func (srv *SnuggieServer) RunConsumer() {
 	for {
 		job, err := srv.C.NextSliceJob()
+		if err == ErrQueueClosed {
+			return
+		}
 		if err != nil {
-			log.Printf("consumer: %v", err)
+			logger.Errorf("consumer: %v", err)
 			return
 		}
+		srv.jobStarted(job)
 		job.Done(srv.runConsumerJob(job))
 	}
 }
 
-func (srv *SnuggieServer) runConsumerJob(job *Job) (path string, err error) {
-	if !strings.HasPrefix(job.MeshURL, "file://") {
-		return "", fmt.Errorf("consumer cannot process: %v", job.MeshURL)
+// jobStarted marks job processing and records the start of a new attempt to
+// slice it.
+func (srv *SnuggieServer) jobStarted(job *Job) {
+	var created time.Time
+	err := srv.Store.UpdateJob(job.ID, srv.event(slicerjob.EventStarted, ""), func(j *slicerjob.Job) error {
+		if !j.Status.IsWaiting() {
+			return errNotWaiting
+		}
+		now := time.Now()
+		if j.Status == slicerjob.Processing {
+			// the job was interrupted by a restart and is resumed.
+			j.Updated = &now
+		} else if err := j.SetStatus(slicerjob.Processing, now); err != nil {
+			return err
+		}
+		j.Attempts = append(j.Attempts, &slicerjob.Attempt{
+			Number:  len(j.Attempts) + 1,
+			Node:    srv.NodeID,
+			Started: &now,
+		})
+		if j.Created != nil {
+			created = *j.Created
+		}
+		return nil
+	})
+	if err != nil && err != errNotWaiting {
+		job.Logger().Warnf("update job: %v", err)
+	}
+	srv.Stats.JobStarted(job.ID, job.Slicer, job.Preset, created)
+}
+
+// jobProgress records a milestone reached while slicing job.
+func (srv *SnuggieServer) jobProgress(job *Job, progress float64, milestone string) {
+	err := srv.Store.UpdateJob(job.ID, srv.event(slicerjob.EventProgress, milestone), func(j *slicerjob.Job) error {
+		if j.Status != slicerjob.Processing {
+			return errNotWaiting
+		}
+		now := time.Now()
+		j.Progress = progress
+		j.Updated = &now
+		return nil
+	})
+	if err != nil && err != errNotWaiting {
+		job.Logger().Warnf("update job: %v", err)
+	}
+}
+
+// event returns a history event of the given type which occurred on this
+// node.
+func (srv *SnuggieServer) event(typ, msg string) *slicerjob.Event {
+	return &slicerjob.Event{Type: typ, Node: srv.NodeID, Message: msg}
+}
+
+// runConsumerJob slices job and returns the key of its gcode.  Consumers run
+// in the server's process and read the mesh from the BlobStore rather than
+// the job's MeshURL.
+func (srv *SnuggieServer) runConsumerJob(job *Job) (key string, err error) {
+	meshKey, err := srv.Store.ViewMeshFile(job.ID)
+	if err == nil && meshKey == "" {
+		err = fmt.Errorf("not found")
+	}
+	if err != nil {
+		return "", fmt.Errorf("meshfile: %v", err)
 	}
 
 	gcode := filepath.Join(srv.DataDir, job.ID+".gcode")
@@ -525,21 +1210,55 @@ func (srv *SnuggieServer) runConsumerJob(job *Job) (path string, err error) {
 	if configPath == "" {
 		return "", fmt.Errorf("consumer: unknown preset")
 	}
+	// slic3r needs a local, uncompressed mesh with its original file
+	// extension.
+	ext := filepath.Ext(strings.TrimSuffix(meshKey, gzipExt))
+	mesh := filepath.Join(srv.DataDir, job.ID+".slicing"+ext)
+	err = extractArtifact(srv.Blobs, mesh, meshKey)
+	if err != nil {
+		return "", fmt.Errorf("meshfile: %v", err)
+	}
+	defer os.Remove(mesh)
 	slic3r := &Slic3r{
 		Bin:        srv.Slic3r,
 		ConfigPath: configPath,
-		InPath:     strings.TrimPrefix(job.MeshURL, "file://"),
+		InPath:     mesh,
 		OutPath:    gcode,
 	}
-	err = Run(slic3r, job.Cancel)
+	err = Run(slic3r, &srv.Limits, job.Cancel, job.Logger())
+	if _, ok := err.(*LimitError); ok || err == errShutdown {
+		return "", err
+	}
 	if err != nil {
-		return "", fmt.Errorf("run: %v", err)
+		rerr := fmt.Errorf("run: %v", err)
+		if isTransientRunError(err) {
+			return "", &retryableError{rerr}
+		}
+		return "", rerr
 	}
 	_, err = os.Stat(slic3r.OutPath)
 	if err != nil {
 		return "", fmt.Errorf("stat gcode: %v", err)
 	}
-	return gcode, nil
+	srv.jobProgress(job, 0.8, "sliced")
+	procs, err := srv.gcodeProcessors(job, mesh)
+	if err != nil {
+		return "", fmt.Errorf("postprocess: %v", err)
+	}
+	if len(procs) > 0 {
+		err = postProcessGCode(gcode, procs)
+		if err != nil {
+			return "", fmt.Errorf("postprocess: %v", err)
+		}
+		srv.jobProgress(job, 0.9, "post-processed")
+	}
+	key = job.ID + ".gcode" + gzipExt
+	err = putArtifactFile(srv.Blobs, key, gcode)
+	if err != nil {
+		os.Remove(gcode)
+		return "", fmt.Errorf("store gcode: %v", err)
+	}
+	return key, nil
 }
 
 func main() {
@@ -549,6 +1268,34 @@ func main() {
 	dataDir := flag.String("data", "", "location for database, .stl, .gcode")
 	httpAddr := flag.String("http", ":8888", "address to serve traffic")
 	baseURL := flag.String("baseurl", "", "links and redirection go to the specified base url")
+	targetsDir := flag.String("targets", "", "specify a directory with output target configurations")
+	logLevel := flag.String("log.level", "info", "minimum level of logged messages (debug, info, warn, error)")
+	logJSON := flag.Bool("log.json", false, "log messages as JSON objects")
+	workers := flag.Int("slicer.workers", 1, "number of jobs sliced at a time")
+	shutdownTimeout := flag.Duration("shutdown.timeout", time.Minute, "time allowed for running slices to finish when the server is stopped")
+	minFree := flag.Int64("data.minfree", defaultMinFree>>20, "free space (MB) required in the data directory for readiness")
+	maxUpload := flag.Int64("upload.maxsize", defaultMaxUpload>>20, "maximum size (MB) of a job request, or 0 for no limit")
+	maxTriangles := flag.Int("upload.maxtriangles", defaultMaxTriangles, "maximum triangles in a job's mesh, or 0 for no limit")
+	slicerTimeout := flag.Duration("slicer.timeout", 30*time.Minute, "wall-clock time a slicer may run, or 0 for no limit")
+	slicerMemory := flag.Int64("slicer.memory", 0, "memory (MB) a slicer may use, or 0 for no limit")
+	slicerCPUTime := flag.Duration("slicer.cputime", 0, "processor time a slicer may use, or 0 for no limit")
+	slicerCPUs := flag.Float64("slicer.cpus", 0, "processors a slicer may use concurrently, or 0 for no limit (requires -slicer.cgroup)")
+	slicerNice := flag.Int("slicer.nice", 10, "scheduling priority adjustment for slicers")
+	slicerCgroup := flag.String("slicer.cgroup", "", "cgroup v2 directory delegated to the server in which slicers are run")
+	retryMax := flag.Int("retry.max", 3, "attempts to slice a job which fails for transient reasons")
+	retryBackoff := flag.Duration("retry.backoff", 10*time.Second, "delay before a failed job is sliced again; doubled for each attempt")
+	retryMaxBackoff := flag.Duration("retry.maxbackoff", 5*time.Minute, "maximum delay before a failed job is sliced again")
+	quota := flag.Int64("data.quota", 0, "space (MB) files may use before terminated jobs are evicted, or 0 for no limit")
+	gcInterval := flag.Duration("gc.interval", time.Minute, "time between runs of the garbage collector")
+	retainComplete := flag.Duration("retain.complete", 24*time.Hour, "time completed jobs are kept")
+	retainFailed := flag.Duration("retain.failed", 24*time.Hour, "time failed jobs are kept")
+	retainCancelled := flag.Duration("retain.cancelled", time.Hour, "time cancelled jobs are kept")
+	s3Bucket := flag.String("s3.bucket", "", "store meshes and g-code in an S3-compatible bucket instead of the data directory")
+	s3Endpoint := flag.String("s3.endpoint", "https://s3.amazonaws.com", "URL of the S3-compatible service")
+	s3Region := flag.String("s3.region", "us-east-1", "region of the S3 bucket")
+	s3Prefix := flag.String("s3.prefix", "", "prefix of the S3 object keys, like \"snuggied/\"")
+	s3AccessKey := flag.String("s3.accesskey", "", "S3 access key id (default $AWS_ACCESS_KEY_ID)")
+	s3SecretKey := flag.String("s3.secretkey", "", "S3 secret access key (default $AWS_SECRET_ACCESS_KEY)")
 	flagenv.Prefix = "SNUGGIED_"
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage: %s [flags]\n", os.Args[0])
@@ -571,11 +1318,17 @@ func main() {
 	flagenv.Parse()
 	flag.Parse()
 
+	level, err := ParseLevel(*logLevel)
+	if err != nil {
+		logger.Fatalf("log.level: %v", err)
+	}
+	logger = NewLogger(os.Stderr, level, *logJSON).With("node", *machineID)
+
 	pathPrefix := "/slicer"
 	if *baseURL != "" {
 		u, err := url.Parse(*baseURL)
 		if err != nil {
-			log.Fatalf("baseurl: %v", err)
+			logger.Fatalf("baseurl: %v", err)
 		}
 		pathPrefix = strings.TrimSuffix(u.Path, "/")
 	} else {
@@ -589,94 +1342,192 @@ func main() {
 	if *dataDir == "" {
 		home := os.Getenv("HOME")
 		if home == "" {
-			log.Fatalf("data: unable to locate home directory")
+			logger.Fatalf("data: unable to locate home directory")
 		}
 		*dataDir = filepath.Join(home, ".local", "share", "matching-snuggies", "data")
 		err := os.MkdirAll(*dataDir, 0755)
 		if err != nil {
-			log.Fatalf("data: %v", err)
+			logger.Fatalf("data: %v", err)
 		}
 	}
 
 	// make sure that dataDir is a directory and that it's path is absolute.
 	// forcing absolute paths is merely a simple way to prevent weird bugs
 	// later on.
-	err := pathIsDir(*dataDir)
+	err = pathIsDir(*dataDir)
 	if err != nil {
-		log.Fatalf("data directory: %v", err)
+		logger.Fatalf("data directory: %v", err)
 	}
 	if !filepath.IsAbs(*dataDir) {
-		log.Fatalf("data directory is not an absolute path: %v", *dataDir)
+		logger.Fatalf("data directory is not an absolute path: %v", *dataDir)
 	}
 
 	slic3rPresets, err := ReadPresetsDirSlic3r(*slic3rConfigDir)
 	if err != nil {
-		log.Fatalf("slic3r configs: %v", err)
+		logger.Fatalf("slic3r configs: %v", err)
 	}
 	if len(slic3rPresets) == 0 {
-		log.Fatalf("slic3r configs: no presets found")
+		logger.Fatalf("slic3r configs: no presets found")
 	}
 
-	DB = loadDB(filepath.Join(*dataDir, "snuggied.boltdb"))
+	var targets map[string]*OutputTarget
+	if *targetsDir != "" {
+		targets, err = ReadTargetsDir(*targetsDir)
+		if err != nil {
+			logger.Fatalf("targets: %v", err)
+		}
+	}
+
+	store, err := OpenBoltStore(filepath.Join(*dataDir, "snuggied.boltdb"))
+	if err != nil {
+		logger.Fatalf("database: %v", err)
+	}
 	fileroot := filepath.Join(*dataDir, "snuggied-files")
 	err = os.MkdirAll(fileroot, 0750)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalf("data: %v", err)
+	}
+	var blobs BlobStore = LocalBlobs(fileroot)
+	if *s3Bucket != "" {
+		if *s3AccessKey == "" {
+			*s3AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		}
+		if *s3SecretKey == "" {
+			*s3SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		}
+		blobs = &S3Blobs{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			Prefix:    *s3Prefix,
+			AccessKey: *s3AccessKey,
+			SecretKey: *s3SecretKey,
+		}
+	}
+
+	limits := Limits{
+		Timeout: *slicerTimeout,
+		Memory:  *slicerMemory << 20,
+		CPUTime: *slicerCPUTime,
+		CPUs:    *slicerCPUs,
+		Nice:    *slicerNice,
+		Cgroup:  *slicerCgroup,
+	}
+	if limits.Cgroup != "" {
+		err := CheckCgroup(limits.Cgroup, &limits)
+		if err != nil {
+			logger.Warnf("slicer.cgroup: %v; using process limits only", err)
+			limits.Cgroup = ""
+		}
+	}
+	if limits.CPUs > 0 && limits.Cgroup == "" {
+		logger.Warnf("slicer.cpus: ignored without a cgroup")
+	}
+
+	if *workers < 1 {
+		logger.Fatalf("slicer.workers: must be at least 1")
+	}
+	if *gcInterval <= 0 {
+		logger.Fatalf("gc.interval: must be positive")
 	}
 
+	retry := RetryPolicy{
+		MaxAttempts: *retryMax,
+		Backoff:     *retryBackoff,
+		MaxBackoff:  *retryMaxBackoff,
+	}
+	retention := Retention{
+		Complete:  *retainComplete,
+		Failed:    *retainFailed,
+		Cancelled: *retainCancelled,
+	}
 	srv := &SnuggieServer{
+		NodeID:        *machineID,
 		BaseURL:       *baseURL,
 		Prefix:        pathPrefix,
 		DataDir:       fileroot,
+		Blobs:         blobs,
+		Thumbnails:    NewThumbnailer(1, blobs, fileroot),
+		Targets:       targets,
+		Stats:         NewStats(),
+		Store:         store,
+		Workers:       *workers,
+		MinFree:       *minFree << 20,
+		Quota:         *quota << 20,
+		Retention:     retention,
+		Limits:        limits,
+		Retry:         retry,
+		MaxUpload:     *maxUpload << 20,
+		MaxTriangles:  *maxTriangles,
 		Slic3r:        *slic3rBin,
 		Slic3rPresets: slic3rPresets,
 	}
 
 	// register http handlers
-	srv.RegisterHandlers(http.DefaultServeMux)
+	handler := logRequests(srv.RegisterHandlers(http.NewServeMux()))
 
 	// the scheduler/consumer for the server are implemented using an in-memory
 	// queue.
 	memq := MemoryQueue(srv.JobDone)
+	memq.NodeID = *machineID
 	srv.S, srv.C = memq, memq
-	srv.LocalConsumer = true // use file:// locations instead of http://
 
-	// BUG:
-	// there is a race condition starting the queue consumer before serving
-	// http traffic. slice jobs could be finished before the http server is
-	// capable of serving the result. this would be most problematic if binding
-	// the address fails.
-	go srv.RunConsumer()
+	// bind the listener before any jobs are processed so that results can
+	// always be served.
+	ln, err := net.Listen("tcp", *httpAddr)
+	if err != nil {
+		logger.Fatalf("http: %v", err)
+	}
+	logger.Infof("listening on %s", ln.Addr())
+	httpServer := &http.Server{Handler: handler}
+	httpErr := make(chan error, 1)
+	go func() { httpErr <- httpServer.Serve(ln) }()
 
-	// run the garbage collector every minute, deleting objects which are more
-	// than one hour old.
+	// jobs waiting when the server last stopped are sliced before new ones.
+	err = srv.RequeueJobs()
+	if err != nil {
+		logger.Errorf("requeue: %v", err)
+	}
+	srv.StartConsumers()
+
+	// run the garbage collector periodically, deleting jobs which have
+	// expired and enforcing the disk quota.
 	gctrigger := make(chan struct{}, 1)
 	gctrigger <- struct{}{}
-	go gcLoop(time.Minute, 5*time.Minute, gctrigger)
-
-	log.Printf("machine %s binding to %s", *machineID, *httpAddr)
-	log.Fatal(http.ListenAndServe(*httpAddr, nil))
-}
-
-func gcLoop(delay, staleness time.Duration, trigger <-chan struct{}) {
-	ticker := time.NewTicker(delay)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-		case <-trigger:
-		}
-		err := RemoveFiles(delay/2, 1000)
-		if err != nil {
-			log.Printf("remove: %v", err)
-			// don't do anything special about errors removing files the
-			// logging is specific enough for the user to handle anything.
-		}
-		err = DeleteOldJobs(time.Now().Add(-staleness), delay/2, 1000)
-		if err != nil {
-			log.Printf("gc: %v", err)
-		}
+	gcstop := make(chan struct{})
+	gcdone := make(chan struct{})
+	go func() {
+		defer close(gcdone)
+		srv.gcLoop(*gcInterval, gctrigger, gcstop)
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case s := <-sig:
+		logger.Infof("received %v; shutting down", s)
+	case err := <-httpErr:
+		logger.Errorf("http: %v", err)
+	}
+	// a second signal stops the server immediately.
+	signal.Stop(sig)
+
+	// requests continue to be served while slices finish so clients can
+	// retrieve their results.  new jobs are rejected.
+	srv.Drain(*shutdownTimeout)
+	close(gcstop)
+	<-gcdone
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err = httpServer.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		logger.Warnf("http shutdown: %v", err)
+	}
+	err = store.Close()
+	if err != nil {
+		logger.Fatalf("database: %v", err)
 	}
+	logger.Infof("shutdown complete")
 }
 
 func pathIsDir(path string) error {
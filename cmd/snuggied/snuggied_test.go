@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+func TestJobHistory(t *testing.T) {
+	store := MemoryStore()
+	srv := &SnuggieServer{Prefix: "/slicer", NodeID: "node0", Store: store, S: MemoryQueue(nil)}
+	job := slicerjob.New()
+	other := slicerjob.New()
+	for _, j := range []*slicerjob.Job{job, other} {
+		err := store.InsertJob(j, srv.event(slicerjob.EventAccepted, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	qjob := &Job{ID: job.ID}
+	srv.jobStarted(qjob)
+	srv.jobProgress(qjob, 0.8, "sliced")
+	srv.jobFailed(job.ID, fmt.Errorf("bad mesh"))
+
+	mux := http.NewServeMux()
+	srv.RegisterHandlers(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/slicer/jobs/"+job.ID+"/history", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status: %d", w.Code)
+	}
+	var history *slicerjob.History
+	err := json.Unmarshal(w.Body.Bytes(), &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []struct {
+		Type   string
+		Status slicerjob.Status
+	}{
+		{slicerjob.EventAccepted, slicerjob.Accepted},
+		{slicerjob.EventStarted, slicerjob.Processing},
+		{slicerjob.EventProgress, slicerjob.Processing},
+		{slicerjob.EventFailed, slicerjob.Failed},
+	}
+	if history.JobID != job.ID || len(history.Events) != len(expect) {
+		t.Fatalf("history: %+v", history)
+	}
+	for i, ev := range history.Events {
+		if ev.Type != expect[i].Type || ev.Status != expect[i].Status || ev.Node != "node0" {
+			t.Errorf("event %d: %+v", i, ev)
+		}
+	}
+	if ev := history.Events[2]; ev.Progress != 0.8 || ev.Message != "sliced" {
+		t.Errorf("progress event: %+v", ev)
+	}
+	if ev := history.Events[3]; ev.Message != "bad mesh" {
+		t.Errorf("failed event: %+v", ev)
+	}
+
+	// terminated jobs cannot be cancelled.
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("DELETE", "/slicer/jobs/"+job.ID, nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("cancel failed job: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("DELETE", "/slicer/jobs/"+other.ID, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("cancel accepted job: %d", w.Code)
+	}
+	history, err = store.ViewHistory(other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(history.Events); n != 2 || history.Events[1].Type != slicerjob.EventCancelled {
+		t.Errorf("cancelled history: %+v", history.Events)
+	}
+
+	// deleted jobs have no history.
+	err = store.DeleteJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/slicer/jobs/"+job.ID+"/history", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("deleted job history: %d", w.Code)
+	}
+}
+
+// insertFailStore is a JobStore which cannot store new jobs.
+type insertFailStore struct {
+	JobStore
+}
+
+func (s insertFailStore) InsertJob(job *slicerjob.Job, ev *slicerjob.Event) error {
+	return fmt.Errorf("store is full")
+}
+
+func TestRegisterJobFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobs := LocalBlobs(dir)
+	srv := &SnuggieServer{
+		Prefix:     "/slicer",
+		NodeID:     "node0",
+		Store:      insertFailStore{MemoryStore()},
+		S:          MemoryQueue(nil),
+		Blobs:      blobs,
+		Thumbnails: NewThumbnailer(1, blobs, dir),
+	}
+	f, err := os.Open("../../testdata/FirstCube.stl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	job := slicerjob.New()
+	err = srv.registerJob(job, f, &multipart.FileHeader{Filename: "FirstCube.stl"}, nil)
+	if err == nil {
+		t.Fatalf("job registered")
+	}
+
+	// nothing is left behind for a job which was not stored.
+	_, err = blobs.Open(job.ID + ".stl" + gzipExt)
+	if err != ErrBlobNotFound {
+		t.Errorf("mesh blob: %v", err)
+	}
+	if n := len(srv.Thumbnails.pending); n != 0 {
+		t.Errorf("%d thumbnails rendering", n)
+	}
+}
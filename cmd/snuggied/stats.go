@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// statsWindows are the periods over which terminated jobs are counted.  The
+// last window must be the longest.
+var statsWindows = []struct {
+	Name string
+	Dur  time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+// QueueStater is implemented by queues that can report their length.
+type QueueStater interface {
+	QueueStats() (running, queued int)
+}
+
+// Stats collects statistics about the jobs processed by a server.  Stats are
+// kept in memory and reset when the server restarts.  A nil *Stats discards
+// the jobs recorded with it.
+type Stats struct {
+	mu      sync.Mutex
+	started map[string]time.Time
+	events  []statsEvent
+	presets map[string]*presetTotals
+
+	// totals for the metrics endpoint.
+	jobs       map[jobsKey]int
+	retries    map[string]int
+	gcFiles    int
+	gcJobs     int
+	sliceTimes map[string]*histogram
+	queueWaits map[string]*histogram
+
+	gc slicerjob.GCStats
+}
+
+// gcRecent is the number of garbage collector decisions kept by Stats.
+const gcRecent = 20
+
+// jobsKey identifies the jobs counted by the snuggied_jobs_total metric.
+type jobsKey struct {
+	Slicer string
+	Status slicerjob.Status
+}
+
+// statsEvent records the termination of a job.
+type statsEvent struct {
+	Time   time.Time
+	Status slicerjob.Status
+}
+
+type presetTotals struct {
+	Started   int
+	Complete  int
+	Failed    int
+	Slices    int
+	QueueWait time.Duration
+	SliceTime time.Duration
+}
+
+// NewStats allocates and initializes a new Stats.
+func NewStats() *Stats {
+	return &Stats{
+		started:    make(map[string]time.Time),
+		presets:    make(map[string]*presetTotals),
+		jobs:       make(map[jobsKey]int),
+		retries:    make(map[string]int),
+		sliceTimes: make(map[string]*histogram),
+		queueWaits: make(map[string]*histogram),
+	}
+}
+
+func (s *Stats) preset(name string) *presetTotals {
+	p := s.presets[name]
+	if p == nil {
+		p = new(presetTotals)
+		s.presets[name] = p
+	}
+	return p
+}
+
+// JobAccepted records that a job was created.
+func (s *Stats) JobAccepted(slicer string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[jobsKey{slicer, slicerjob.Accepted}]++
+}
+
+// JobStarted records that a consumer began slicing a job which was created
+// at the given time.
+func (s *Stats) JobStarted(id, slicer, preset string, created time.Time) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started[id] = now
+	s.jobs[jobsKey{slicer, slicerjob.Processing}]++
+	p := s.preset(preset)
+	p.Started++
+	if !created.IsZero() {
+		wait := now.Sub(created)
+		p.QueueWait += wait
+		observe(s.queueWaits, preset, wait)
+	}
+}
+
+// JobRetried records that a job failed and will be sliced again.
+func (s *Stats) JobRetried(slicer string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries[slicer]++
+}
+
+// JobTerminated records that a job reached the terminal status.  Jobs which
+// are cancelled before they start may be recorded without calling
+// JobStarted.
+func (s *Stats) JobTerminated(id, slicer, preset string, status slicerjob.Status) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start, ok := s.started[id]
+	delete(s.started, id)
+	s.jobs[jobsKey{slicer, status}]++
+	p := s.preset(preset)
+	switch status {
+	case slicerjob.Complete:
+		p.Complete++
+		if ok {
+			p.Slices++
+			p.SliceTime += now.Sub(start)
+			observe(s.sliceTimes, preset, now.Sub(start))
+		}
+	case slicerjob.Failed:
+		p.Failed++
+	}
+	s.events = append(s.events, statsEvent{now, status})
+	s.expire(now)
+}
+
+// GCRun records a run of the garbage collector which removed files and
+// deleted jobs.  After the run the server's files used usage bytes of quota,
+// which is zero if unlimited.
+func (s *Stats) GCRun(files int, deleted []*slicerjob.GCDecision, usage, quota int64) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gcFiles += files
+	s.gcJobs += len(deleted)
+	s.gc.LastRun = &now
+	s.gc.Usage = usage
+	s.gc.Quota = quota
+	s.gc.RemovedFiles += files
+	for _, d := range deleted {
+		switch d.Reason {
+		case slicerjob.GCExpired:
+			s.gc.ExpiredJobs++
+		case slicerjob.GCQuota:
+			s.gc.EvictedJobs++
+			s.gc.EvictedBytes += d.Bytes
+		}
+	}
+	// recent decisions are kept newest first.
+	recent := make([]*slicerjob.GCDecision, 0, gcRecent)
+	for i := len(deleted) - 1; i >= 0 && len(recent) < gcRecent; i-- {
+		recent = append(recent, deleted[i])
+	}
+	for _, d := range s.gc.Recent {
+		if len(recent) >= gcRecent {
+			break
+		}
+		recent = append(recent, d)
+	}
+	s.gc.Recent = recent
+}
+
+// expire discards events older than the longest window.
+func (s *Stats) expire(now time.Time) {
+	oldest := now.Add(-statsWindows[len(statsWindows)-1].Dur)
+	i := 0
+	for i < len(s.events) && s.events[i].Time.Before(oldest) {
+		i++
+	}
+	if i > 0 {
+		s.events = append(s.events[:0], s.events[i:]...)
+	}
+}
+
+// Snapshot returns the current statistics.  Queue and disk usage are not
+// computed by Snapshot.
+func (s *Stats) Snapshot() *slicerjob.ServerStats {
+	now := time.Now()
+	stats := &slicerjob.ServerStats{
+		Time:    now,
+		Windows: make(map[string]*slicerjob.WindowStats),
+		Presets: make(map[string]*slicerjob.PresetStats),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now)
+	for _, w := range statsWindows {
+		win := new(slicerjob.WindowStats)
+		since := now.Add(-w.Dur)
+		for _, e := range s.events {
+			if e.Time.Before(since) {
+				continue
+			}
+			switch e.Status {
+			case slicerjob.Complete:
+				win.Complete++
+			case slicerjob.Failed:
+				win.Failed++
+			case slicerjob.Cancelled:
+				win.Cancelled++
+			}
+		}
+		stats.Windows[w.Name] = win
+	}
+	for name, p := range s.presets {
+		ps := &slicerjob.PresetStats{
+			Started:  p.Started,
+			Complete: p.Complete,
+			Failed:   p.Failed,
+		}
+		if p.Started > 0 {
+			ps.MeanQueueWait = (p.QueueWait / time.Duration(p.Started)).Seconds()
+		}
+		if p.Slices > 0 {
+			ps.MeanSliceTime = (p.SliceTime / time.Duration(p.Slices)).Seconds()
+		}
+		stats.Presets[name] = ps
+	}
+	if s.gc.LastRun != nil {
+		gc := s.gc
+		gc.Recent = append([]*slicerjob.GCDecision(nil), s.gc.Recent...)
+		stats.GC = &gc
+	}
+	return stats
+}
+
+// diskUsage computes the space used by the files in the data directory and
+// the job store.
+func (srv *SnuggieServer) diskUsage() (*slicerjob.DiskUsage, error) {
+	du := new(slicerjob.DiskUsage)
+	err := filepath.Walk(srv.DataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// files may be removed by the garbage collector during the walk.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			du.Files += info.Size()
+			du.FileCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if db, ok := srv.Store.(StoreSizer); ok {
+		du.Database, err = db.Size()
+		if err != nil {
+			return nil, err
+		}
+	}
+	du.Total = du.Files + du.Database
+	return du, nil
+}
+
+// GetStats responds with statistics about the server's queue, jobs, and disk
+// usage.
+func (srv *SnuggieServer) GetStats(w http.ResponseWriter, r *http.Request) {
+	stats := srv.Stats.Snapshot()
+	if q, ok := srv.S.(QueueStater); ok {
+		stats.Running, stats.Queued = q.QueueStats()
+	}
+	var err error
+	stats.Disk, err = srv.diskUsage()
+	if err != nil {
+		requestLogger(r).Warnf("disk usage: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(stats)
+	if err != nil {
+		requestLogger(r).Warnf("http response: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+func TestStats(t *testing.T) {
+	s := NewStats()
+	s.JobStarted("a", "slic3r", "hq", time.Now().Add(-2*time.Second))
+	s.JobTerminated("a", "slic3r", "hq", slicerjob.Complete)
+	s.JobStarted("b", "slic3r", "hq", time.Now())
+	s.JobTerminated("b", "slic3r", "hq", slicerjob.Failed)
+	s.JobTerminated("c", "slic3r", "fast", slicerjob.Cancelled)
+
+	// events older than the longest window are discarded.
+	s.events = append([]statsEvent{{time.Now().Add(-48 * time.Hour), slicerjob.Complete}}, s.events...)
+
+	stats := s.Snapshot()
+	win := stats.Windows["1m"]
+	if win == nil {
+		t.Fatalf("missing window")
+	}
+	if win.Complete != 1 || win.Failed != 1 || win.Cancelled != 1 {
+		t.Errorf("window: %+v", win)
+	}
+	if len(s.events) != 3 {
+		t.Errorf("events: %d", len(s.events))
+	}
+	hq := stats.Presets["hq"]
+	if hq == nil {
+		t.Fatalf("missing preset")
+	}
+	if hq.Started != 2 || hq.Complete != 1 || hq.Failed != 1 {
+		t.Errorf("preset: %+v", hq)
+	}
+	if hq.MeanQueueWait < 0.9 || hq.MeanQueueWait > 1.5 {
+		t.Errorf("mean queue wait: %v", hq.MeanQueueWait)
+	}
+}
+
+type fakeQueue struct{ running, queued int }
+
+func (q fakeQueue) QueueStats() (int, int) { return q.running, q.queued }
+
+func TestWriteMetrics(t *testing.T) {
+	s := NewStats()
+	s.JobAccepted("slic3r")
+	s.JobStarted("a", "slic3r", "hq", time.Now().Add(-2*time.Second))
+	s.JobTerminated("a", "slic3r", "hq", slicerjob.Complete)
+	s.GCRun(3, []*slicerjob.GCDecision{{JobID: "b", Reason: slicerjob.GCQuota, Bytes: 10}}, 100, 0)
+
+	var buf bytes.Buffer
+	err := s.WriteMetrics(&buf, fakeQueue{1, 4}, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`snuggied_jobs_total{backend="slic3r",status="accepted"} 1`,
+		`snuggied_jobs_total{backend="slic3r",status="complete"} 1`,
+		`snuggied_queue_wait_seconds_bucket{preset="hq",le="1"} 0`,
+		`snuggied_queue_wait_seconds_bucket{preset="hq",le="2.5"} 1`,
+		`snuggied_queue_wait_seconds_bucket{preset="hq",le="+Inf"} 1`,
+		`snuggied_slice_duration_seconds_count{preset="hq"} 1`,
+		`snuggied_gc_files_removed_total 3`,
+		`snuggied_gc_jobs_deleted_total 1`,
+		`snuggied_gc_jobs_evicted_total 1`,
+		`snuggied_queue_length 4`,
+		`snuggied_worker_occupancy 0.5`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+
+	// servers without stats still report their queue.
+	s = nil
+	buf.Reset()
+	err = s.WriteMetrics(&buf, fakeQueue{1, 4}, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Contains(out, "snuggied_jobs_total") || !strings.Contains(out, "snuggied_workers 2\n") {
+		t.Errorf("nil stats:\n%s", out)
+	}
+}
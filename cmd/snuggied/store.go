@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/gcode"
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// JobStore persists jobs, their histories, and the locations of their files.
+// Jobs returned by a JobStore may be modified by the caller without
+// affecting the store.  JobStore implementations are safe for concurrent use.
+type JobStore interface {
+	// InsertJob stores a new job and begins its history with ev, if ev is
+	// not nil.
+	InsertJob(job *slicerjob.Job, ev *slicerjob.Event) error
+
+	// ViewJob returns the job with the given id or ErrJobNotFound.
+	ViewJob(id string) (*slicerjob.Job, error)
+
+	// UpdateJob modifies the job with the given id using fn and appends ev,
+	// if it is not nil, to the job's history.  The job is not modified if fn
+	// returns an error.  A slicerjob.TransitionError is returned if fn
+	// changes the job's status in a way slicerjob does not allow.  The status
+	// and progress of ev are set from the job after fn modifies it, so fn may
+	// change ev to describe what happened.
+	UpdateJob(id string, ev *slicerjob.Event, fn func(job *slicerjob.Job) error) error
+
+	// DeleteJob deletes a job and its history.  The job's files are recorded
+	// so they can be removed later, see DeletedFiles.
+	DeleteJob(id string) error
+
+	// ListJobs returns up to limit jobs matching q which follow cursor.  The
+	// returned cursor continues the listing and is nil when no jobs remain.
+	// ListJobs stops and returns ErrExceededMaxDur if it runs longer than
+	// maxDur.
+	ListJobs(maxDur time.Duration, limit int, cursor []byte, q *JobQuery) ([]*slicerjob.Job, []byte, error)
+
+	// DeleteOldJobs deletes up to maxDel terminated jobs which have expired
+	// at time now under the retention r and returns the deleted jobs.
+	// ErrMaxDeleted is returned if the limit is reached and
+	// ErrExceededMaxDur if deletion runs longer than maxDur.
+	DeleteOldJobs(r *Retention, now time.Time, maxDur time.Duration, maxDel int) ([]*slicerjob.Job, error)
+
+	// ViewHistory returns the events recorded for the job with the given id,
+	// oldest first.
+	ViewHistory(id string) (*slicerjob.History, error)
+
+	// PutMeshFile and PutGCodeFile record the BlobStore keys of a job's
+	// files.  ViewMeshFile and ViewGCodeFile return an empty key if a job has
+	// no such file.
+	PutMeshFile(id, path string) error
+	ViewMeshFile(id string) (string, error)
+	PutGCodeFile(id, path string) error
+	ViewGCodeFile(id string) (string, error)
+
+	// PutLayerIndex stores the layer index of a job's gcode.  ViewLayerIndex
+	// returns a nil index if the gcode has not been indexed.
+	PutLayerIndex(id string, idx *gcode.LayerIndex) error
+	ViewLayerIndex(id string) (*gcode.LayerIndex, error)
+
+	// DeletedFiles returns up to limit files of deleted jobs which have not
+	// been removed.  FileRemoved forgets a file once it has been removed.
+	DeletedFiles(limit int) ([]*DeletedFile, error)
+	FileRemoved(key string) error
+
+	// Ping returns an error if the store cannot be written.
+	Ping() error
+
+	Close() error
+}
+
+// StoreSizer is implemented by stores which occupy space on disk.
+type StoreSizer interface {
+	// Size returns the bytes used by the store.
+	Size() (int64, error)
+}
+
+// DeletedFile is a file belonging to a deleted job, stored in the BlobStore
+// under Path.  Mesh is true if the file is a job's mesh, which may have
+// thumbnails.
+type DeletedFile struct {
+	Key  string
+	Path string
+	Mesh bool
+}
+
+// JobQuery selects the jobs returned by ListJobs.  Jobs created in the
+// range [CreatedAfter, CreatedBefore) with any of the given statuses, and for
+// which Filter returns nil, are listed in order of creation.  Zero values do
+// not restrict the jobs listed.
+type JobQuery struct {
+	Status        []slicerjob.Status
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Newest        bool // list the most recently created jobs first
+	Filter        func(job *slicerjob.Job) error
+}
+
+// hasStatus returns true if q lists jobs with status.
+func (q *JobQuery) hasStatus(status slicerjob.Status) bool {
+	if len(q.Status) == 0 {
+		return true
+	}
+	for _, s := range q.Status {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+var ErrJobNotFound = fmt.Errorf("job not found")
+
+var ErrMaxDeleted = fmt.Errorf("maximum amount deleted")
+var ErrExceededMaxDur = fmt.Errorf("exceeded maximum duration")
+
+// ErrStop and ErrSkip may be returned by the Filter of a JobQuery to end a
+// listing or to omit a job from it.
+var ErrStop = fmt.Errorf("stop")
+var ErrSkip = fmt.Errorf("skip")
+
+// terminalStatuses are the statuses of jobs which have terminated.
+var terminalStatuses = []slicerjob.Status{slicerjob.Complete, slicerjob.Failed, slicerjob.Cancelled}
+
+// applyUpdate modifies job using fn and checks the change in its status.
+func applyUpdate(job *slicerjob.Job, fn func(job *slicerjob.Job) error) error {
+	from := job.Status
+	err := fn(job)
+	if err != nil {
+		return err
+	}
+	if job.Status != from && !from.CanTransition(job.Status) {
+		return &slicerjob.TransitionError{From: from, To: job.Status}
+	}
+	return nil
+}
+
+// completeEvent fills in the time, status, and progress of ev, an event
+// which has happened to job.
+func completeEvent(job *slicerjob.Job, ev *slicerjob.Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev.Status = job.Status
+	ev.Progress = job.Progress
+}
+
+// deletedFileKey returns the key recording the deletion of a job's file of
+// the given kind ("meshes" or "gcodes").
+func deletedFileKey(kind, id string) string {
+	return fmt.Sprintf("%s/%s/%s", time.Now().Format(time.RFC3339), kind, id)
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/gcode"
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+func TestMemStore(t *testing.T) {
+	testJobStore(t, func(t *testing.T) JobStore {
+		return MemoryStore()
+	})
+}
+
+func TestBoltStore(t *testing.T) {
+	testJobStore(t, func(t *testing.T) JobStore {
+		dir, err := ioutil.TempDir("", "snuggied-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := OpenBoltStore(filepath.Join(dir, "snuggied.boltdb"))
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			store.Close()
+			os.RemoveAll(dir)
+		})
+		return store
+	})
+}
+
+// testJobStore runs the tests every JobStore must pass against stores
+// returned by open.  Each test is given an empty store.
+func testJobStore(t *testing.T, open func(t *testing.T) JobStore) {
+	for _, test := range []struct {
+		name string
+		fn   func(t *testing.T, store JobStore)
+	}{
+		{"Jobs", testStoreJobs},
+		{"History", testStoreHistory},
+		{"ListJobs", testStoreListJobs},
+		{"DeleteOldJobs", testStoreDeleteOldJobs},
+		{"Files", testStoreFiles},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, open(t))
+		})
+	}
+}
+
+func testStoreJobs(t *testing.T, store JobStore) {
+	err := store.Ping()
+	if err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	_, err = store.ViewJob("missing")
+	if err != ErrJobNotFound {
+		t.Errorf("missing job: %v", err)
+	}
+
+	job := slicerjob.New()
+	job.Preset = "hq"
+	err = store.InsertJob(job, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.InsertJob(job, nil) == nil {
+		t.Errorf("job inserted twice")
+	}
+
+	// jobs are copied so callers do not modify the store.
+	job.Preset = "modified"
+	stored, err := store.ViewJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Preset != "hq" {
+		t.Errorf("stored job modified: %q", stored.Preset)
+	}
+	stored.Preset = "modified"
+	if stored, _ = store.ViewJob(job.ID); stored.Preset != "hq" {
+		t.Errorf("stored job modified: %q", stored.Preset)
+	}
+
+	// jobs are not modified when the update fails.
+	err = store.UpdateJob(job.ID, nil, func(j *slicerjob.Job) error {
+		j.Preset = "failed"
+		return fmt.Errorf("update failed")
+	})
+	if err == nil {
+		t.Errorf("update error not returned")
+	}
+	err = store.UpdateJob(job.ID, nil, func(j *slicerjob.Job) error {
+		j.Preset = "invalid"
+		j.Status = slicerjob.Complete
+		return nil
+	})
+	if _, ok := err.(*slicerjob.TransitionError); !ok {
+		t.Errorf("accepted job completed: %v", err)
+	}
+	err = store.UpdateJob(job.ID, nil, func(j *slicerjob.Job) error {
+		j.Preset = "fast"
+		return j.SetStatus(slicerjob.Processing, time.Now())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err = store.ViewJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Preset != "fast" || stored.Status != slicerjob.Processing {
+		t.Errorf("updated job: %v %q", stored.Status, stored.Preset)
+	}
+	if err := store.UpdateJob("missing", nil, func(*slicerjob.Job) error { return nil }); err != ErrJobNotFound {
+		t.Errorf("update missing job: %v", err)
+	}
+
+	err = store.DeleteJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.ViewJob(job.ID)
+	if err != ErrJobNotFound {
+		t.Errorf("deleted job: %v", err)
+	}
+}
+
+func testStoreHistory(t *testing.T, store JobStore) {
+	job := slicerjob.New()
+	err := store.InsertJob(job, &slicerjob.Event{Type: slicerjob.EventAccepted, Node: "node0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.UpdateJob(job.ID, &slicerjob.Event{Type: slicerjob.EventStarted}, func(j *slicerjob.Job) error {
+		return j.SetStatus(slicerjob.Processing, time.Now())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// events are only recorded for successful updates.
+	store.UpdateJob(job.ID, &slicerjob.Event{Type: slicerjob.EventCancelled}, func(j *slicerjob.Job) error {
+		return fmt.Errorf("update failed")
+	})
+	ev := &slicerjob.Event{Type: slicerjob.EventProgress}
+	err = store.UpdateJob(job.ID, ev, func(j *slicerjob.Job) error {
+		j.Progress = 0.5
+		ev.Message = "halfway"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := store.ViewHistory(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.JobID != job.ID || len(history.Events) != 3 {
+		t.Fatalf("history: %+v", history)
+	}
+	first, last := history.Events[0], history.Events[2]
+	if first.Type != slicerjob.EventAccepted || first.Status != slicerjob.Accepted || first.Node != "node0" || first.Time.IsZero() {
+		t.Errorf("first event: %+v", first)
+	}
+	if history.Events[1].Status != slicerjob.Processing {
+		t.Errorf("second event: %+v", history.Events[1])
+	}
+	if last.Type != slicerjob.EventProgress || last.Progress != 0.5 || last.Message != "halfway" {
+		t.Errorf("last event: %+v", last)
+	}
+	if last.Time.Before(first.Time) {
+		t.Errorf("events out of order")
+	}
+
+	err = store.DeleteJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err = store.ViewHistory(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Events == nil || len(history.Events) != 0 {
+		t.Errorf("history of deleted job: %+v", history.Events)
+	}
+}
+
+func testStoreListJobs(t *testing.T, store JobStore) {
+	// jobs are created an hour apart with statuses cycling through accepted,
+	// complete, and failed.
+	start := time.Now().Add(-24 * time.Hour)
+	ids := putListJobs(t, store, start)
+
+	// pages follow each other in both orders.
+	list := func(limit int, q *JobQuery) []string {
+		var listed []string
+		var cursor []byte
+		for {
+			jobs, next, err := store.ListJobs(0, limit, cursor, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, job := range jobs {
+				listed = append(listed, job.ID)
+			}
+			if next == nil {
+				return listed
+			}
+			cursor = next
+		}
+	}
+	check := func(name string, listed []string, expect ...int) {
+		t.Helper()
+		if len(listed) != len(expect) {
+			t.Errorf("%s: %d jobs (expected %d)", name, len(listed), len(expect))
+			return
+		}
+		for i, j := range expect {
+			if listed[i] != ids[j] {
+				t.Errorf("%s: job %d is not %d", name, i, j)
+			}
+		}
+	}
+	check("oldest", list(2, nil), 0, 1, 2, 3, 4, 5, 6, 7, 8)
+	check("newest", list(4, &JobQuery{Newest: true}), 8, 7, 6, 5, 4, 3, 2, 1, 0)
+	check("complete", list(2, &JobQuery{Status: []slicerjob.Status{slicerjob.Complete}}), 1, 4, 7)
+	check("complete newest", list(1, &JobQuery{Status: []slicerjob.Status{slicerjob.Complete}, Newest: true}), 7, 4, 1)
+	check("terminated", list(2, &JobQuery{Status: terminalStatuses}), 1, 2, 4, 5, 7, 8)
+	check("created", list(1, &JobQuery{
+		CreatedAfter:  start.Add(2 * time.Hour),
+		CreatedBefore: start.Add(5 * time.Hour),
+	}), 2, 3, 4)
+	check("created newest", list(2, &JobQuery{
+		Status:        []slicerjob.Status{slicerjob.Failed},
+		CreatedAfter:  start.Add(2 * time.Hour),
+		CreatedBefore: start.Add(6 * time.Hour),
+		Newest:        true,
+	}), 5, 2)
+	check("filter", list(2, &JobQuery{
+		Newest: true,
+		Filter: func(job *slicerjob.Job) error {
+			if job.Preset != "hq" {
+				return ErrSkip
+			}
+			return nil
+		},
+	}), 7, 5, 3, 1)
+	check("stop", list(0, &JobQuery{
+		Filter: func(job *slicerjob.Job) error {
+			if job.ID == ids[3] {
+				return ErrStop
+			}
+			return nil
+		},
+	}), 0, 1, 2)
+
+	// status changes move jobs between statuses.
+	err := store.UpdateJob(ids[0], nil, func(job *slicerjob.Job) error {
+		return job.SetStatus(slicerjob.Cancelled, time.Now())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("accepted", list(0, &JobQuery{Status: []slicerjob.Status{slicerjob.Accepted}}), 3, 6)
+	check("cancelled", list(0, &JobQuery{Status: []slicerjob.Status{slicerjob.Cancelled}}), 0)
+
+	// deleted jobs are not listed.
+	err = store.DeleteJob(ids[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("deleted", list(0, &JobQuery{Status: []slicerjob.Status{slicerjob.Accepted}}), 6)
+}
+
+// putListJobs inserts nine jobs created an hour apart, beginning at start,
+// and returns their ids.  Statuses cycle through accepted, complete, and
+// failed, and presets alternate between default and hq.
+func putListJobs(t *testing.T, store JobStore, start time.Time) []string {
+	statuses := []slicerjob.Status{slicerjob.Accepted, slicerjob.Complete, slicerjob.Failed}
+	var ids []string
+	for i := 0; i < 9; i++ {
+		job := slicerjob.New()
+		created := start.Add(time.Duration(i) * time.Hour)
+		job.Created = &created
+		job.Status = statuses[i%3]
+		job.Preset = "default"
+		if i%2 == 1 {
+			job.Preset = "hq"
+		}
+		err := store.InsertJob(job, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	return ids
+}
+
+func testStoreDeleteOldJobs(t *testing.T, store JobStore) {
+	now := time.Now()
+	job := func(status slicerjob.Status, age, ttl time.Duration) string {
+		job := slicerjob.New()
+		job.Status = status
+		job.TTL = ttl.Seconds()
+		if status.IsTerminal() {
+			term := now.Add(-age)
+			job.Terminated = &term
+		}
+		err := store.InsertJob(job, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job.ID
+	}
+	old := job(slicerjob.Complete, 2*time.Hour, 0)
+	oldFailed := job(slicerjob.Failed, 3*time.Hour, 0)
+	recent := job(slicerjob.Complete, time.Minute, 0)
+	waiting := job(slicerjob.Accepted, 0, 0)
+	retainedFailed := job(slicerjob.Failed, 2*time.Hour, 0)
+	shortTTL := job(slicerjob.Complete, 2*time.Minute, time.Minute)
+	longTTL := job(slicerjob.Complete, 3*time.Hour, 4*time.Hour)
+	r := &Retention{Complete: time.Hour, Failed: 150 * time.Minute, Cancelled: time.Hour}
+
+	deleted, err := store.DeleteOldJobs(r, now, time.Minute, 1)
+	if err != ErrMaxDeleted || len(deleted) != 1 {
+		t.Errorf("deleted %d: %v", len(deleted), err)
+	}
+	deleted, err = store.DeleteOldJobs(r, now, time.Minute, 10)
+	if err != nil || len(deleted) != 2 {
+		t.Errorf("deleted %d: %v", len(deleted), err)
+	}
+	for _, id := range []string{old, oldFailed, shortTTL} {
+		if _, err := store.ViewJob(id); err != ErrJobNotFound {
+			t.Errorf("expired job: %v", err)
+		}
+	}
+	for _, id := range []string{recent, waiting, retainedFailed, longTTL} {
+		if _, err := store.ViewJob(id); err != nil {
+			t.Errorf("retained job: %v", err)
+		}
+	}
+
+	// jobs which terminate later are deleted once they expire.
+	err = store.UpdateJob(waiting, nil, func(job *slicerjob.Job) error {
+		return job.SetStatus(slicerjob.Cancelled, now.Add(-time.Hour))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err = store.DeleteOldJobs(r, now, time.Minute, 10)
+	if err != nil || len(deleted) != 1 || deleted[0].ID != waiting {
+		t.Errorf("deleted %d: %v", len(deleted), err)
+	}
+}
+
+func testStoreFiles(t *testing.T, store JobStore) {
+	job := slicerjob.New()
+	err := store.InsertJob(job, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path, err := store.ViewMeshFile(job.ID); err != nil || path != "" {
+		t.Errorf("mesh file before put: %q %v", path, err)
+	}
+	if idx, err := store.ViewLayerIndex(job.ID); err != nil || idx != nil {
+		t.Errorf("layer index before put: %v %v", idx, err)
+	}
+	store.PutMeshFile(job.ID, "/data/mesh.stl")
+	store.PutGCodeFile(job.ID, "/data/mesh.gcode")
+	store.PutLayerIndex(job.ID, &gcode.LayerIndex{Layers: []*gcode.LayerEntry{{Z: 0.2}}})
+	if path, _ := store.ViewMeshFile(job.ID); path != "/data/mesh.stl" {
+		t.Errorf("mesh file: %q", path)
+	}
+	if path, _ := store.ViewGCodeFile(job.ID); path != "/data/mesh.gcode" {
+		t.Errorf("gcode file: %q", path)
+	}
+	if idx, _ := store.ViewLayerIndex(job.ID); idx == nil || len(idx.Layers) != 1 {
+		t.Errorf("layer index: %v", idx)
+	}
+
+	files, err := store.DeletedFiles(0)
+	if err != nil || len(files) != 0 {
+		t.Errorf("deleted files before delete: %v %v", files, err)
+	}
+	err = store.DeleteJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path, _ := store.ViewMeshFile(job.ID); path != "" {
+		t.Errorf("mesh file of deleted job: %q", path)
+	}
+	files, err = store.DeletedFiles(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("deleted files: %d", len(files))
+	}
+	for _, f := range files {
+		if f.Mesh != (f.Path == "/data/mesh.stl") {
+			t.Errorf("deleted file: %+v", f)
+		}
+	}
+	if files, _ := store.DeletedFiles(1); len(files) != 1 {
+		t.Errorf("limited deleted files: %d", len(files))
+	}
+	err = store.FileRemoved(files[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining, _ := store.DeletedFiles(0)
+	if len(remaining) != 1 || remaining[0].Key != files[1].Key {
+		t.Errorf("remaining deleted files: %v", remaining)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// Output target types.
+const (
+	targetOctoPrint = "octoprint"
+	targetMoonraker = "moonraker"
+)
+
+// OutputTarget is printer host software which receives the G-code of
+// completed jobs.
+type OutputTarget struct {
+	Name string
+
+	// Type is the host software, "octoprint" or "moonraker".
+	Type   string
+	URL    string
+	APIKey string
+
+	// Print is the default for jobs which do not specify whether printing
+	// should start when the upload is complete.
+	Print bool
+
+	// Retries is the number of times a failed upload is retried.  The delay
+	// between attempts begins at RetryDelay and doubles after each attempt.
+	Retries    int
+	RetryDelay time.Duration
+
+	Client *http.Client
+}
+
+// ReadTargetsDir reads output target configurations from the INI files in
+// dir.  The name of each target is the name of its file without the ".ini"
+// extension.
+//
+//	type = octoprint
+//	url = http://octopi.local
+//	api_key = 0123456789ABCDEF
+//	print = 0
+//	retries = 3
+//	retry_delay = 5s
+func ReadTargetsDir(dir string) (map[string]*OutputTarget, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]*OutputTarget)
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".ini" {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".ini")
+		config, err := ReadConfigSlic3r(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		target, err := newOutputTarget(name, config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file.Name(), err)
+		}
+		targets[name] = target
+	}
+	return targets, nil
+}
+
+func newOutputTarget(name string, config map[string]string) (*OutputTarget, error) {
+	t := &OutputTarget{
+		Name:       name,
+		Type:       config["type"],
+		URL:        strings.TrimSuffix(config["url"], "/"),
+		APIKey:     config["api_key"],
+		Retries:    3,
+		RetryDelay: 5 * time.Second,
+	}
+	if t.Type != targetOctoPrint && t.Type != targetMoonraker {
+		return nil, fmt.Errorf("type must be %q or %q", targetOctoPrint, targetMoonraker)
+	}
+	if t.URL == "" {
+		return nil, fmt.Errorf("missing url")
+	}
+	var err error
+	if v := config["print"]; v != "" {
+		t.Print, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("print: %v", err)
+		}
+	}
+	if v := config["retries"]; v != "" {
+		t.Retries, err = strconv.Atoi(v)
+		if err != nil || t.Retries < 0 {
+			return nil, fmt.Errorf("retries: invalid value %q", v)
+		}
+	}
+	if v := config["retry_delay"]; v != "" {
+		t.RetryDelay, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("retry_delay: %v", err)
+		}
+	}
+	return t, nil
+}
+
+// uploadError is an unsuccessful HTTP response from an output target.
+type uploadError struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (err *uploadError) Error() string {
+	return fmt.Sprintf("http %s: %q", err.Status, err.Message)
+}
+
+// isRetryable returns true if an upload failing with err may succeed when
+// retried.  Client errors other than timeouts and rate limiting are not
+// retried.
+func isRetryable(err error) bool {
+	if err, ok := err.(*uploadError); ok {
+		switch {
+		case err.StatusCode == http.StatusRequestTimeout:
+		case err.StatusCode == http.StatusTooManyRequests:
+		case err.StatusCode >= 400 && err.StatusCode < 500:
+			return false
+		}
+	}
+	return true
+}
+
+// Upload sends G-code read from r to the target, storing it as filename.  If
+// print is true the target is instructed to begin printing the file.
+func (t *OutputTarget) Upload(filename string, r io.Reader, print bool) error {
+	var endpoint string
+	var fields [][2]string
+	switch t.Type {
+	case targetOctoPrint:
+		endpoint = "/api/files/local"
+		fields = append(fields,
+			[2]string{"select", strconv.FormatBool(print)},
+			[2]string{"print", strconv.FormatBool(print)},
+		)
+	case targetMoonraker:
+		endpoint = "/server/files/upload"
+		fields = append(fields,
+			[2]string{"root", "gcodes"},
+			[2]string{"print", strconv.FormatBool(print)},
+		)
+	default:
+		return fmt.Errorf("unknown target type: %q", t.Type)
+	}
+
+	// stream the form to the target instead of buffering the G-code.
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUploadForm(form, fields, filename, r))
+	}()
+	req, err := http.NewRequest("POST", t.URL+endpoint, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if t.APIKey != "" {
+		req.Header.Set("X-Api-Key", t.APIKey)
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		p, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 200))
+		return &uploadError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Message:    strings.TrimSpace(string(p)),
+		}
+	}
+	return nil
+}
+
+func writeUploadForm(w *multipart.Writer, fields [][2]string, filename string, r io.Reader) error {
+	for _, field := range fields {
+		err := w.WriteField(field[0], field[1])
+		if err != nil {
+			return err
+		}
+	}
+	file, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// deliver uploads the gcode for job id stored under key to its output target,
+// retrying failed uploads.  The progress of the delivery is recorded in the
+// job.
+func (srv *SnuggieServer) deliver(id, key string) {
+	log := logger.With("job", id)
+	job, err := srv.Store.ViewJob(id)
+	if err != nil || job.Delivery == nil {
+		log.Errorf("deliver: %v", err)
+		return
+	}
+	log = log.With("target", job.Delivery.Target)
+	target := srv.Targets[job.Delivery.Target]
+	if target == nil {
+		srv.updateDelivery(id, 0, fmt.Errorf("unknown target: %q", job.Delivery.Target), true)
+		return
+	}
+	filename := gcodeFilename(job)
+	delay := target.RetryDelay
+	for attempt := 1; ; attempt++ {
+		err := uploadArtifact(target, srv.Blobs, key, filename, job.Delivery.Print)
+		final := err == nil || attempt > target.Retries || !isRetryable(err)
+		srv.updateDelivery(id, attempt, err, final)
+		if err == nil {
+			log.Infof("delivered")
+			return
+		}
+		log.Warnf("deliver attempt %d: %v", attempt, err)
+		if final {
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func uploadArtifact(target *OutputTarget, blobs BlobStore, key, filename string, print bool) error {
+	r, err := openArtifact(blobs, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return target.Upload(filename, r, print)
+}
+
+// updateDelivery records the result of a delivery attempt.  If final is
+// false a failed attempt will be retried.
+func (srv *SnuggieServer) updateDelivery(id string, attempts int, err error, final bool) {
+	errup := srv.Store.UpdateJob(id, nil, func(job *slicerjob.Job) error {
+		if job.Delivery == nil {
+			return fmt.Errorf("job has no delivery")
+		}
+		now := time.Now()
+		d := job.Delivery
+		d.Attempts = attempts
+		d.Updated = &now
+		d.Error = ""
+		switch {
+		case err == nil:
+			d.Status = slicerjob.DeliveryComplete
+		case final:
+			d.Status = slicerjob.DeliveryFailed
+			d.Error = err.Error()
+		default:
+			d.Status = slicerjob.DeliveryRetrying
+			d.Error = err.Error()
+		}
+		return nil
+	})
+	if errup != nil {
+		logger.With("job", id).Errorf("deliver: %v", errup)
+	}
+}
+
+// gcodeFilename returns the name given to a job's gcode on output targets,
+// which is derived from the original mesh file name when it is known.
+func gcodeFilename(job *slicerjob.Job) string {
+	name := strings.TrimSuffix(job.MeshName, filepath.Ext(job.MeshName))
+	if name == "" {
+		name = job.ID
+	}
+	return name + ".gcode"
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// fakeHost emulates the upload endpoints of OctoPrint and Moonraker.  The
+// first Failures requests are rejected as unavailable.
+type fakeHost struct {
+	Failures int
+
+	mu       sync.Mutex
+	requests int
+	uploads  []*fakeUpload
+}
+
+type fakeUpload struct {
+	Path     string
+	APIKey   string
+	Fields   map[string]string
+	Filename string
+	Content  string
+}
+
+func (h *fakeHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests++
+	if h.requests <= h.Failures {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path != "/api/files/local" && r.URL.Path != "/server/files/upload" {
+		http.NotFound(w, r)
+		return
+	}
+	f, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, _ := ioutil.ReadAll(f)
+	up := &fakeUpload{
+		Path:     r.URL.Path,
+		APIKey:   r.Header.Get("X-Api-Key"),
+		Fields:   make(map[string]string),
+		Filename: header.Filename,
+		Content:  string(p),
+	}
+	for k, v := range r.MultipartForm.Value {
+		up.Fields[k] = v[0]
+	}
+	h.uploads = append(h.uploads, up)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func TestOutputTargetUpload(t *testing.T) {
+	host := new(fakeHost)
+	server := httptest.NewServer(host)
+	defer server.Close()
+
+	for _, test := range []struct {
+		typ    string
+		path   string
+		fields map[string]string
+	}{
+		{targetOctoPrint, "/api/files/local", map[string]string{"select": "true", "print": "true"}},
+		{targetMoonraker, "/server/files/upload", map[string]string{"root": "gcodes", "print": "true"}},
+	} {
+		target, err := newOutputTarget("test", map[string]string{
+			"type":    test.typ,
+			"url":     server.URL + "/",
+			"api_key": "secret",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = target.Upload("cube.gcode", strings.NewReader("G28\n"), true)
+		if err != nil {
+			t.Fatalf("%s: %v", test.typ, err)
+		}
+		up := host.uploads[len(host.uploads)-1]
+		if up.Path != test.path || up.APIKey != "secret" || up.Filename != "cube.gcode" || up.Content != "G28\n" {
+			t.Errorf("%s: upload %#v", test.typ, up)
+		}
+		for k, v := range test.fields {
+			if up.Fields[k] != v {
+				t.Errorf("%s: field %s=%q (!= %q)", test.typ, k, up.Fields[k], v)
+			}
+		}
+	}
+
+	_, err := newOutputTarget("test", map[string]string{"type": "repetier", "url": server.URL})
+	if err == nil {
+		t.Errorf("unknown target type accepted")
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	host := &fakeHost{Failures: 1}
+	server := httptest.NewServer(host)
+	defer server.Close()
+	srv := &SnuggieServer{
+		Store: MemoryStore(),
+		Blobs: LocalBlobs(dir),
+		Targets: map[string]*OutputTarget{
+			"octopi": {
+				Name:       "octopi",
+				Type:       targetOctoPrint,
+				URL:        server.URL,
+				Retries:    2,
+				RetryDelay: time.Millisecond,
+			},
+		},
+	}
+
+	job := slicerjob.New()
+	job.MeshName = "cube.stl"
+	job.Delivery = &slicerjob.Delivery{Target: "octopi", Status: slicerjob.DeliveryPending}
+	err = srv.Store.InsertJob(job, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := job.ID + ".gcode" + gzipExt
+	err = putArtifact(srv.Blobs, key, strings.NewReader("G28\nM84\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.deliver(job.ID, key)
+
+	job, err = srv.Store.ViewJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Delivery.Status != slicerjob.DeliveryComplete || job.Delivery.Attempts != 2 {
+		t.Errorf("delivery: %#v", job.Delivery)
+	}
+	if len(host.uploads) != 1 {
+		t.Fatalf("%d uploads", len(host.uploads))
+	}
+	if up := host.uploads[0]; up.Filename != "cube.gcode" || up.Content != "G28\nM84\n" || up.Fields["print"] != "false" {
+		t.Errorf("upload: %#v", up)
+	}
+}
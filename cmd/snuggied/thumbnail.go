@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bmatsuo/matching-snuggies/gcode"
+	"github.com/bmatsuo/matching-snuggies/mesh"
+)
+
+// Thumbnail sizes in pixels.  Sizes embedded in G-code may be any
+// dimensions between minThumbnailSize and maxThumbnailSize.
+const (
+	defaultThumbnailSize = 256
+	minThumbnailSize     = 16
+	maxThumbnailSize     = 1024
+)
+
+// thumbnailSizes are the sizes of the square thumbnails which can be
+// requested from the server.  Each is cached so the set is kept small.
+var thumbnailSizes = []int{64, 128, 256, 512, 1024}
+
+func isThumbnailSize(size int) bool {
+	for _, s := range thumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// maxPendingThumbnails is the number of thumbnails which may be waiting to be
+// rendered before further requests are refused.
+const maxPendingThumbnails = 32
+
+// errThumbnailsBusy is returned when too many thumbnails are waiting to be
+// rendered.
+var errThumbnailsBusy = fmt.Errorf("too many thumbnails being rendered")
+
+// Thumbnailer renders thumbnails of meshes in a BlobStore in the background
+// and caches them as PNG files in a local directory.  Thumbnailer is safe for
+// concurrent use.
+type Thumbnailer struct {
+	Blobs BlobStore
+	Dir   string
+
+	mu      sync.Mutex
+	pending map[string]*ThumbnailJob
+	sem     chan struct{}
+}
+
+// NewThumbnailer returns a Thumbnailer that renders at most n thumbnails at a
+// time of meshes in blobs, caching them in dir.
+func NewThumbnailer(n int, blobs BlobStore, dir string) *Thumbnailer {
+	if n < 1 {
+		n = 1
+	}
+	return &Thumbnailer{
+		Blobs:   blobs,
+		Dir:     dir,
+		pending: make(map[string]*ThumbnailJob),
+		sem:     make(chan struct{}, n),
+	}
+}
+
+// thumbnailPath returns the location in dir of the cached thumbnail for the
+// mesh stored under key.
+func thumbnailPath(dir, key string, size int) string {
+	return fmt.Sprintf("%s.thumb%d.png", meshBase(dir, key), size)
+}
+
+// thumbnailGlob matches all cached thumbnails in dir for the mesh stored
+// under key.
+func thumbnailGlob(dir, key string) string {
+	return meshBase(dir, key) + ".thumb*.png"
+}
+
+// meshBase returns the location in dir named after the mesh stored under key
+// without its file extensions.
+func meshBase(dir, key string) string {
+	base := strings.TrimSuffix(filepath.Base(key), gzipExt)
+	return filepath.Join(dir, strings.TrimSuffix(base, filepath.Ext(base)))
+}
+
+// ThumbnailJob is a thumbnail that is being rendered.  Path and Err must not
+// be accessed until Done is closed.
+type ThumbnailJob struct {
+	Done chan struct{}
+	Path string
+	Err  error
+}
+
+// Render begins rendering a thumbnail of the mesh stored under key unless it
+// is already cached or being rendered.  The size must be one of
+// thumbnailSizes.  If maxPendingThumbnails are already waiting to be rendered
+// errThumbnailsBusy is returned.
+func (t *Thumbnailer) Render(key string, size int) (*ThumbnailJob, error) {
+	if !isThumbnailSize(size) {
+		return nil, fmt.Errorf("invalid thumbnail size %d", size)
+	}
+	path := thumbnailPath(t.Dir, key, size)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if job := t.pending[path]; job != nil {
+		return job, nil
+	}
+	job := &ThumbnailJob{Done: make(chan struct{}), Path: path}
+	if _, err := os.Stat(path); err == nil {
+		close(job.Done)
+		return job, nil
+	}
+	if len(t.pending) >= maxPendingThumbnails {
+		return nil, errThumbnailsBusy
+	}
+	t.pending[path] = job
+	go func() {
+		t.sem <- struct{}{}
+		job.Err = renderThumbnail(t.Blobs, path, key, size)
+		<-t.sem
+		if job.Err != nil {
+			logger.With("mesh", key).Warnf("thumbnail: %v", job.Err)
+		}
+		t.mu.Lock()
+		delete(t.pending, path)
+		t.mu.Unlock()
+		close(job.Done)
+	}()
+	return job, nil
+}
+
+// renderThumbnail renders the mesh stored under key and writes a PNG image
+// to path.
+func renderThumbnail(blobs BlobStore, path, key string, size int) error {
+	r, err := openArtifact(blobs, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	m, err := mesh.Read(r, strings.TrimSuffix(key, gzipExt))
+	if err != nil {
+		return err
+	}
+	img := mesh.Render(m, size, size)
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, img)
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeThumbnails removes the thumbnails cached in dir for the mesh stored
+// under key.
+func removeThumbnails(dir, key string) {
+	paths, _ := filepath.Glob(thumbnailGlob(dir, key))
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil {
+			logger.Warnf("remove thumbnail: %v", err)
+		}
+	}
+}
+
+// parseThumbnailSizes parses a comma separated list of image dimensions, like
+// "16x16,220x124", as used by the "thumbnails" setting of presets and jobs.
+// The value "none" disables thumbnails.
+func parseThumbnailSizes(spec string) ([]image.Point, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+	var sizes []image.Point
+	for _, dim := range strings.Split(spec, ",") {
+		wh := strings.Split(strings.TrimSpace(dim), "x")
+		if len(wh) != 2 {
+			return nil, fmt.Errorf("invalid size %q", dim)
+		}
+		w, errw := strconv.Atoi(wh[0])
+		h, errh := strconv.Atoi(wh[1])
+		if errw != nil || errh != nil {
+			return nil, fmt.Errorf("invalid size %q", dim)
+		}
+		if w < minThumbnailSize || h < minThumbnailSize || w > maxThumbnailSize || h > maxThumbnailSize {
+			return nil, fmt.Errorf("size %q outside [%d, %d]", dim, minThumbnailSize, maxThumbnailSize)
+		}
+		sizes = append(sizes, image.Pt(w, h))
+	}
+	return sizes, nil
+}
+
+// gcodeThumbnails renders the uncompressed mesh at meshPath as PNG images of
+// each size.
+func gcodeThumbnails(meshPath string, sizes []image.Point) ([]*gcode.Thumbnail, error) {
+	f, err := os.Open(meshPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := mesh.Read(f, meshPath)
+	if err != nil {
+		return nil, err
+	}
+	var thumbs []*gcode.Thumbnail
+	for _, size := range sizes {
+		var buf bytes.Buffer
+		err := png.Encode(&buf, mesh.Render(m, size.X, size.Y))
+		if err != nil {
+			return nil, err
+		}
+		thumbs = append(thumbs, &gcode.Thumbnail{
+			Width:  size.X,
+			Height: size.Y,
+			PNG:    buf.Bytes(),
+		})
+	}
+	return thumbs, nil
+}
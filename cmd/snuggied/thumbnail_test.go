@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThumbnailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggied-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blobs := LocalBlobs(dir)
+	f, err := os.Open("../../testdata/FirstCube.stl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putArtifact(blobs, "cube.stl"+gzipExt, f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbs := NewThumbnailer(1, blobs, dir)
+
+	job, err := thumbs.Render("cube.stl"+gzipExt, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-job.Done
+	if job.Err != nil {
+		t.Fatal(job.Err)
+	}
+	if job.Path != thumbnailPath(dir, "cube.stl"+gzipExt, 128) {
+		t.Errorf("path: %s", job.Path)
+	}
+	if _, err := os.Stat(job.Path); err != nil {
+		t.Error(err)
+	}
+
+	// only a fixed set of sizes is rendered.
+	_, err = thumbs.Render("cube.stl"+gzipExt, 100)
+	if err == nil {
+		t.Errorf("thumbnail size 100 rendered")
+	}
+
+	// renders are refused while too many are waiting.
+	thumbs.sem <- struct{}{}
+	var jobs []*ThumbnailJob
+	for i := 0; i < maxPendingThumbnails; i++ {
+		job, err := thumbs.Render(filepath.Join("missing", string(rune('a'+i))+".stl"), 64)
+		if err != nil {
+			t.Fatalf("render %d: %v", i, err)
+		}
+		jobs = append(jobs, job)
+	}
+	_, err = thumbs.Render("cube.stl"+gzipExt, 64)
+	if err != errThumbnailsBusy {
+		t.Errorf("render while busy: %v", err)
+	}
+	// cached thumbnails are still available.
+	_, err = thumbs.Render("cube.stl"+gzipExt, 128)
+	if err != nil {
+		t.Errorf("cached thumbnail: %v", err)
+	}
+	<-thumbs.sem
+	for _, job := range jobs {
+		<-job.Done
+	}
+}
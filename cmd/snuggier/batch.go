@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/bmatsuo/matching-snuggies/slicerclient"
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// batchFile is a mesh file sliced in batch mode and the result of slicing
+// it.
+type batchFile struct {
+	Path   string
+	Output string
+	Job    *slicerjob.Job
+	Status string
+	Err    error
+}
+
+// batch slices many mesh files, with at most Concurrency jobs on the server
+// at a time.  The G-code for each mesh is written to a file with the same
+// name as the mesh and the extension ".gcode", in OutDir if it is not empty
+// or otherwise next to the mesh.
+type batch struct {
+	Client      *slicerclient.Client
+	Backend     string
+	Preset      string
+	OutDir      string
+	Concurrency int
+}
+
+// batchOutput returns the name of the file G-code for the mesh at path is
+// written to.
+func batchOutput(outdir, path string) string {
+	dir := outdir
+	if dir == "" {
+		dir = filepath.Dir(path)
+	}
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return filepath.Join(dir, base+".gcode")
+}
+
+// Files returns the files sliced for the mesh paths.  An error is returned
+// if the G-code for two meshes would be written to the same file.
+func (b *batch) Files(paths []string) ([]*batchFile, error) {
+	files := make([]*batchFile, len(paths))
+	outputs := make(map[string]string, len(paths))
+	for i, path := range paths {
+		output := batchOutput(b.OutDir, path)
+		if other, ok := outputs[output]; ok {
+			return nil, fmt.Errorf("%s and %s would both be written to %s", other, path, output)
+		}
+		outputs[output] = path
+		files[i] = &batchFile{Path: path, Output: output, Status: "pending"}
+	}
+	return files, nil
+}
+
+// Run slices files until they have all terminated or ctx is cancelled.  Jobs
+// which are running when ctx is cancelled are cancelled and files which have
+// not been sent to the server are skipped.
+func (b *batch) Run(ctx context.Context, files []*batchFile) {
+	if b.OutDir != "" {
+		err := os.MkdirAll(b.OutDir, 0755)
+		if err != nil {
+			for _, f := range files {
+				f.Status, f.Err = "error", err
+			}
+			return
+		}
+	}
+	n := b.Concurrency
+	if n < 1 {
+		n = 1
+	}
+	queue := make(chan *batchFile)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				b.slice(ctx, f)
+			}
+		}()
+	}
+	for _, f := range files {
+		if ctx.Err() != nil {
+			f.Status = "skipped"
+			continue
+		}
+		queue <- f
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// slice slices a single file and records the result in f.
+func (b *batch) slice(ctx context.Context, f *batchFile) {
+	if ctx.Err() != nil {
+		f.Status = "skipped"
+		return
+	}
+	prefix := filepath.Base(f.Path) + ": "
+	job, err := sliceFile(ctx, b.Client, b.Backend, b.Preset, f.Path)
+	if err == nil {
+		f.Job = job
+		job, err = watchJob(ctx, b.Client, job, prefix)
+	}
+	if err == nil {
+		f.Job = job
+		err = slicerclient.CheckJob(job)
+	}
+	if err == nil {
+		err = b.download(ctx, job, f.Output)
+	}
+	switch {
+	case err == nil:
+		f.Status = slicerjob.Complete.String()
+	case err == errCancelled || ctx.Err() != nil:
+		f.Status, f.Err = slicerjob.Cancelled.String(), errCancelled
+	default:
+		f.Status, f.Err = "error", err
+		if jerr, ok := err.(*slicerclient.JobError); ok {
+			f.Status = jerr.Status.String()
+		}
+		log.Printf("%s%v", prefix, err)
+	}
+}
+
+// download writes the G-code for job to path.  The G-code is written to a
+// temporary file first so that path is never left incomplete.
+func (b *batch) download(ctx context.Context, job *slicerjob.Job, path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = b.Client.DownloadGCode(ctx, job.ID, tmp)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("gcode: %v", err)
+	}
+	return nil
+}
+
+// writeBatchTable writes the status of each file as a table, followed by a
+// summary line, and returns the number of files which were not sliced.
+func writeBatchTable(w io.Writer, files []*batchFile) int {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSTATUS\tOUTPUT")
+	var failed int
+	for _, f := range files {
+		result := f.Output
+		if f.Err != nil {
+			failed++
+			result = f.Err.Error()
+		} else if f.Status != slicerjob.Complete.String() {
+			failed++
+			result = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Path, f.Status, result)
+	}
+	tw.Flush()
+	if failed > 0 {
+		fmt.Fprintf(w, "%d of %d files failed\n", failed, len(files))
+	} else {
+		fmt.Fprintf(w, "%d of %d files sliced\n", len(files), len(files))
+	}
+	return failed
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmatsuo/matching-snuggies/slicerclient"
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// fakeSlicer completes jobs for meshes immediately with G-code naming the
+// mesh, except that meshes whose names begin with "bad" fail.  Meshes whose
+// names begin with "huge" are rejected and those beginning with "busy" are
+// refused as if the server were unavailable.
+func fakeSlicer() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slicer/jobs", func(w http.ResponseWriter, r *http.Request) {
+		_, header, err := r.FormFile("meshfile")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case strings.HasPrefix(header.Filename, "huge"):
+			http.Error(w, "upload exceeds 1 MB", http.StatusRequestEntityTooLarge)
+			return
+		case strings.HasPrefix(header.Filename, "busy"):
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		job := &slicerjob.Job{ID: header.Filename, Status: slicerjob.Complete}
+		if strings.HasPrefix(header.Filename, "bad") {
+			job.Status = slicerjob.Failed
+			job.Error = "mesh is not manifold"
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	})
+	mux.HandleFunc("/slicer/gcodes/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("; " + strings.TrimPrefix(r.URL.Path, "/slicer/gcodes/") + "\n"))
+	})
+	return mux
+}
+
+func TestBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggier-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var paths []string
+	for _, name := range []string{"cube.stl", "bad.stl", "gear.amf"} {
+		path := filepath.Join(dir, "parts", name)
+		paths = append(paths, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err := ioutil.WriteFile(path, []byte("solid"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := httptest.NewServer(fakeSlicer())
+	defer server.Close()
+
+	b := &batch{
+		Client:      slicerclient.New(server.URL),
+		Backend:     "slic3r",
+		Preset:      "hq",
+		OutDir:      filepath.Join(dir, "gcode"),
+		Concurrency: 2,
+	}
+	_, err = b.Files([]string{"a/cube.stl", "b/cube.amf"})
+	if err == nil {
+		t.Errorf("conflicting outputs accepted")
+	}
+	files, err := b.Files(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Run(context.Background(), files)
+	for i, status := range []string{"complete", "failed", "complete"} {
+		if files[i].Status != status {
+			t.Errorf("%s: %s %v", files[i].Path, files[i].Status, files[i].Err)
+		}
+	}
+	p, err := ioutil.ReadFile(filepath.Join(dir, "gcode", "gear.gcode"))
+	if err != nil || string(p) != "; gear.amf\n" {
+		t.Errorf("gear.gcode: %q %v", p, err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "gcode", "bad.gcode"))
+	if !os.IsNotExist(err) {
+		t.Errorf("gcode written for failed job: %v", err)
+	}
+
+	var buf bytes.Buffer
+	failed := writeBatchTable(&buf, files)
+	if failed != 1 || !strings.Contains(buf.String(), "job failed: mesh is not manifold") ||
+		!strings.HasSuffix(buf.String(), "1 of 3 files failed\n") {
+		t.Errorf("table (%d failed):\n%s", failed, buf.String())
+	}
+
+	// files are skipped once the batch is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	files, _ = b.Files(paths)
+	b.Run(ctx, files)
+	for _, f := range files {
+		if f.Status != "skipped" {
+			t.Errorf("%s: %s", f.Path, f.Status)
+		}
+	}
+}
+
+func TestBatchOutput(t *testing.T) {
+	for _, test := range []struct{ outdir, path, expect string }{
+		{"", "parts/cube.stl", "parts/cube.gcode"},
+		{"", "cube.amf", "cube.gcode"},
+		{"gcode", "parts/cube.v2.stl", "gcode/cube.v2.gcode"},
+	} {
+		if output := batchOutput(test.outdir, test.path); output != filepath.FromSlash(test.expect) {
+			t.Errorf("%q %q: %q", test.outdir, test.path, output)
+		}
+	}
+}
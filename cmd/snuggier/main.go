@@ -7,59 +7,84 @@ models to G-code for 3D printing using a snuggied server.
 Call snuggier with the -h flag to see available command line configuration.
 
 	snuggier -h
+
+Many meshes are sliced together when more than one is given or an output
+directory is specified with -outdir.  Up to -j jobs are on the server at a
+time and the G-code for each mesh is written to a file named after it, in
+the output directory or otherwise next to the mesh.  A table of the status
+of each file is written when all jobs have terminated and snuggier exits
+with a non-zero status if any file was not sliced.
+
+	snuggier -outdir=gcode/ -j=4 parts/*.stl
+
+The print subcommand streams G-code to a printer connected to a serial port.
+Mesh files are sliced by the server first.  Progress and temperatures are
+logged while printing, and an interrupt cancels the print and turns off the
+printer's heaters.
+
+	snuggier print -device=/dev/ttyACM0 -baud=115200 model.stl
+	snuggier print -device=/dev/ttyACM0 model.gcode
+
+The watch subcommand slices mesh files saved to a directory.  The directory
+is scanned periodically and a mesh file is sliced once its size and
+modification time have not changed for the -settle duration.  G-code is
+written to the output directory along with a status file, like
+model.status.json, describing the job and any error.  The status is "queued"
+until one of the -j jobs is free and "slicing" while the job runs.  Mesh
+files whose G-code would be written to the same file, like model.stl and
+model.amf, are not sliced and the status records the error.  Sliced files are
+recorded in a state file in the output directory so they are not sliced again
+when snuggier restarts, unless they have changed.  Files which failed because
+the server could not be reached or was unavailable are not recorded and are
+sliced again by a later scan.
+
+	snuggier watch -in=incoming/ -out=sliced/ -preset=hq
 */
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
 	"time"
 
+	"github.com/bmatsuo/matching-snuggies/mesh"
+	"github.com/bmatsuo/matching-snuggies/slicerclient"
 	"github.com/bmatsuo/matching-snuggies/slicerjob"
 )
 
 func main() {
-	server := flag.String("server", "localhost:8888", "snuggied server address")
+	if len(os.Args) > 1 && os.Args[1] == "print" {
+		printMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		watchMain(os.Args[2:])
+		return
+	}
+
+	server := flag.String("server", "localhost:8888", "snuggied server address or URL")
 	verbose := flag.Bool("v", false, "verbose logging")
 	slicerBackend := flag.String("backend", "slic3r", "backend slicer")
 	slicerPreset := flag.String("preset", "hq", "specify a configuration preset for the backend")
-	presets := flag.Bool("L", false, "get list of available configuration presets for Slic3r")
+	presets := flag.Bool("L", false, "get list of available configuration presets for the backend")
 	gcodeDest := flag.String("o", "", "specify an output gcode filename")
+	outdir := flag.String("outdir", "", "directory gcode for many mesh files is written to")
+	concurrency := flag.Int("j", 4, "maximum number of concurrent jobs when slicing many mesh files")
 	flag.Parse()
 
-	client := &Client{
-		ServerAddr: *server,
-	}
-
-	if *verbose {
-		client.RequestLog = func(r *Response) {
-			if r.Err != nil {
-				log.Printf("HTTP %s %s %v", r.Method, r.URL, r.Err)
-				return
-			}
-			if r.Data != nil {
-				log.Printf("HTTP %s %s %v (%v)\n%v", r.Method, r.URL, r.Dur, r.Response.Status, r.Data)
-				return
-			}
-			log.Printf("HTTP %s %s %v (%v)", r.Method, r.URL, r.Dur, r.Response.Status)
-		}
-	}
+	client := newClient(*server, *verbose)
 
 	if *presets == true {
-		presets, err := client.SlicerPresets()
+		presets, err := client.Presets(context.Background(), *slicerBackend)
 		if err != nil {
-			fmt.Errorf("something bad happened: %v", err)
+			log.Fatalf("presets: %v", err)
 		}
 		for i := range presets {
 			fmt.Println(presets[i])
@@ -76,374 +101,197 @@ func main() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
+	if *outdir != "" || flag.NArg() > 1 {
+		if *gcodeDest != "" {
+			log.Fatalf("-o cannot be used with many mesh files; use -outdir")
+		}
+		b := &batch{
+			Client:      client,
+			Backend:     *slicerBackend,
+			Preset:      *slicerPreset,
+			OutDir:      *outdir,
+			Concurrency: *concurrency,
+		}
+		files, err := b.Files(flag.Args())
+		if err != nil {
+			log.Fatal(err)
+		}
+		ctx, cancel := signalContext(sig)
+		log.Printf("sending %d file(s) to snuggied server at %v", len(files), *server)
+		b.Run(ctx, files)
+		cancel()
+		if writeBatchTable(os.Stdout, files) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// send files to the slicer to be printed and poll the slicer until the job
 	// has completed.
 	log.Printf("sending file(s) to snuggied server at %v", *server)
-	job, err := client.SliceFile(*slicerBackend, *slicerPreset, meshpath)
+	job, err := sliceFile(context.Background(), client, *slicerBackend, *slicerPreset, meshpath)
 	if err != nil {
 		log.Fatalf("sending files: %v", err)
 	}
 
-	// poll the server until the job has completed.  use exponential backoff to
-	// reduce spam for slice slicing jobs.
-	maxTick := time.Second * 5
-	currentTick := 100 * time.Millisecond
-	tick := time.After(currentTick)
-	status := slicerjob.Status(-1)
-	for job.Status.IsWaiting() {
-		if status != job.Status {
-			log.Printf("status=%s", job.Status)
-			status = job.Status
-		}
-		select {
-		case s := <-sig:
-			// stop intercepting signals. if the job cancellation is taking too
-			// long let the future signals terminate the process naturally.
-			signal.Stop(sig)
-			log.Printf("signal: %v", s)
-			err := client.Cancel(job)
-			if err != nil {
-				log.Printf("failed to cancel job: %v", err)
-			}
-			log.Printf("slicing job canceled")
-			return
-		case <-tick:
-			job, err = client.SlicerStatus(job)
-			if err != nil {
-				// TODO:
-				// detect potentially intermittent network failures and
-				// continue polling up to some reasonable time limit.
-				log.Fatalf("waiting: %v", err)
-			}
-
-			currentTick *= 2
-			if currentTick > maxTick {
-				currentTick = maxTick
-			}
-			tick = time.After(currentTick)
-		}
+	job, err = waitJob(client, job, sig)
+	if err == errCancelled {
+		return
 	}
-	if job.GCodeURL != "" {
-		log.Printf("status=%s gcode=%v", job.Status, job.GCodeURL)
-	} else {
-		log.Printf("status=%s")
+	if err != nil {
+		log.Fatalf("waiting: %v", err)
 	}
 
 	// stop intercepting signals because it because much more difficult to stop
 	// gracefully while reading gcode from the server.
 	signal.Stop(sig)
 
-	if job.Status == slicerjob.Failed || job.Status == slicerjob.Cancelled {
-		log.Fatalf("job %v", job.Status)
+	err = slicerclient.CheckJob(job)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// download gcode from the slicer and write to the specified file.
-	r, err := client.GCode(job)
-	if err != nil {
-		log.Fatalf("gcode: %v", err)
-	}
-	defer r.Close()
 	var f *os.File
 	if *gcodeDest == "" {
 		f = os.Stdout
 	} else {
 		f, err = os.Create(*gcodeDest)
 		if err != nil {
-			log.Panic(err)
+			log.Fatal(err)
 		}
-		defer func() {
-			err := f.Close()
-			if err != nil {
-				log.Panic(err)
-			}
-		}()
 		log.Printf("writing output to %q", *gcodeDest)
 	}
-	_, err = io.Copy(f, r)
+	_, err = client.DownloadGCode(context.Background(), job.ID, f)
 	if err != nil {
-		log.Panic(err)
-	}
-}
-
-type Client struct {
-	Client     *http.Client
-	ServerAddr string
-	HTTPS      bool
-	RequestLog func(*Response)
-}
-
-type Response struct {
-	URL      string
-	Method   string
-	Err      error
-	Response *http.Response
-	Dur      time.Duration
-	Data     interface{}
-}
-
-func (c *Client) get(url string) (*http.Response, error, *Response) {
-	start := time.Now()
-	resp, err := c.client().Get(url)
-	return resp, err, &Response{
-		URL:      url,
-		Method:   "GET",
-		Err:      err,
-		Response: resp,
-		Dur:      time.Since(start),
+		log.Fatalf("gcode: %v", err)
 	}
-}
-func (c *Client) del(url string) (*http.Response, error, *Response) {
-	start := time.Now()
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("request: %v", err), &Response{
-			URL:    url,
-			Method: "DELETE",
-			Err:    err,
-			Dur:    time.Since(start),
+	if f != os.Stdout {
+		err = f.Close()
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
-	resp, err := c.client().Do(req)
-	return resp, err, &Response{
-		URL:      url,
-		Method:   "DELETE",
-		Err:      err,
-		Response: resp,
-		Dur:      time.Since(start),
-	}
-}
-func (c *Client) post(url, contentType string, r io.Reader) (*http.Response, error, *Response) {
-	start := time.Now()
-	resp, err := c.client().Post(url, contentType, r)
-	return resp, err, &Response{
-		URL:      url,
-		Method:   "POST",
-		Err:      err,
-		Response: resp,
-		Dur:      time.Since(start),
-	}
 }
 
-func (c *Client) logHTTP(r *Response) {
-	if c.RequestLog != nil {
-		c.RequestLog(r)
-	}
-}
-
-// SliceFiles tells the server to slice the specified paths.
-func (c *Client) SliceFile(backend, preset string, path string) (*slicerjob.Job, error) {
-	// check that a mesh file is given as the first argument and open it
-	// so it may to encode in the form.
-	if !IsMeshFile(path) {
-		log.Fatalf("path is not a mesh file: %v", path)
-	}
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	// write the multipart form out to a temporary file.  the temporary
-	// file is closed and unlinked when the function terminates.
-	tmp, err := ioutil.TempFile("", "matching-snuggies-post-")
-	if err != nil {
-		return nil, fmt.Errorf("tempfile: %v", err)
-	}
-	defer os.Remove(tmp.Name())
-	defer tmp.Close()
-	bodyw := multipart.NewWriter(tmp)
-	err = c.writeJobForm(bodyw, backend, preset, path, f)
-	if err != nil {
-		return nil, fmt.Errorf("tempfile: %v", err)
-	}
-
-	// seek back to the beginning of the form and POST it to the slicer
-	// server.  decode a slicerjob.Job from successful responses.
-	var job *slicerjob.Job
-	_, err = tmp.Seek(0, 0)
-	if err != nil {
-		return nil, fmt.Errorf("tempfile: %v", err)
-	}
-	url := c.url("/slicer/jobs")
-	resp, err, r := c.post(url, bodyw.FormDataContentType(), tmp)
-	defer c.logHTTP(r)
-	if err != nil {
-		return nil, fmt.Errorf("POST /slicer/jobs: %v", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusAccepted {
-		err := httpStatusError(resp)
-		r.Data = err
-		return nil, err
-	}
-	err = json.NewDecoder(resp.Body).Decode(&job)
-	if err != nil {
-		r.Data = err
-		return nil, fmt.Errorf("response: %v", err)
+// newClient returns a client for the server.  If verbose is true every
+// request is logged.
+func newClient(server string, verbose bool) *slicerclient.Client {
+	client := slicerclient.New(server)
+	if verbose {
+		client.RequestLog = func(r *slicerclient.RequestInfo) {
+			switch {
+			case r.Response == nil:
+				log.Printf("HTTP %s %s %v", r.Method, r.URL, r.Err)
+			case r.Err != nil:
+				log.Printf("HTTP %s %s %v (%v)\n%v", r.Method, r.URL, r.Dur, r.Response.Status, r.Err)
+			default:
+				log.Printf("HTTP %s %s %v (%v)", r.Method, r.URL, r.Dur, r.Response.Status)
+			}
+		}
 	}
-	return job, nil
+	return client
 }
 
-func (c *Client) writeJobForm(w *multipart.Writer, backend, preset, filename string, r io.Reader) error {
-	err := w.WriteField("slicer", backend)
-	if err != nil {
-		return err
-	}
-	err = w.WriteField("preset", preset)
-	if err != nil {
-		return err
-	}
-	file, err := w.CreateFormFile("meshfile", filepath.Base(filename))
-	if err != nil {
-		return err
+// sliceFile sends the mesh at path to the server to be sliced.
+func sliceFile(ctx context.Context, client *slicerclient.Client, backend, preset, path string) (*slicerjob.Job, error) {
+	if !mesh.IsMeshFile(path) {
+		return nil, fmt.Errorf("path is not a mesh file: %v", path)
 	}
-	_, err = io.Copy(file, r)
-	if err != nil {
-		return err
+	job, err := client.SliceFile(ctx, backend, preset, path)
+	if serr, ok := err.(*slicerclient.StatusError); ok {
+		switch serr.StatusCode {
+		case http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity, http.StatusInsufficientStorage:
+			return nil, rejectedError(serr, path)
+		}
 	}
-	return w.Close()
+	return job, err
 }
 
-func (c *Client) Cancel(job *slicerjob.Job) error {
-	if job.ID == "" {
-		return fmt.Errorf("job missing id")
-	}
-	url := c.url("/slicer/jobs/" + job.ID)
+var errCancelled = fmt.Errorf("job cancelled")
 
-	resp, err, r := c.del(url)
-	defer c.logHTTP(r)
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		err := httpStatusError(resp)
-		r.Data = err
-		return err
-	}
-	return nil
+// signalContext returns a context which is cancelled when a signal is
+// received on sig.  Signals are no longer intercepted after the first is
+// received, so that further signals terminate the process naturally if
+// stopping takes too long.
+func signalContext(sig chan os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case s := <-sig:
+			signal.Stop(sig)
+			log.Printf("signal: %v", s)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
 }
 
-func (c *Client) SlicerPresets() ([]string, error) {
-	url := c.url("/slicer/presets/slic3r")
-	resp, err, r := c.get(url)
-	defer c.logHTTP(r)
-	if err != nil {
-		return nil, fmt.Errorf("GET /slicer/presets/slic3r: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		err := httpStatusError(resp)
-		r.Data = err
-		return nil, err
-	}
-	preset := new(slicerjob.SlicerPreset)
-	err = json.NewDecoder(resp.Body).Decode(preset)
-	if err != nil {
-		r.Data = err
-		return nil, fmt.Errorf("GET /slicer/presets/slic3r: %v", err)
-	}
-	r.Data = preset
-
-	return preset.Presets, nil
+// waitJob polls the server until job has terminated and returns its final
+// state.  If a signal is received before the job terminates the job is
+// cancelled and errCancelled is returned.
+func waitJob(client *slicerclient.Client, job *slicerjob.Job, sig chan os.Signal) (*slicerjob.Job, error) {
+	ctx, cancel := signalContext(sig)
+	defer cancel()
+	return watchJob(ctx, client, job, "")
 }
 
-// SlicerStatus returns a current copy of the provided job.
-func (c *Client) SlicerStatus(job *slicerjob.Job) (*slicerjob.Job, error) {
-	if job.ID == "" {
-		return nil, fmt.Errorf("job missing id")
-	}
-	var jobcurr *slicerjob.Job
-	url := c.url("/slicer/jobs/" + job.ID)
-	resp, err, r := c.get(url)
-	defer c.logHTTP(r)
-	if err != nil {
-		return nil, fmt.Errorf("GET /slicer/jobs/: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		err := httpStatusError(resp)
-		r.Data = err
-		return nil, err
-	}
-
-	err = json.NewDecoder(resp.Body).Decode(&jobcurr)
-	if err != nil {
-		r.Data = err
-		return nil, fmt.Errorf("response: %v", err)
-	}
-	js, err := json.Marshal(jobcurr)
-	if err != nil {
-		log.Printf("bizarre json marshal error: %v", err)
+// watchJob polls the server until job has terminated and returns its final
+// state, logging each change of status with the given prefix.  If ctx is
+// cancelled before the job terminates the job is cancelled and errCancelled
+// is returned.
+func watchJob(ctx context.Context, client *slicerclient.Client, job *slicerjob.Job, prefix string) (*slicerjob.Job, error) {
+	status := slicerjob.Status(-1)
+	job, err := client.Watch(ctx, job, func(job *slicerjob.Job) {
+		if status != job.Status && job.Status.IsWaiting() {
+			log.Printf("%sstatus=%s", prefix, job.Status)
+			status = job.Status
+		}
+	})
+	if err == context.Canceled {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := client.Cancel(ctx, job.ID)
+		if err != nil {
+			log.Printf("%sfailed to cancel job: %v", prefix, err)
+		}
+		log.Printf("%sslicing job canceled", prefix)
+		return job, errCancelled
 	}
-	r.Data = string(js)
-
-	return jobcurr, nil
-}
-
-// GCode requests the gcode for job.
-func (c *Client) GCode(job *slicerjob.Job) (io.ReadCloser, error) {
-	url := c.url("/slicer/gcodes/" + job.ID)
-	resp, err, r := c.get(url)
-	defer c.logHTTP(r)
 	if err != nil {
-		return nil, fmt.Errorf("GET /slicer/codes/: %v", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		err := httpStatusError(resp)
-		r.Data = err
 		return nil, err
 	}
-	return resp.Body, nil
-}
-
-func (c *Client) client() *http.Client {
-	if c.Client == nil {
-		return http.DefaultClient
-	}
-	return c.Client
-}
-
-func (c *Client) url(pathquery string) string {
-	pathquery = strings.TrimPrefix(pathquery, "/")
-	scheme := "http"
-	if c.HTTPS {
-		scheme = "https"
+	if job.GCodeURL != "" {
+		log.Printf("%sstatus=%s gcode=%v", prefix, job.Status, job.GCodeURL)
+	} else {
+		log.Printf("%sstatus=%s", prefix, job.Status)
 	}
-	return scheme + "://" + c.ServerAddr + "/" + pathquery
-}
-
-var meshExts = map[string]bool{
-	".stl": true,
-	".amf": true,
+	return job, nil
 }
 
-func IsMeshFile(path string) bool {
-	return meshExts[filepath.Ext(path)]
+// rejectionError is returned for a job refused by the server, which would be
+// refused again if the same mesh were sent.
+type rejectionError struct {
+	msg string
 }
 
-func httpStatusError(resp *http.Response) error {
-	p, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 85))
-	msg := trimMessage(string(p), 80)
-	return fmt.Errorf("http %s: %q", resp.Status, msg)
+func (err *rejectionError) Error() string {
+	return err.msg
 }
 
-func trimMessage(s string, n int) string {
-	s = strings.TrimSpace(s)
-	if len(s) < n {
-		return s
-	}
-	var rs []rune
-	var m int
-	for _, c := range s {
-		if m >= n {
-			break
+// rejectedError describes a job refused by the server because the mesh at
+// path exceeds its upload limits or the server lacks space to store it.
+func rejectedError(serr *slicerclient.StatusError, path string) error {
+	msg := serr.Message
+	switch serr.StatusCode {
+	case http.StatusRequestEntityTooLarge:
+		if info, err := os.Stat(path); err == nil {
+			msg += fmt.Sprintf(" (the file is %.1f MB)", float64(info.Size())/(1<<20))
 		}
-		rs = append(rs, c)
-		m++
+	case http.StatusInsufficientStorage:
+		msg += " (try again after old jobs are removed)"
 	}
-	return string(rs) + "..."
+	msg = fmt.Sprintf("%s rejected by server: %s: %s", filepath.Base(path), serr.Status, msg)
+	return &rejectionError{msg}
 }
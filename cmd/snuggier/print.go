@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/mesh"
+	"github.com/bmatsuo/matching-snuggies/printer"
+	"github.com/bmatsuo/matching-snuggies/slicerclient"
+)
+
+// cooldownGCode is sent to the printer after a print is interrupted so that
+// heaters and motors are not left on.
+var cooldownGCode = []string{
+	"M104 S0",
+	"M140 S0",
+	"M107",
+	"M84",
+}
+
+// printMain implements the "snuggier print" subcommand, which streams G-code
+// to a printer connected over a serial port.  Mesh files are sliced by the
+// snuggied server before they are printed.
+//
+//	snuggier print -device=/dev/ttyACM0 model.stl
+//	snuggier print -device=/dev/ttyUSB0 -baud=250000 model.gcode
+func printMain(args []string) {
+	fs := flag.NewFlagSet("print", flag.ExitOnError)
+	server := fs.String("server", "localhost:8888", "snuggied server address")
+	verbose := fs.Bool("v", false, "verbose logging, including printer communication")
+	slicerBackend := fs.String("backend", "slic3r", "backend slicer")
+	slicerPreset := fs.String("preset", "hq", "specify a configuration preset for the backend")
+	device := fs.String("device", "/dev/ttyACM0", "serial device the printer is connected to")
+	baud := fs.Int("baud", 115200, "serial baud rate")
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		log.Fatalf("missing argument: mesh or gcode file")
+	}
+	path := fs.Arg(0)
+
+	// start intercepting signals from the operating system
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	if mesh.IsMeshFile(path) {
+		log.Printf("sending file(s) to snuggied server at %v", *server)
+		client := newClient(*server, *verbose)
+		gcodePath, err := sliceToTemp(client, *slicerBackend, *slicerPreset, path, sig)
+		if err == errCancelled {
+			return
+		}
+		if err != nil {
+			log.Fatalf("slicing: %v", err)
+		}
+		defer os.Remove(gcodePath)
+		path = gcodePath
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	port, err := printer.OpenSerial(*device, *baud)
+	if err != nil {
+		log.Fatalf("opening printer: %v", err)
+	}
+	defer port.Close()
+
+	p := printer.New(port)
+	if *verbose {
+		p.Log = func(line string) { log.Printf("printer: %s", line) }
+	}
+	var lastStatus time.Time
+	p.StatusFunc = func(s *printer.Status) {
+		if time.Since(lastStatus) < 2*time.Second {
+			return
+		}
+		lastStatus = time.Now()
+		log.Printf("progress=%.1f%% line=%d resends=%d%s", 100*s.Progress(), s.Line, s.Resends, formatTemps(s.Temps))
+	}
+
+	log.Printf("waiting for printer on %s", *device)
+	err = p.WaitReady(3 * time.Second)
+	if err != nil {
+		log.Fatalf("printer: %v", err)
+	}
+
+	go func() {
+		s, ok := <-sig
+		if !ok {
+			return
+		}
+		// stop intercepting signals.  if the printer stops responding let
+		// further signals terminate the process.
+		signal.Stop(sig)
+		log.Printf("signal: %v", s)
+		p.Cancel()
+	}()
+
+	log.Printf("printing %s (%d bytes)", path, info.Size())
+	err = p.Print(f, info.Size())
+	if err == printer.ErrCancelled {
+		log.Printf("print cancelled; cooling down")
+		for _, cmd := range cooldownGCode {
+			err := p.Send(cmd)
+			if err != nil {
+				log.Fatalf("printer: %v", err)
+			}
+		}
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("printer: %v", err)
+	}
+	signal.Stop(sig)
+	close(sig)
+	log.Printf("print complete")
+}
+
+// sliceToTemp slices the mesh at path and downloads the resulting G-code to a
+// temporary file so that its size is known before printing begins.
+func sliceToTemp(client *slicerclient.Client, backend, preset, path string, sig chan os.Signal) (string, error) {
+	job, err := sliceFile(context.Background(), client, backend, preset, path)
+	if err != nil {
+		return "", err
+	}
+	job, err = waitJob(client, job, sig)
+	if err != nil {
+		return "", err
+	}
+	err = slicerclient.CheckJob(job)
+	if err != nil {
+		return "", err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	f, err := ioutil.TempFile("", "snuggier-"+base+"-")
+	if err != nil {
+		return "", err
+	}
+	_, err = client.DownloadGCode(context.Background(), job.ID, f)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func formatTemps(temps map[string]printer.Temp) string {
+	var names []string
+	for name := range temps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var s string
+	for _, name := range names {
+		t := temps[name]
+		s += fmt.Sprintf(" %s=%.1f/%.1f", name, t.Current, t.Target)
+	}
+	return s
+}
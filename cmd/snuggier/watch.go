@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/mesh"
+	"github.com/bmatsuo/matching-snuggies/slicerclient"
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// watchStateFile is the default name of the file in the output directory
+// recording the mesh files which have been sliced.
+const watchStateFile = ".snuggier-watch.json"
+
+// watchMain implements the "snuggier watch" subcommand, which slices mesh
+// files as they are saved to a directory.
+//
+//	snuggier watch -in=incoming/ -out=sliced/ -preset=hq
+func watchMain(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	server := fs.String("server", "localhost:8888", "snuggied server address or URL")
+	verbose := fs.Bool("v", false, "verbose logging")
+	slicerBackend := fs.String("backend", "slic3r", "backend slicer")
+	slicerPreset := fs.String("preset", "hq", "specify a configuration preset for the backend")
+	in := fs.String("in", "", "directory watched for mesh files")
+	out := fs.String("out", "", "directory gcode and status files are written to")
+	statePath := fs.String("state", "", "file recording sliced mesh files (default OUT/"+watchStateFile+")")
+	interval := fs.Duration("interval", 2*time.Second, "time between scans of the watched directory")
+	settle := fs.Duration("settle", 5*time.Second, "time a mesh file must be unchanged before it is sliced")
+	concurrency := fs.Int("j", 2, "maximum number of concurrent jobs")
+	fs.Parse(args)
+
+	if *in == "" || *out == "" {
+		log.Fatalf("watch: -in and -out are required")
+	}
+	if *statePath == "" {
+		*statePath = filepath.Join(*out, watchStateFile)
+	}
+	err := os.MkdirAll(*out, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w, err := newWatcher(&batch{
+		Client:      newClient(*server, *verbose),
+		Backend:     *slicerBackend,
+		Preset:      *slicerPreset,
+		OutDir:      *out,
+		Concurrency: *concurrency,
+	}, *in, *statePath, *settle)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := signalContext(sig)
+	defer cancel()
+	log.Printf("watching %s for mesh files; writing gcode to %s", *in, *out)
+	w.Run(ctx, *interval)
+}
+
+// watchEntry records the version of a mesh file which was sliced.
+type watchEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified_time"`
+	Status  string    `json:"status"`
+	JobID   string    `json:"job_id,omitempty"`
+}
+
+// watchStatus is written to a file next to the G-code for a mesh to
+// describe the result of slicing it.
+type watchStatus struct {
+	Mesh    string    `json:"mesh"`
+	Status  string    `json:"status"`
+	JobID   string    `json:"job_id,omitempty"`
+	GCode   string    `json:"gcode,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated_time"`
+}
+
+// watchItem is a version of a mesh file being sliced.
+type watchItem struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	File    *batchFile
+}
+
+// pendingFile is a mesh file waiting for writes to it to settle.
+type pendingFile struct {
+	size  int64
+	mod   time.Time
+	since time.Time
+}
+
+// watcher slices mesh files saved to a directory once their size and
+// modification time have not changed for the settle duration.  The G-code
+// for each mesh is written to the output directory of its batch along with a
+// status file.  Each version of a mesh file is only sliced once, which is
+// recorded in a state file so it is not sliced again after a restart.  Mesh
+// files which change are sliced again.
+type watcher struct {
+	batch     *batch
+	dir       string
+	statePath string
+	settle    time.Duration
+
+	state   map[string]*watchEntry
+	pending map[string]*pendingFile
+	active  map[string]bool
+}
+
+func newWatcher(b *batch, dir, statePath string, settle time.Duration) (*watcher, error) {
+	w := &watcher{
+		batch:     b,
+		dir:       dir,
+		statePath: statePath,
+		settle:    settle,
+		state:     make(map[string]*watchEntry),
+		pending:   make(map[string]*pendingFile),
+		active:    make(map[string]bool),
+	}
+	p, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(p, &w.state)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", statePath, err)
+	}
+	return w, nil
+}
+
+// Run slices mesh files in the watched directory, which is scanned for
+// changes each interval, until ctx is cancelled.  Running jobs are cancelled
+// and Run returns once they have terminated.  Cancelled jobs are not recorded
+// as sliced.
+func (w *watcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	results := make(chan *watchItem)
+	sem := make(chan struct{}, w.concurrency())
+	submit := func(now time.Time) {
+		for _, item := range w.scan(now) {
+			w.start(item)
+			go func(item *watchItem) {
+				sem <- struct{}{}
+				w.slice(ctx, item)
+				<-sem
+				results <- item
+			}(item)
+		}
+	}
+	submit(time.Now())
+	done := ctx.Done()
+	for {
+		select {
+		case <-done:
+			done = nil
+			if len(w.active) > 0 {
+				log.Printf("waiting for %d job(s) to stop", len(w.active))
+			}
+		case item := <-results:
+			w.finish(item, ctx.Err() != nil)
+		case now := <-ticker.C:
+			if done != nil {
+				submit(now)
+			}
+		}
+		if done == nil && len(w.active) == 0 {
+			return
+		}
+	}
+}
+
+func (w *watcher) concurrency() int {
+	if w.batch.Concurrency < 1 {
+		return 1
+	}
+	return w.batch.Concurrency
+}
+
+// scan returns the mesh files in the watched directory which should be
+// sliced at time now.  Files which have already been sliced, are being
+// sliced, or have changed within the settle duration are not returned.
+// Files whose G-code would be written to the same file as another mesh in
+// the directory are not sliced and an error status is written for them.
+func (w *watcher) scan(now time.Time) []*watchItem {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		log.Printf("watch: %v", err)
+		return nil
+	}
+	present := make(map[string]bool, len(infos))
+	outputs := make(map[string][]string, len(infos))
+	var settled []*watchItem
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || strings.HasPrefix(name, ".") || !mesh.IsMeshFile(name) {
+			continue
+		}
+		present[name] = true
+		path := filepath.Join(w.dir, name)
+		output := batchOutput(w.batch.OutDir, path)
+		outputs[output] = append(outputs[output], name)
+		if w.active[name] {
+			continue
+		}
+		size, mod := info.Size(), info.ModTime()
+		if e := w.state[name]; e != nil && e.Size == size && e.ModTime.Equal(mod) {
+			continue
+		}
+		p := w.pending[name]
+		if p == nil || p.size != size || !p.mod.Equal(mod) {
+			w.pending[name] = &pendingFile{size: size, mod: mod, since: now}
+			continue
+		}
+		if now.Sub(p.since) < w.settle {
+			continue
+		}
+		delete(w.pending, name)
+		settled = append(settled, &watchItem{
+			Name:    name,
+			Size:    size,
+			ModTime: mod,
+			File: &batchFile{
+				Path:   path,
+				Output: output,
+				Status: "pending",
+			},
+		})
+	}
+	var items []*watchItem
+	var changed bool
+	for _, item := range settled {
+		if names := outputs[item.File.Output]; len(names) > 1 {
+			w.conflict(item, names)
+			changed = true
+			continue
+		}
+		items = append(items, item)
+	}
+
+	// forget files which have been removed so they are sliced if they are
+	// added again.
+	for name := range w.pending {
+		if !present[name] {
+			delete(w.pending, name)
+		}
+	}
+	for name := range w.state {
+		if !present[name] {
+			delete(w.state, name)
+			changed = true
+		}
+	}
+	if changed {
+		w.save()
+	}
+	return items
+}
+
+// conflict records that item is not sliced because the G-code for the mesh
+// files names, which include item, would be written to the same file.  The
+// mesh file is not sliced again until it changes.
+func (w *watcher) conflict(item *watchItem, names []string) {
+	var others []string
+	for _, name := range names {
+		if name != item.Name {
+			others = append(others, name)
+		}
+	}
+	f := item.File
+	f.Status = "error"
+	f.Err = fmt.Errorf("%s and %s would both be written to %s",
+		item.Name, strings.Join(others, " and "), filepath.Base(f.Output))
+	w.writeStatus(f)
+	log.Printf("%s: %s: %v", item.Name, f.Status, f.Err)
+	w.state[item.Name] = &watchEntry{Size: item.Size, ModTime: item.ModTime, Status: f.Status}
+}
+
+// start marks item as queued to be sliced.
+func (w *watcher) start(item *watchItem) {
+	log.Printf("%s: queued", item.Name)
+	w.active[item.Name] = true
+	item.File.Status = "queued"
+	w.writeStatus(item.File)
+}
+
+// slice slices item once it is no longer queued behind other jobs.  It may
+// be called concurrently for different items.
+func (w *watcher) slice(ctx context.Context, item *watchItem) {
+	if ctx.Err() == nil {
+		log.Printf("%s: slicing", item.Name)
+		item.File.Status = "slicing"
+		w.writeStatus(item.File)
+	}
+	w.batch.slice(ctx, item.File)
+}
+
+// finish records the result of slicing item.  If stopping is true and the
+// job was cancelled the mesh file is not recorded as sliced.  Nor is it if
+// slicing failed for a reason which may not recur, like the server being
+// unavailable, so that it is sliced again by a later scan.
+func (w *watcher) finish(item *watchItem, stopping bool) {
+	delete(w.active, item.Name)
+	f := item.File
+	w.writeStatus(f)
+	cancelled := f.Status == slicerjob.Cancelled.String() || f.Status == "skipped"
+	if stopping && cancelled {
+		return
+	}
+	if f.Err != nil {
+		// G-code for a previous version of the mesh is removed so it is not
+		// mistaken for the result.
+		os.Remove(f.Output)
+		log.Printf("%s: %s: %v", item.Name, f.Status, f.Err)
+		if !isFinalError(f.Err) {
+			return
+		}
+	} else {
+		log.Printf("%s: %s: %s", item.Name, f.Status, f.Output)
+	}
+	e := &watchEntry{Size: item.Size, ModTime: item.ModTime, Status: f.Status}
+	if f.Job != nil {
+		e.JobID = f.Job.ID
+	}
+	w.state[item.Name] = e
+	w.save()
+}
+
+// isFinalError returns true if err, the result of slicing a mesh file, would
+// be the result of slicing the same file again.  Jobs which terminated
+// without completing and meshes the server refused are final.
+func isFinalError(err error) bool {
+	switch err.(type) {
+	case *slicerclient.JobError, *rejectionError:
+		return true
+	}
+	return false
+}
+
+// watchStatusPath returns the name of the status file written for the
+// G-code file at output.
+func watchStatusPath(output string) string {
+	return strings.TrimSuffix(output, filepath.Ext(output)) + ".status.json"
+}
+
+func (w *watcher) writeStatus(f *batchFile) {
+	s := &watchStatus{
+		Mesh:    filepath.Base(f.Path),
+		Status:  f.Status,
+		Updated: time.Now(),
+	}
+	if f.Job != nil {
+		s.JobID = f.Job.ID
+	}
+	if f.Err != nil {
+		s.Error = f.Err.Error()
+	} else if f.Status == slicerjob.Complete.String() {
+		s.GCode = filepath.Base(f.Output)
+	}
+	err := writeJSONFile(watchStatusPath(f.Output), s)
+	if err != nil {
+		log.Printf("status: %v", err)
+	}
+}
+
+func (w *watcher) save() {
+	err := writeJSONFile(w.statePath, w.state)
+	if err != nil {
+		log.Printf("state: %v", err)
+	}
+}
+
+// writeJSONFile writes v to path as JSON.  The file is replaced atomically
+// so readers never see it partially written.
+func writeJSONFile(path string, v interface{}) error {
+	p, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(p, '\n'))
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
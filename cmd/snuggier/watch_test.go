@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerclient"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snuggier-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "incoming")
+	out := filepath.Join(dir, "sliced")
+	os.Mkdir(in, 0755)
+	os.Mkdir(out, 0755)
+	server := httptest.NewServer(fakeSlicer())
+	defer server.Close()
+	client := slicerclient.New(server.URL)
+	client.Retry = slicerclient.RetryPolicy{MaxAttempts: 1}
+	b := &batch{
+		Client:  client,
+		Backend: "slic3r",
+		Preset:  "hq",
+		OutDir:  out,
+	}
+	statePath := filepath.Join(out, watchStateFile)
+	settle := 5 * time.Second
+	w, err := newWatcher(b, in, statePath, settle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name, content string) {
+		err := ioutil.WriteFile(filepath.Join(in, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	readStatus := func(name string) (status watchStatus) {
+		p, _ := ioutil.ReadFile(filepath.Join(out, name))
+		json.Unmarshal(p, &status)
+		return status
+	}
+	// slice runs the jobs for the files returned by a scan at time now.
+	slice := func(w *watcher, now time.Time) []string {
+		var names []string
+		for _, item := range w.scan(now) {
+			names = append(names, item.Name)
+			w.start(item)
+			if s := readStatus(filepath.Base(watchStatusPath(item.File.Output))); s.Status != "queued" {
+				t.Errorf("%s: status %q before slicing", item.Name, s.Status)
+			}
+			w.slice(context.Background(), item)
+			w.finish(item, false)
+		}
+		return names
+	}
+
+	write("cube.stl", "solid")
+	write("bad.stl", "solid")
+	write("notes.txt", "cube")
+	t0 := time.Now()
+	if names := slice(w, t0); len(names) != 0 {
+		t.Errorf("unsettled files sliced: %v", names)
+	}
+	if names := slice(w, t0.Add(settle/2)); len(names) != 0 {
+		t.Errorf("unsettled files sliced: %v", names)
+	}
+	if names := slice(w, t0.Add(settle)); len(names) != 2 {
+		t.Errorf("settled files: %v", names)
+	}
+
+	p, err := ioutil.ReadFile(filepath.Join(out, "cube.gcode"))
+	if err != nil || string(p) != "; cube.stl\n" {
+		t.Errorf("cube.gcode: %q %v", p, err)
+	}
+	if s := readStatus("cube.status.json"); s.Status != "complete" || s.GCode != "cube.gcode" {
+		t.Errorf("cube status: %+v", s)
+	}
+	if s := readStatus("bad.status.json"); s.Status != "failed" || s.Error != "job failed: mesh is not manifold" {
+		t.Errorf("bad status: %+v", s)
+	}
+
+	// files are not sliced again after a restart unless they change.
+	w, err = newWatcher(b, in, statePath, settle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1 := t0.Add(time.Minute)
+	slice(w, t1)
+	if names := slice(w, t1.Add(settle)); len(names) != 0 {
+		t.Errorf("files sliced after restart: %v", names)
+	}
+	write("cube.stl", "solid cube")
+	t2 := t1.Add(time.Minute)
+	slice(w, t2)
+	if names := slice(w, t2.Add(settle)); len(names) != 1 || names[0] != "cube.stl" {
+		t.Errorf("changed files: %v", names)
+	}
+
+	// meshes the server refuses are only sliced again if it may accept them
+	// later.
+	write("huge.stl", "solid")
+	write("busy.stl", "solid")
+	t3 := t2.Add(time.Minute)
+	slice(w, t3)
+	if names := slice(w, t3.Add(settle)); len(names) != 2 {
+		t.Errorf("refused files: %v", names)
+	}
+	if w.state["huge.stl"] == nil || w.state["busy.stl"] != nil {
+		t.Errorf("state after refusals: %v", w.state)
+	}
+	if s := readStatus("busy.status.json"); s.Status != "error" {
+		t.Errorf("busy status: %+v", s)
+	}
+	slice(w, t3.Add(2*settle))
+	if names := slice(w, t3.Add(3*settle)); len(names) != 1 || names[0] != "busy.stl" {
+		t.Errorf("refused files sliced again: %v", names)
+	}
+	os.Remove(filepath.Join(in, "huge.stl"))
+	os.Remove(filepath.Join(in, "busy.stl"))
+
+	// meshes whose G-code would overwrite another mesh's are not sliced.
+	write("cube.amf", "solid")
+	t4 := t3.Add(time.Minute)
+	slice(w, t4)
+	if names := slice(w, t4.Add(settle)); len(names) != 0 {
+		t.Errorf("conflicting files sliced: %v", names)
+	}
+	if s := readStatus("cube.status.json"); s.Status != "error" || s.Error != "cube.amf and cube.stl would both be written to cube.gcode" {
+		t.Errorf("conflict status: %+v", s)
+	}
+	if names := slice(w, t4.Add(2*settle)); len(names) != 0 {
+		t.Errorf("conflicting files sliced again: %v", names)
+	}
+	p, err = ioutil.ReadFile(filepath.Join(out, "cube.gcode"))
+	if err != nil || string(p) != "; cube.stl\n" {
+		t.Errorf("cube.gcode after conflict: %q %v", p, err)
+	}
+	os.Remove(filepath.Join(in, "cube.amf"))
+
+	// removed files are forgotten.
+	os.Remove(filepath.Join(in, "bad.stl"))
+	slice(w, t4.Add(time.Minute))
+	if len(w.state) != 1 || w.state["bad.stl"] != nil {
+		t.Errorf("state: %v", w.state)
+	}
+}
@@ -0,0 +1,111 @@
+package gcode
+
+import (
+	"io"
+	"math"
+	"time"
+)
+
+// DefaultAcceleration is the acceleration assumed by Analyze when neither
+// the G-code nor the caller specify one.
+const DefaultAcceleration = 1500 // mm/s^2
+
+// layerEpsilon is the smallest change in Z considered to begin a new layer.
+const layerEpsilon = 1e-4
+
+// Options configure the physical properties used to compute Stats.
+type Options struct {
+	// FilamentDiameter is the diameter of the filament in millimeters.
+	FilamentDiameter float64
+
+	// FilamentDensity is the density of the filament in g/cm^3.
+	FilamentDensity float64
+
+	// Acceleration is used for moves until the G-code sets its own
+	// acceleration with M204.  If zero DefaultAcceleration is used.
+	Acceleration float64
+}
+
+// Stats summarizes a G-code program.
+type Stats struct {
+	PrintTime      time.Duration
+	FilamentLength float64 // mm
+	FilamentVolume float64 // cm^3
+	FilamentWeight float64 // g
+	Layers         int
+	MaxZ           float64 // mm, the highest point material is deposited
+}
+
+// Analyze reads a G-code program from r and estimates the resources required
+// to print it.  Print time is estimated with a trapezoidal velocity profile
+// for each move, assuming the tool head comes to rest between moves, which
+// overestimates the time taken by firmware with look-ahead planning.
+func Analyze(r io.Reader, opt *Options) (*Stats, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
+	stats := new(Stats)
+	m := &Machine{Accel: opt.Acceleration}
+	if m.Accel <= 0 {
+		m.Accel = DefaultAcceleration
+	}
+	var seconds float64
+	var layerZ float64
+	s := NewScanner(r)
+	for s.Scan() {
+		l := s.Line()
+		if l.Is("G4") {
+			if v, ok := l.Arg('P'); ok {
+				seconds += v / 1000
+			} else if v, ok := l.Arg('S'); ok {
+				seconds += v
+			}
+			continue
+		}
+		mv, ok := m.Exec(l)
+		if !ok {
+			continue
+		}
+		stats.FilamentLength += mv.E
+		seconds += moveTime(&mv, m.Accel)
+		if mv.IsExtrusion() {
+			if stats.Layers == 0 || math.Abs(mv.To.Z-layerZ) > layerEpsilon {
+				stats.Layers++
+				layerZ = mv.To.Z
+			}
+			if mv.To.Z > stats.MaxZ {
+				stats.MaxZ = mv.To.Z
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	stats.PrintTime = time.Duration(seconds * float64(time.Second))
+	radius := opt.FilamentDiameter / 2
+	stats.FilamentVolume = stats.FilamentLength * math.Pi * radius * radius / 1000
+	stats.FilamentWeight = stats.FilamentVolume * opt.FilamentDensity
+	return stats, nil
+}
+
+// moveTime returns the number of seconds taken by mv.  The tool head
+// accelerates from rest up to the move's feedrate and decelerates back to
+// rest, never reaching the feedrate when the move is too short.
+func moveTime(mv *Move, accel float64) float64 {
+	dist := mv.From.Dist(mv.To)
+	if dist == 0 {
+		// extruder only moves, retraction and priming.
+		dist = math.Abs(mv.E)
+	}
+	v := mv.Feedrate / 60
+	if dist == 0 || v <= 0 {
+		return 0
+	}
+	if accel <= 0 {
+		return dist / v
+	}
+	if dist < v*v/accel {
+		return 2 * math.Sqrt(dist/accel)
+	}
+	return dist/v + v/accel
+}
@@ -0,0 +1,271 @@
+/*
+Package gcode reads the G-code produced by backend slicers.  It understands
+the subset of RepRap/Marlin G-code emitted by Slic3r: linear moves, homing,
+positioning modes and position resets.  Commands it does not understand are
+passed through untouched.
+*/
+package gcode
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Arg is a single parameter of a G-code command, such as X10.5 or S200.
+type Arg struct {
+	Letter byte
+	Value  float64
+}
+
+// Line is a parsed line of G-code.  Blank lines and lines containing only a
+// comment have an empty Code.
+type Line struct {
+	Raw     string
+	Code    string
+	Args    []Arg
+	Comment string
+}
+
+// ParseLine parses a single line of G-code.  Arguments which cannot be parsed
+// as numbers are ignored.
+func ParseLine(s string) *Line {
+	l := &Line{Raw: s}
+	if i := strings.IndexByte(s, ';'); i >= 0 {
+		l.Comment = strings.TrimSpace(s[i+1:])
+		s = s[:i]
+	}
+	fields := strings.Fields(s)
+	if len(fields) > 0 && (fields[0][0] == 'N' || fields[0][0] == 'n') {
+		// line numbers are only meaningful on the wire to a printer.
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return l
+	}
+	l.Code = strings.ToUpper(fields[0])
+	for _, f := range fields[1:] {
+		if len(f) < 2 {
+			continue
+		}
+		if f[0] == '*' {
+			// checksum
+			continue
+		}
+		v, err := strconv.ParseFloat(f[1:], 64)
+		if err != nil {
+			continue
+		}
+		letter := f[0]
+		if 'a' <= letter && letter <= 'z' {
+			letter -= 'a' - 'A'
+		}
+		l.Args = append(l.Args, Arg{letter, v})
+	}
+	return l
+}
+
+// Arg returns the value of the argument with the given letter.
+func (l *Line) Arg(letter byte) (float64, bool) {
+	for _, a := range l.Args {
+		if a.Letter == letter {
+			return a.Value, true
+		}
+	}
+	return 0, false
+}
+
+// Is returns true if l is the command code, e.g. "G1".
+func (l *Line) Is(code string) bool {
+	return l.Code == code
+}
+
+// Scanner reads successive lines of G-code from an io.Reader.
+type Scanner struct {
+	s     *bufio.Scanner
+	line  *Line
+	start int64
+	pos   int64
+}
+
+// NewScanner returns a Scanner that reads from r.
+func NewScanner(r io.Reader) *Scanner {
+	s := &Scanner{s: bufio.NewScanner(r)}
+	s.s.Buffer(nil, 1<<20)
+	s.s.Split(s.split)
+	return s
+}
+
+// split wraps bufio.ScanLines to track the offset of each line.
+func (s *Scanner) split(data []byte, atEOF bool) (int, []byte, error) {
+	adv, tok, err := bufio.ScanLines(data, atEOF)
+	if tok != nil {
+		s.start = s.pos
+	}
+	s.pos += int64(adv)
+	return adv, tok, err
+}
+
+// Offset returns the byte offset of the most recent line read by Scan,
+// relative to the position of the reader when the Scanner was created.
+func (s *Scanner) Offset() int64 {
+	return s.start
+}
+
+// Scan advances to the next line.  Scan returns false at the end of input or
+// on error.
+func (s *Scanner) Scan() bool {
+	if !s.s.Scan() {
+		s.line = nil
+		return false
+	}
+	s.line = ParseLine(strings.TrimRight(s.s.Text(), "\r"))
+	return true
+}
+
+// Line returns the most recent line read by Scan.
+func (s *Scanner) Line() *Line {
+	return s.line
+}
+
+// Err returns the first non-EOF error encountered.
+func (s *Scanner) Err() error {
+	return s.s.Err()
+}
+
+// Point is a position of the tool head in millimeters.
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// Dist returns the euclidean distance between p and q.
+func (p Point) Dist(q Point) float64 {
+	dx, dy, dz := q.X-p.X, q.Y-p.Y, q.Z-p.Z
+	return math.Sqrt(dx*dx + dy*dy + dz*dz)
+}
+
+// Move is a linear movement of the tool head.
+type Move struct {
+	From     Point
+	To       Point
+	E        float64 // filament fed in millimeters, negative for retraction
+	Feedrate float64 // mm/min
+}
+
+// IsExtrusion returns true if the move deposits material.
+func (m *Move) IsExtrusion() bool {
+	return m.E > 0 && (m.From.X != m.To.X || m.From.Y != m.To.Y)
+}
+
+// Machine tracks the state of a printer as it executes G-code.  The zero
+// value is a machine at the origin using absolute positioning.
+type Machine struct {
+	Pos      Point   `json:"pos"`
+	E        float64 `json:"e"`
+	Feedrate float64 `json:"feedrate"` // mm/min
+	RelXYZ   bool    `json:"rel_xyz,omitempty"`
+	RelE     bool    `json:"rel_e,omitempty"`
+	Inches   bool    `json:"inches,omitempty"`
+	Accel    float64 `json:"accel,omitempty"` // mm/s^2, zero until set by M204
+}
+
+// Exec updates m with the effects of l.  If l moves the tool head or the
+// extruder the movement is returned with a true value.
+func (m *Machine) Exec(l *Line) (Move, bool) {
+	switch l.Code {
+	case "G0", "G1", "G2", "G3":
+		// arcs are approximated by a straight line to their endpoint.
+		return m.move(l)
+	case "G20":
+		m.Inches = true
+	case "G21":
+		m.Inches = false
+	case "G28":
+		all := true
+		for _, c := range []byte("XYZ") {
+			if _, ok := l.Arg(c); ok {
+				all = false
+			}
+		}
+		if _, ok := l.Arg('X'); all || ok {
+			m.Pos.X = 0
+		}
+		if _, ok := l.Arg('Y'); all || ok {
+			m.Pos.Y = 0
+		}
+		if _, ok := l.Arg('Z'); all || ok {
+			m.Pos.Z = 0
+		}
+	case "G90":
+		m.RelXYZ = false
+		m.RelE = false
+	case "G91":
+		m.RelXYZ = true
+		m.RelE = true
+	case "M82":
+		m.RelE = false
+	case "M83":
+		m.RelE = true
+	case "G92":
+		if v, ok := l.Arg('X'); ok {
+			m.Pos.X = m.units(v)
+		}
+		if v, ok := l.Arg('Y'); ok {
+			m.Pos.Y = m.units(v)
+		}
+		if v, ok := l.Arg('Z'); ok {
+			m.Pos.Z = m.units(v)
+		}
+		if v, ok := l.Arg('E'); ok {
+			m.E = m.units(v)
+		}
+	case "M204":
+		if v, ok := l.Arg('S'); ok {
+			m.Accel = v
+		} else if v, ok := l.Arg('P'); ok {
+			m.Accel = v
+		}
+	}
+	return Move{}, false
+}
+
+func (m *Machine) units(v float64) float64 {
+	if m.Inches {
+		return v * 25.4
+	}
+	return v
+}
+
+func (m *Machine) move(l *Line) (Move, bool) {
+	if v, ok := l.Arg('F'); ok {
+		m.Feedrate = m.units(v)
+	}
+	mv := Move{From: m.Pos, To: m.Pos, Feedrate: m.Feedrate}
+	moved := false
+	axis := func(c byte, cur *float64, rel bool) {
+		v, ok := l.Arg(c)
+		if !ok {
+			return
+		}
+		v = m.units(v)
+		if rel {
+			*cur += v
+		} else {
+			*cur = v
+		}
+		moved = true
+	}
+	axis('X', &mv.To.X, m.RelXYZ)
+	axis('Y', &mv.To.Y, m.RelXYZ)
+	axis('Z', &mv.To.Z, m.RelXYZ)
+	e := m.E
+	axis('E', &e, m.RelE)
+	mv.E = e - m.E
+	m.E = e
+	m.Pos = mv.To
+	return mv, moved
+}
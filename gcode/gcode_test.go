@@ -0,0 +1,228 @@
+package gcode
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testProgram = `; generated for testing
+G21 ; millimeters
+G90
+M82
+G28
+G92 E0
+G1 Z0.3 F600
+G1 X10 Y0 E1 F1200
+G1 X10 Y10 E2
+G1 E1.5 F1800 ; retract
+G1 Z0.6 F600
+G1 E2 F1800
+G1 X0 Y10 E3 F1200
+G4 P500
+G1 Z10 F600
+`
+
+func TestParseLine(t *testing.T) {
+	l := ParseLine("N12 g1 x1.5 Y-2 e.25 *91 ; perimeter")
+	if l.Code != "G1" {
+		t.Errorf("code: %q", l.Code)
+	}
+	if l.Comment != "perimeter" {
+		t.Errorf("comment: %q", l.Comment)
+	}
+	for _, test := range []struct {
+		c byte
+		v float64
+	}{
+		{'X', 1.5},
+		{'Y', -2},
+		{'E', 0.25},
+	} {
+		v, ok := l.Arg(test.c)
+		if !ok || v != test.v {
+			t.Errorf("%c: %v (%v)", test.c, v, ok)
+		}
+	}
+	if _, ok := l.Arg('N'); ok {
+		t.Errorf("line number parsed as an argument")
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	stats, err := Analyze(strings.NewReader(testProgram), &Options{
+		FilamentDiameter: 1.75,
+		FilamentDensity:  1.25,
+		Acceleration:     1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Layers != 2 {
+		t.Errorf("layers: %d", stats.Layers)
+	}
+	if stats.MaxZ != 0.6 {
+		t.Errorf("max z: %v", stats.MaxZ)
+	}
+	if stats.FilamentLength != 3 {
+		t.Errorf("filament length: %v", stats.FilamentLength)
+	}
+	vol := 3 * math.Pi * 0.875 * 0.875 / 1000
+	if math.Abs(stats.FilamentVolume-vol) > 1e-9 {
+		t.Errorf("filament volume: %v (!= %v)", stats.FilamentVolume, vol)
+	}
+	if math.Abs(stats.FilamentWeight-vol*1.25) > 1e-9 {
+		t.Errorf("filament weight: %v", stats.FilamentWeight)
+	}
+	// the three 10mm extrusions at 20mm/s take 0.52s each, the dwell 0.5s,
+	// and the z moves and retractions take a bit more.
+	if stats.PrintTime < 2*time.Second || stats.PrintTime > 5*time.Second {
+		t.Errorf("print time: %v", stats.PrintTime)
+	}
+}
+
+func TestMoveTime(t *testing.T) {
+	// long enough to reach the feedrate: 100mm at 10mm/s with 100mm/s^2
+	// acceleration spends 0.1s on each ramp.
+	mv := &Move{To: Point{X: 100}, Feedrate: 600}
+	if dt := moveTime(mv, 100); math.Abs(dt-10.1) > 1e-9 {
+		t.Errorf("long move: %v", dt)
+	}
+	// too short to reach the feedrate
+	mv = &Move{To: Point{X: 1}, Feedrate: 600}
+	if dt := moveTime(mv, 100); math.Abs(dt-0.2) > 1e-9 {
+		t.Errorf("short move: %v", dt)
+	}
+}
+
+func TestPostProcess(t *testing.T) {
+	var procs []Processor
+	for _, spec := range [][2]string{
+		{"start_gcode", `G1 X0 Y0\nG1 X5`},
+		{"pause", "2"},
+		{"temp_ramp", "210:190"},
+		{"end_gcode", "M84"},
+	} {
+		p, err := NewProcessor(spec[0], spec[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		procs = append(procs, p)
+	}
+	var buf bytes.Buffer
+	err := PostProcess(&buf, strings.NewReader(testProgram), procs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, expect := range []string{
+		"G1 Z0.3 F600\nG1 X0 Y0\nG1 X5\nM104 S210 ; temperature ramp layer 1\nG1 X10 Y0 E1 F1200\n",
+		"G1 E2 F1800\nM600 ; filament change before layer 2 (z=0.6)\nM104 S190 ; temperature ramp layer 2\nG1 X0 Y10 E3 F1200\n",
+		"G1 Z10 F600\nM84\n",
+	} {
+		if !strings.Contains(out, expect) {
+			t.Errorf("output missing %q:\n%s", expect, out)
+		}
+	}
+
+	_, err = NewProcessor("pause", "zero")
+	if err == nil {
+		t.Errorf("invalid pause layer accepted")
+	}
+	p, _ := NewProcessor("pause", "3")
+	err = PostProcess(&buf, strings.NewReader(testProgram), []Processor{p})
+	if err == nil {
+		t.Errorf("pause beyond the last layer accepted")
+	}
+
+	// a Z-hop to the height of the next layer does not begin the layer.
+	zhop := strings.Replace(testProgram, "G1 X10 Y10 E2\n", "G1 Z0.6 F600 ; hop\nG1 X10 Y10\nG1 Z0.3 F600\nG1 X10 Y10 E2\n", 1)
+	p, _ = NewProcessor("pause", "2")
+	buf.Reset()
+	err = PostProcess(&buf, strings.NewReader(zhop), []Processor{p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "G1 E2 F1800\nM600 ; filament change before layer 2 (z=0.6)\nG1 X0 Y10 E3 F1200\n"
+	if out := buf.String(); !strings.Contains(out, expect) || strings.Count(out, "M600") != 1 {
+		t.Errorf("pause after z-hop:\n%s", out)
+	}
+}
+
+func TestReadLayer(t *testing.T) {
+	r := strings.NewReader(testProgram)
+	idx, err := IndexLayers(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Layers) != 2 {
+		t.Fatalf("layers: %d", len(idx.Layers))
+	}
+	layer, err := ReadLayer(r, idx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer.Z != 0.6 {
+		t.Errorf("z: %v", layer.Z)
+	}
+	if len(layer.Paths) != 1 {
+		t.Fatalf("paths: %d", len(layer.Paths))
+	}
+	p := layer.Paths[0]
+	if !p.Extrude || len(p.Points) != 2 || p.Points[0] != [2]float64{10, 10} || p.Points[1] != [2]float64{0, 10} {
+		t.Errorf("path: %#v", p)
+	}
+	_, err = ReadLayer(r, idx, 3)
+	if err == nil {
+		t.Errorf("layer out of range")
+	}
+	var buf bytes.Buffer
+	err = layer.WriteSVG(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `points="10,10 0,10"`) {
+		t.Errorf("svg:\n%s", buf.String())
+	}
+
+	// a Z-hop to the height of the next layer does not begin the layer.
+	zhop := strings.Replace(testProgram, "G1 X10 Y10 E2\n", "G1 Z0.6 F600 ; hop\nG1 X5 Y5\nG1 Z0.3 F600\nG1 X10 Y10 E2\n", 1)
+	r = strings.NewReader(zhop)
+	idx, err = IndexLayers(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Layers) != 2 {
+		t.Fatalf("z-hop layers: %d", len(idx.Layers))
+	}
+	layer, err = ReadLayer(r, idx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layer.Paths) != 3 || layer.Paths[1].Extrude || layer.Paths[2].Points[1] != [2]float64{10, 10} {
+		t.Errorf("z-hop layer 1: %+v", layer.Paths)
+	}
+	layer, err = ReadLayer(r, idx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layer.Paths) != 1 || layer.Paths[0].Points[0] != [2]float64{10, 10} || layer.Paths[0].Points[1] != [2]float64{0, 10} {
+		t.Errorf("z-hop layer 2: %+v", layer.Paths)
+	}
+}
+
+func TestEmbedThumbnails(t *testing.T) {
+	thumb := &Thumbnail{Width: 16, Height: 12, PNG: bytes.Repeat([]byte{0xff}, 60)}
+	var buf bytes.Buffer
+	err := PostProcess(&buf, strings.NewReader(testProgram), []Processor{EmbedThumbnails([]*Thumbnail{thumb})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := strings.Repeat("/", 78)
+	expect := ";\n; thumbnail begin 16x12 80\n; " + data + "\n; //\n; thumbnail end\n;\n; generated for testing\n"
+	if !strings.HasPrefix(buf.String(), expect) {
+		t.Errorf("output:\n%s", buf.String())
+	}
+}
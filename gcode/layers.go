@@ -0,0 +1,170 @@
+package gcode
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// LayerIndex locates the layers of a G-code program so that individual
+// layers can be read without parsing the entire program.
+type LayerIndex struct {
+	Layers []*LayerEntry `json:"layers"`
+}
+
+// LayerEntry locates a single layer in a program.
+type LayerEntry struct {
+	Z float64 `json:"z"`
+
+	// Offset is the byte offset of the move which begins the layer and State
+	// is the state of the machine immediately before the move.
+	Offset int64   `json:"offset"`
+	State  Machine `json:"state"`
+}
+
+// IndexLayers reads the program in r and returns an index of its layers.  A
+// layer begins with the first extruding move at a height at which material
+// is deposited, as in PostProcess, so travel moves and Z-hops to the height
+// of the next layer remain part of the current one.
+func IndexLayers(r io.ReadSeeker) (*LayerIndex, error) {
+	heights, err := LayerHeights(r)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := new(LayerIndex)
+	var m Machine
+	s := NewScanner(r)
+	for s.Scan() && len(idx.Layers) < len(heights) {
+		state := m
+		mv, ok := m.Exec(s.Line())
+		z := heights[len(idx.Layers)]
+		if ok && mv.IsExtrusion() && math.Abs(mv.To.Z-z) <= layerEpsilon {
+			idx.Layers = append(idx.Layers, &LayerEntry{
+				Z:      z,
+				Offset: s.Offset(),
+				State:  state,
+			})
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Layer contains the tool paths of a single layer.
+type Layer struct {
+	Num   int     `json:"layer"`
+	Z     float64 `json:"z"`
+	Paths []*Path `json:"paths"`
+}
+
+// Path is a polyline traced by the tool head while either extruding or
+// travelling.  Points are XY coordinates in millimeters.
+type Path struct {
+	Extrude bool         `json:"extrude"`
+	Points  [][2]float64 `json:"points"`
+}
+
+// ReadLayer reads layer n, numbered from 1, from the indexed program in r.
+func ReadLayer(r io.ReadSeeker, idx *LayerIndex, n int) (*Layer, error) {
+	if n < 1 || n > len(idx.Layers) {
+		return nil, fmt.Errorf("layer %d out of range [1, %d]", n, len(idx.Layers))
+	}
+	entry := idx.Layers[n-1]
+	end := int64(-1)
+	if n < len(idx.Layers) {
+		end = idx.Layers[n].Offset - entry.Offset
+	}
+	_, err := r.Seek(entry.Offset, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	layer := &Layer{Num: n, Z: entry.Z}
+	var path *Path
+	m := entry.State
+	s := NewScanner(r)
+	for s.Scan() {
+		if end >= 0 && s.Offset() >= end {
+			break
+		}
+		mv, ok := m.Exec(s.Line())
+		if !ok || (mv.From.X == mv.To.X && mv.From.Y == mv.To.Y) {
+			continue
+		}
+		extrude := mv.IsExtrusion()
+		from := [2]float64{mv.From.X, mv.From.Y}
+		to := [2]float64{mv.To.X, mv.To.Y}
+		if path == nil || path.Extrude != extrude || path.Points[len(path.Points)-1] != from {
+			path = &Path{Extrude: extrude, Points: [][2]float64{from}}
+			layer.Paths = append(layer.Paths, path)
+		}
+		path.Points = append(path.Points, to)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// WriteSVG renders the layer as an SVG image in millimeter units.
+// Extrusions are drawn as solid lines and travel moves as thin dashed lines.
+func (l *Layer) WriteSVG(w io.Writer) error {
+	minx, miny := math.Inf(1), math.Inf(1)
+	maxx, maxy := math.Inf(-1), math.Inf(-1)
+	for _, p := range l.Paths {
+		for _, pt := range p.Points {
+			minx, maxx = math.Min(minx, pt[0]), math.Max(maxx, pt[0])
+			miny, maxy = math.Min(miny, pt[1]), math.Max(maxy, pt[1])
+		}
+	}
+	if len(l.Paths) == 0 {
+		minx, miny, maxx, maxy = 0, 0, 1, 1
+	}
+	const margin = 2
+	minx, miny = minx-margin, miny-margin
+	width, height := maxx-minx+margin, maxy-miny+margin
+
+	// printer coordinates have y increasing upward, so the image is flipped
+	// vertically.
+	ew := &errWriter{w: w}
+	ew.printf(`<svg xmlns="http://www.w3.org/2000/svg" width="%gmm" height="%gmm" viewBox="%g %g %g %g">`+"\n",
+		width, height, minx, -(miny + height), width, height)
+	ew.printf(`<title>layer %d z=%g</title>`+"\n", l.Num, l.Z)
+	ew.printf(`<g transform="scale(1,-1)" fill="none" stroke-linecap="round" stroke-linejoin="round">` + "\n")
+	for _, p := range l.Paths {
+		if p.Extrude {
+			ew.printf(`<polyline class="extrude" stroke="#d9480f" stroke-width="0.4" points="`)
+		} else {
+			ew.printf(`<polyline class="travel" stroke="#1c7ed6" stroke-width="0.1" stroke-dasharray="0.5,0.5" points="`)
+		}
+		for i, pt := range p.Points {
+			if i > 0 {
+				ew.printf(" ")
+			}
+			ew.printf("%g,%g", pt[0], pt[1])
+		}
+		ew.printf(`"/>` + "\n")
+	}
+	ew.printf("</g>\n</svg>\n")
+	return ew.err
+}
+
+// errWriter retains the first error encountered writing to w.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, v ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, v...)
+}
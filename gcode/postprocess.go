@@ -0,0 +1,249 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Processor is a built-in G-code post-processor.  Processors insert G-code
+// into a program at its start and end, and at the beginning of each layer.
+type Processor interface {
+	// Start is called before the first line of the program is written.  The
+	// height of each layer is given in ascending order.
+	Start(w io.Writer, layers []float64) error
+
+	// Layer is called before the first extruding move of layer n, at height
+	// z.  Layers are numbered from 1.  Travel moves, such as Z-hops, do not
+	// begin a layer.
+	Layer(w io.Writer, n int, z float64) error
+
+	// End is called after the last line of the program is written.
+	End(w io.Writer) error
+}
+
+// processors contains the constructors for built-in processors.
+var processors = map[string]func(arg string) (Processor, error){
+	"pause":       newPause,
+	"temp_ramp":   newTempRamp,
+	"start_gcode": newStartGCode,
+	"end_gcode":   newEndGCode,
+}
+
+// ProcessorNames returns the names of the built-in processors.
+func ProcessorNames() []string {
+	var names []string
+	for name := range processors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewProcessor returns the built-in processor with the given name configured
+// by arg.  The built-in processors are
+//
+//	pause        arg is a layer number.  A filament change (M600) is
+//	             inserted before the layer.
+//	temp_ramp    arg is "start:end", hotend temperatures in celsius.  The
+//	             temperature is set before each layer, changing linearly
+//	             from start on the first layer to end on the last.
+//	start_gcode  arg is G-code inserted before the first layer, after the
+//	             slicer's own start code.
+//	end_gcode    arg is G-code appended to the end of the program.
+func NewProcessor(name, arg string) (Processor, error) {
+	fn := processors[name]
+	if fn == nil {
+		return nil, fmt.Errorf("unknown processor: %q", name)
+	}
+	p, err := fn(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return p, nil
+}
+
+// PostProcess copies the program in r to w, applying each processor in
+// order.  The program is read twice, first to locate its layers.
+func PostProcess(w io.Writer, r io.ReadSeeker, procs []Processor) error {
+	layers, err := LayerHeights(r)
+	if err != nil {
+		return err
+	}
+	_, err = r.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, p := range procs {
+		err := p.Start(bw, layers)
+		if err != nil {
+			return err
+		}
+	}
+	var m Machine
+	var next int
+	s := NewScanner(r)
+	for s.Scan() {
+		l := s.Line()
+		mv, ok := m.Exec(l)
+		if ok && mv.IsExtrusion() && next < len(layers) && math.Abs(mv.To.Z-layers[next]) <= layerEpsilon {
+			next++
+			for _, p := range procs {
+				err := p.Layer(bw, next, layers[next-1])
+				if err != nil {
+					return err
+				}
+			}
+		}
+		_, err := io.WriteString(bw, l.Raw+"\n")
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	for _, p := range procs {
+		err := p.End(bw)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// LayerHeights reads a program from r and returns the distinct heights at
+// which material is deposited, in ascending order.
+func LayerHeights(r io.Reader) ([]float64, error) {
+	var layers []float64
+	var m Machine
+	s := NewScanner(r)
+	for s.Scan() {
+		mv, ok := m.Exec(s.Line())
+		if !ok || !mv.IsExtrusion() {
+			continue
+		}
+		i := sort.SearchFloat64s(layers, mv.To.Z-layerEpsilon)
+		if i < len(layers) && math.Abs(layers[i]-mv.To.Z) <= layerEpsilon {
+			continue
+		}
+		layers = append(layers, 0)
+		copy(layers[i+1:], layers[i:])
+		layers[i] = mv.To.Z
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+type pause struct {
+	layer int
+}
+
+func newPause(arg string) (Processor, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid layer: %q", arg)
+	}
+	return &pause{n}, nil
+}
+
+func (p *pause) Start(w io.Writer, layers []float64) error {
+	if p.layer > len(layers) {
+		return fmt.Errorf("pause: layer %d beyond last layer %d", p.layer, len(layers))
+	}
+	return nil
+}
+
+func (p *pause) Layer(w io.Writer, n int, z float64) error {
+	if n != p.layer {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "M600 ; filament change before layer %d (z=%g)\n", n, z)
+	return err
+}
+
+func (p *pause) End(w io.Writer) error { return nil }
+
+type tempRamp struct {
+	start, end float64
+	numLayers  int
+}
+
+func newTempRamp(arg string) (Processor, error) {
+	temps := strings.Split(arg, ":")
+	if len(temps) != 2 {
+		return nil, fmt.Errorf("expected start:end temperatures: %q", arg)
+	}
+	start, err := strconv.ParseFloat(strings.TrimSpace(temps[0]), 64)
+	if err != nil || start < 0 {
+		return nil, fmt.Errorf("invalid start temperature: %q", temps[0])
+	}
+	end, err := strconv.ParseFloat(strings.TrimSpace(temps[1]), 64)
+	if err != nil || end < 0 {
+		return nil, fmt.Errorf("invalid end temperature: %q", temps[1])
+	}
+	return &tempRamp{start: start, end: end}, nil
+}
+
+func (p *tempRamp) Start(w io.Writer, layers []float64) error {
+	p.numLayers = len(layers)
+	return nil
+}
+
+func (p *tempRamp) Layer(w io.Writer, n int, z float64) error {
+	temp := p.start
+	if p.numLayers > 1 {
+		temp += (p.end - p.start) * float64(n-1) / float64(p.numLayers-1)
+	}
+	_, err := fmt.Fprintf(w, "M104 S%.0f ; temperature ramp layer %d\n", temp, n)
+	return err
+}
+
+func (p *tempRamp) End(w io.Writer) error { return nil }
+
+type injectCode struct {
+	start string
+	end   string
+}
+
+func newStartGCode(arg string) (Processor, error) {
+	return &injectCode{start: normalizeCode(arg)}, nil
+}
+
+func newEndGCode(arg string) (Processor, error) {
+	return &injectCode{end: normalizeCode(arg)}, nil
+}
+
+// normalizeCode ensures that code is terminated by a newline.  Literal "\n"
+// sequences, as found in slic3r configuration files, are treated as newlines.
+func normalizeCode(code string) string {
+	code = strings.Replace(code, `\n`, "\n", -1)
+	code = strings.Replace(code, "\r\n", "\n", -1)
+	if code != "" && !strings.HasSuffix(code, "\n") {
+		code += "\n"
+	}
+	return code
+}
+
+func (p *injectCode) Start(w io.Writer, layers []float64) error { return nil }
+
+func (p *injectCode) Layer(w io.Writer, n int, z float64) error {
+	if n != 1 || p.start == "" {
+		return nil
+	}
+	_, err := io.WriteString(w, p.start)
+	return err
+}
+
+func (p *injectCode) End(w io.Writer) error {
+	_, err := io.WriteString(w, p.end)
+	return err
+}
@@ -0,0 +1,67 @@
+package gcode
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// thumbnailLineLen is the maximum length of base64 data on each comment line
+// of a thumbnail block, as written by PrusaSlicer.
+const thumbnailLineLen = 78
+
+// Thumbnail is a PNG image embedded in a program for display by printers.
+type Thumbnail struct {
+	Width  int
+	Height int
+	PNG    []byte
+}
+
+// WriteThumbnail writes t as a comment block understood by printer firmware
+// with thumbnail support (Prusa, Marlin).
+//
+//	; thumbnail begin 16x16 1234
+//	; iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9hAAAA...
+//	; thumbnail end
+func WriteThumbnail(w io.Writer, t *Thumbnail) error {
+	data := base64.StdEncoding.EncodeToString(t.PNG)
+	_, err := fmt.Fprintf(w, ";\n; thumbnail begin %dx%d %d\n", t.Width, t.Height, len(data))
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := thumbnailLineLen
+		if n > len(data) {
+			n = len(data)
+		}
+		_, err = fmt.Fprintf(w, "; %s\n", data[:n])
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	_, err = io.WriteString(w, "; thumbnail end\n;\n")
+	return err
+}
+
+// EmbedThumbnails returns a Processor that writes thumbnails at the start of
+// a program, where printers look for them.
+func EmbedThumbnails(thumbs []*Thumbnail) Processor {
+	return embedThumbnails(thumbs)
+}
+
+type embedThumbnails []*Thumbnail
+
+func (p embedThumbnails) Start(w io.Writer, layers []float64) error {
+	for _, t := range p {
+		err := WriteThumbnail(w, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p embedThumbnails) Layer(w io.Writer, n int, z float64) error { return nil }
+
+func (p embedThumbnails) End(w io.Writer) error { return nil }
@@ -0,0 +1,338 @@
+/*
+Package mesh reads the 3D mesh formats accepted by snuggied (STL and AMF) and
+renders them as images.
+*/
+package mesh
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Vec3 is a point or direction in three dimensions.
+type Vec3 [3]float64
+
+func (v Vec3) Sub(w Vec3) Vec3 {
+	return Vec3{v[0] - w[0], v[1] - w[1], v[2] - w[2]}
+}
+
+func (v Vec3) Cross(w Vec3) Vec3 {
+	return Vec3{
+		v[1]*w[2] - v[2]*w[1],
+		v[2]*w[0] - v[0]*w[2],
+		v[0]*w[1] - v[1]*w[0],
+	}
+}
+
+func (v Vec3) Dot(w Vec3) float64 {
+	return v[0]*w[0] + v[1]*w[1] + v[2]*w[2]
+}
+
+// Normalize returns v scaled to unit length.  The zero vector is returned
+// unmodified.
+func (v Vec3) Normalize() Vec3 {
+	n := math.Sqrt(v.Dot(v))
+	if n == 0 {
+		return v
+	}
+	return Vec3{v[0] / n, v[1] / n, v[2] / n}
+}
+
+// Triangle is a face of a mesh.
+type Triangle [3]Vec3
+
+// Normal returns the unit normal of t, following the right hand rule.
+func (t *Triangle) Normal() Vec3 {
+	return t[1].Sub(t[0]).Cross(t[2].Sub(t[0])).Normalize()
+}
+
+// Mesh is a triangle mesh with coordinates in millimeters.
+type Mesh struct {
+	Triangles []Triangle
+}
+
+// Bounds returns the corners of the smallest box containing m.
+func (m *Mesh) Bounds() (min, max Vec3) {
+	if len(m.Triangles) == 0 {
+		return min, max
+	}
+	min = m.Triangles[0][0]
+	max = min
+	for _, t := range m.Triangles {
+		for _, v := range t {
+			for i := range v {
+				min[i] = math.Min(min[i], v[i])
+				max[i] = math.Max(max[i], v[i])
+			}
+		}
+	}
+	return min, max
+}
+
+// IsMeshFile returns true if the extension of path is a supported mesh
+// format.
+func IsMeshFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".stl", ".amf":
+		return true
+	}
+	return false
+}
+
+// Read reads a mesh from r.  The format is determined by the extension of
+// name, either ".stl" or ".amf".
+func Read(r io.Reader, name string) (*Mesh, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".stl":
+		return ReadSTL(r)
+	case ".amf":
+		return ReadAMF(r)
+	}
+	return nil, fmt.Errorf("unknown mesh format: %q", name)
+}
+
+// ReadSTL reads a mesh in the binary or ASCII STL format.
+func ReadSTL(r io.Reader) (*Mesh, error) {
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if isBinarySTL(p) {
+		return readBinarySTL(p)
+	}
+	return readASCIISTL(p)
+}
+
+// CountTriangles returns the number of triangles in a mesh of size bytes read
+// from r.  The format is determined by the extension of name.  Binary STL
+// files are counted from their header without reading the triangles.  ASCII
+// STL files are scanned without storing the mesh.
+func CountTriangles(r io.Reader, name string, size int64) (int, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".stl":
+		return countSTL(r, size)
+	case ".amf":
+		m, err := ReadAMF(r)
+		if err != nil {
+			return 0, err
+		}
+		return len(m.Triangles), nil
+	}
+	return 0, fmt.Errorf("unknown mesh format: %q", name)
+}
+
+func countSTL(r io.Reader, size int64) (int, error) {
+	header := make([]byte, 84)
+	n, err := io.ReadFull(r, header)
+	if err == nil {
+		count := binary.LittleEndian.Uint32(header[80:84])
+		if uint64(size) == 84+50*uint64(count) {
+			return int(count), nil
+		}
+	} else if err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+
+	// the file is not a binary STL.  count the facets of an ASCII STL.
+	var count int
+	s := bufio.NewScanner(io.MultiReader(bytes.NewReader(header[:n]), r))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 0 && fields[0] == "endfacet" {
+			count++
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, fmt.Errorf("stl: %v", err)
+	}
+	if count == 0 && !bytes.HasPrefix(bytes.TrimSpace(header[:n]), []byte("solid")) {
+		return 0, fmt.Errorf("stl: not a binary or ASCII STL file")
+	}
+	return count, nil
+}
+
+// isBinarySTL returns true if p has the size of a binary STL file.  Some
+// binary STL files begin with "solid" like the ASCII format so the prefix is
+// not reliable.
+func isBinarySTL(p []byte) bool {
+	if len(p) < 84 {
+		return false
+	}
+	n := binary.LittleEndian.Uint32(p[80:84])
+	return uint64(len(p)) == 84+50*uint64(n)
+}
+
+func readBinarySTL(p []byte) (*Mesh, error) {
+	n := int(binary.LittleEndian.Uint32(p[80:84]))
+	m := &Mesh{Triangles: make([]Triangle, n)}
+	p = p[84:]
+	for i := range m.Triangles {
+		// each record is a normal, three vertices, and an attribute count.
+		rec := p[50*i+12 : 50*i+48]
+		for j := 0; j < 9; j++ {
+			bits := binary.LittleEndian.Uint32(rec[4*j:])
+			m.Triangles[i][j/3][j%3] = float64(math.Float32frombits(bits))
+		}
+	}
+	return m, nil
+}
+
+func readASCIISTL(p []byte) (*Mesh, error) {
+	m := new(Mesh)
+	var t Triangle
+	var nv int
+	s := bufio.NewScanner(bytes.NewReader(p))
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "facet":
+			nv = 0
+		case "vertex":
+			if len(fields) != 4 || nv >= 3 {
+				return nil, fmt.Errorf("stl: line %d: invalid vertex", lineno)
+			}
+			for i := 0; i < 3; i++ {
+				x, err := strconv.ParseFloat(fields[i+1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("stl: line %d: %v", lineno, err)
+				}
+				t[nv][i] = x
+			}
+			nv++
+		case "endfacet":
+			if nv != 3 {
+				return nil, fmt.Errorf("stl: line %d: facet has %d vertices", lineno, nv)
+			}
+			m.Triangles = append(m.Triangles, t)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type amfVertex struct {
+	X float64 `xml:"coordinates>x"`
+	Y float64 `xml:"coordinates>y"`
+	Z float64 `xml:"coordinates>z"`
+}
+
+type amfTriangle struct {
+	V1 int `xml:"v1"`
+	V2 int `xml:"v2"`
+	V3 int `xml:"v3"`
+}
+
+var amfUnits = map[string]float64{
+	"":           1,
+	"millimeter": 1,
+	"meter":      1000,
+	"micron":     0.001,
+	"inch":       25.4,
+	"feet":       304.8,
+}
+
+// ReadAMF reads a mesh in the AMF format, which may be zip compressed.
+func ReadAMF(r io.Reader) (*Mesh, error) {
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(p, []byte("PK")) {
+		p, err = unzipAMF(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p = bytes.TrimPrefix(p, []byte("\xef\xbb\xbf"))
+
+	// vertices and triangles are located anywhere within their object.
+	// some programs (Repetier-Host) incorrectly nest volumes inside the
+	// vertices element.
+	m := new(Mesh)
+	scale := 1.0
+	var vertices []amfVertex
+	dec := xml.NewDecoder(bytes.NewReader(p))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("amf: %v", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "amf":
+			for _, attr := range start.Attr {
+				if attr.Name.Local == "unit" {
+					scale, ok = amfUnits[attr.Value]
+					if !ok {
+						return nil, fmt.Errorf("amf: unknown unit %q", attr.Value)
+					}
+				}
+			}
+		case "object":
+			vertices = nil
+		case "vertex":
+			var v amfVertex
+			err := dec.DecodeElement(&v, &start)
+			if err != nil {
+				return nil, fmt.Errorf("amf: %v", err)
+			}
+			vertices = append(vertices, v)
+		case "triangle":
+			var tri amfTriangle
+			err := dec.DecodeElement(&tri, &start)
+			if err != nil {
+				return nil, fmt.Errorf("amf: %v", err)
+			}
+			var t Triangle
+			for i, vi := range []int{tri.V1, tri.V2, tri.V3} {
+				if vi < 0 || vi >= len(vertices) {
+					return nil, fmt.Errorf("amf: invalid vertex %d", vi)
+				}
+				v := vertices[vi]
+				t[i] = Vec3{v.X * scale, v.Y * scale, v.Z * scale}
+			}
+			m.Triangles = append(m.Triangles, t)
+		}
+	}
+	return m, nil
+}
+
+// unzipAMF returns the contents of the first file in a zip compressed AMF.
+func unzipAMF(p []byte) ([]byte, error) {
+	z, err := zip.NewReader(bytes.NewReader(p), int64(len(p)))
+	if err != nil {
+		return nil, fmt.Errorf("amf: %v", err)
+	}
+	if len(z.File) == 0 {
+		return nil, fmt.Errorf("amf: empty archive")
+	}
+	f, err := z.File[0].Open()
+	if err != nil {
+		return nil, fmt.Errorf("amf: %v", err)
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,91 @@
+package mesh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func readTestMesh(t *testing.T, path string) *Mesh {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := Read(f, path)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return m
+}
+
+func TestRead(t *testing.T) {
+	for _, path := range []string{
+		"../testdata/FirstCube.stl",
+		"../testdata/FirstCube.amf",
+	} {
+		m := readTestMesh(t, path)
+		if len(m.Triangles) != 12 {
+			t.Errorf("%s: %d triangles", path, len(m.Triangles))
+		}
+		min, max := m.Bounds()
+		size := max.Sub(min)
+		if math.Abs(size[0]-20) > 1e-3 || math.Abs(size[1]-20) > 1e-3 || math.Abs(size[2]-10) > 1e-3 {
+			t.Errorf("%s: size %v", path, size)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	m := readTestMesh(t, "../testdata/FirstCube.stl")
+	img := Render(m, 64, 48)
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 48 {
+		t.Fatalf("bounds: %v", img.Bounds())
+	}
+	// the cube fills the center of the image and leaves the corners empty.
+	if c := img.NRGBAAt(32, 24); c.A != 0xff {
+		t.Errorf("center: %v", c)
+	}
+	if c := img.NRGBAAt(0, 0); c.A != 0 {
+		t.Errorf("corner: %v", c)
+	}
+}
+
+func TestCountTriangles(t *testing.T) {
+	for _, path := range []string{
+		"../testdata/FirstCube.stl",
+		"../testdata/FirstCube.amf",
+	} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := CountTriangles(f, path, info.Size())
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+		} else if n != 12 {
+			t.Errorf("%s: %d triangles", path, n)
+		}
+	}
+
+	// binary STL files are counted from the header.
+	p := make([]byte, 84+50*3)
+	binary.LittleEndian.PutUint32(p[80:], 3)
+	n, err := CountTriangles(bytes.NewReader(p), "part.stl", int64(len(p)))
+	if err != nil || n != 3 {
+		t.Errorf("binary stl: %d triangles (%v)", n, err)
+	}
+
+	_, err = CountTriangles(strings.NewReader("garbage"), "part.stl", 7)
+	if err == nil {
+		t.Errorf("invalid stl counted")
+	}
+}
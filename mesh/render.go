@@ -0,0 +1,162 @@
+package mesh
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Color is the base color of rendered meshes.
+var Color = color.NRGBA{0x3b, 0x8e, 0xd6, 0xff}
+
+// the direction of light in image space, where y points down and z toward
+// the viewer.  faces are lit from the upper left.
+var light = Vec3{-0.45, -0.75, 0.5}.Normalize()
+
+// supersample is the number of samples per pixel in each dimension used to
+// smooth the edges of rendered meshes.
+const supersample = 2
+
+// Render draws a shaded isometric view of m on a transparent image with the
+// given dimensions in pixels.  The mesh is scaled to fit and centered in the
+// image.
+func Render(m *Mesh, width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	if len(m.Triangles) == 0 || width <= 0 || height <= 0 {
+		return img
+	}
+	nx, ny := width*supersample, height*supersample
+
+	// project each vertex onto the view plane.  the viewer looks down at
+	// the mesh from the direction (1, 1, 1) with z pointing up.
+	proj := make([]Triangle, len(m.Triangles))
+	minx, miny := math.Inf(1), math.Inf(1)
+	maxx, maxy := math.Inf(-1), math.Inf(-1)
+	for i, t := range m.Triangles {
+		for j, v := range t {
+			p := isometric(v)
+			proj[i][j] = p
+			minx, maxx = math.Min(minx, p[0]), math.Max(maxx, p[0])
+			miny, maxy = math.Min(miny, p[1]), math.Max(maxy, p[1])
+		}
+	}
+	const margin = 0.05
+	scale := math.Min(
+		float64(nx)/math.Max(maxx-minx, 1e-9),
+		float64(ny)/math.Max(maxy-miny, 1e-9),
+	) * (1 - 2*margin)
+	offx := (float64(nx) - (maxx-minx)*scale) / 2
+	offy := (float64(ny) - (maxy-miny)*scale) / 2
+	for i := range proj {
+		for j := range proj[i] {
+			p := &proj[i][j]
+			p[0] = (p[0]-minx)*scale + offx
+			p[1] = (maxy-p[1])*scale + offy // image y points down
+		}
+	}
+
+	depth := make([]float64, nx*ny)
+	for i := range depth {
+		depth[i] = math.Inf(-1)
+	}
+	shade := make([]float64, nx*ny)
+	covered := make([]bool, nx*ny)
+	for i := range proj {
+		normal := proj[i].Normal()
+		if normal == (Vec3{}) {
+			continue
+		}
+		// mesh winding is not reliable so both sides of a face are lit.
+		s := 0.35 + 0.65*math.Abs(normal.Dot(light))
+		rasterize(&proj[i], nx, ny, func(x, y int, z float64) {
+			k := y*nx + x
+			if z > depth[k] {
+				depth[k] = z
+				shade[k] = s
+				covered[k] = true
+			}
+		})
+	}
+
+	// average the samples for each pixel.
+	for py := 0; py < height; py++ {
+		for px := 0; px < width; px++ {
+			var sum float64
+			var count int
+			for sy := 0; sy < supersample; sy++ {
+				for sx := 0; sx < supersample; sx++ {
+					k := (py*supersample+sy)*nx + px*supersample + sx
+					if covered[k] {
+						sum += shade[k]
+						count++
+					}
+				}
+			}
+			if count == 0 {
+				continue
+			}
+			s := sum / float64(count)
+			img.SetNRGBA(px, py, color.NRGBA{
+				R: uint8(float64(Color.R) * s),
+				G: uint8(float64(Color.G) * s),
+				B: uint8(float64(Color.B) * s),
+				A: uint8(int(Color.A) * count / (supersample * supersample)),
+			})
+		}
+	}
+	return img
+}
+
+// isometric returns the view coordinates of v.  The x and y components are
+// the horizontal and vertical (up) view plane coordinates and z increases
+// toward the viewer.
+func isometric(v Vec3) Vec3 {
+	const cos30, sin30 = 0.8660254037844386, 0.5
+	return Vec3{
+		(v[0] - v[1]) * cos30,
+		v[2] - (v[0]+v[1])*sin30,
+		v[0] + v[1] + v[2],
+	}
+}
+
+// rasterize calls fn for each sample of an nx by ny grid whose center is
+// covered by the projected triangle t, with the interpolated depth.
+func rasterize(t *Triangle, nx, ny int, fn func(x, y int, z float64)) {
+	a, b, c := t[0], t[1], t[2]
+	area := edge(a, b, c)
+	if area == 0 {
+		return
+	}
+	x0 := clamp(int(math.Floor(math.Min(a[0], math.Min(b[0], c[0])))), 0, nx-1)
+	x1 := clamp(int(math.Ceil(math.Max(a[0], math.Max(b[0], c[0])))), 0, nx-1)
+	y0 := clamp(int(math.Floor(math.Min(a[1], math.Min(b[1], c[1])))), 0, ny-1)
+	y1 := clamp(int(math.Ceil(math.Max(a[1], math.Max(b[1], c[1])))), 0, ny-1)
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			p := Vec3{float64(x) + 0.5, float64(y) + 0.5}
+			w0 := edge(b, c, p) / area
+			w1 := edge(c, a, p) / area
+			w2 := edge(a, b, p) / area
+			if w0 < 0 || w1 < 0 || w2 < 0 {
+				continue
+			}
+			fn(x, y, w0*a[2]+w1*b[2]+w2*c[2])
+		}
+	}
+}
+
+// edge returns twice the signed area of the triangle (a, b, p) in the xy
+// plane.
+func edge(a, b, p Vec3) float64 {
+	return (b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])
+}
+
+func clamp(x, min, max int) int {
+	if x < min {
+		return min
+	}
+	if x > max {
+		return max
+	}
+	return x
+}
@@ -0,0 +1,364 @@
+/*
+Package printer streams G-code to 3D printers running RepRap compatible
+firmware (Marlin, RepRapFirmware, Repetier) over a serial connection.
+
+Each command is sent with a line number and checksum.  A command is sent only
+after the firmware acknowledges the previous command with "ok", and commands
+are sent again when the firmware requests it with "Resend".
+*/
+package printer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the default time to wait for the firmware to respond
+// before a print fails.  Slow commands (heating, homing) are expected to
+// produce output while they run.
+const DefaultTimeout = 2 * time.Minute
+
+// historyLen is the number of sent commands retained for resending.
+const historyLen = 128
+
+// Temp is the current and target temperature of a heater.
+type Temp struct {
+	Current float64
+	Target  float64
+}
+
+// Status reports the progress of a print.
+type Status struct {
+	Line      int   // last line number acknowledged
+	BytesSent int64 // bytes of the G-code program sent
+	Size      int64 // total bytes of the G-code program, if known
+	Resends   int
+
+	// Temps maps heater names reported by the firmware ("T", "T0", "B") to
+	// their temperatures.
+	Temps map[string]Temp
+}
+
+// Progress returns the fraction of the program sent, or a negative number
+// if the size of the program is unknown.
+func (s *Status) Progress() float64 {
+	if s.Size <= 0 {
+		return -1
+	}
+	return float64(s.BytesSent) / float64(s.Size)
+}
+
+// Printer is a connection to printer firmware.
+type Printer struct {
+	rw io.ReadWriter
+
+	// Timeout is the maximum time to wait for output from the firmware.
+	Timeout time.Duration
+
+	// TempInterval is how often temperatures are requested (M105) during a
+	// print.  If zero temperatures are not requested.
+	TempInterval time.Duration
+
+	// StatusFunc, if not nil, is called after each acknowledged command.
+	StatusFunc func(*Status)
+
+	// Log, if not nil, is called with each line received from the firmware.
+	Log func(line string)
+
+	lines      chan string
+	readErr    chan error
+	cancel     chan struct{}
+	cancelOnce sync.Once
+	lineno     int
+	history    map[int]string
+	status     Status
+}
+
+// ErrCancelled is returned by Print when the print is cancelled.
+var ErrCancelled = fmt.Errorf("print cancelled")
+
+// New returns a Printer that communicates with firmware over rw.  New starts
+// a goroutine reading from rw which terminates when rw is closed.
+func New(rw io.ReadWriter) *Printer {
+	p := &Printer{
+		rw:           rw,
+		Timeout:      DefaultTimeout,
+		TempInterval: 5 * time.Second,
+		lines:        make(chan string, 64),
+		readErr:      make(chan error, 1),
+		cancel:       make(chan struct{}),
+		history:      make(map[int]string),
+	}
+	p.status.Temps = make(map[string]Temp)
+	go p.readLoop()
+	return p
+}
+
+func (p *Printer) readLoop() {
+	s := bufio.NewScanner(p.rw)
+	for s.Scan() {
+		p.lines <- strings.TrimSpace(s.Text())
+	}
+	err := s.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	p.readErr <- err
+}
+
+// WaitReady waits for the firmware to announce that it has started, which
+// happens when many printers are reset by opening the serial port.  WaitReady
+// returns nil if the firmware is silent for the duration d, assuming that it
+// was already running.
+func (p *Printer) WaitReady(d time.Duration) error {
+	timeout := time.After(d)
+	for {
+		select {
+		case line := <-p.lines:
+			p.log(line)
+			if strings.HasPrefix(line, "start") {
+				return nil
+			}
+		case err := <-p.readErr:
+			return err
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// Cancel stops a print in progress after the command being sent is
+// acknowledged.  Cancel does not stop the printer, and callers will generally
+// want to Send commands turning off heaters after Print returns.
+func (p *Printer) Cancel() {
+	p.cancelOnce.Do(func() { close(p.cancel) })
+}
+
+// Print sends the program read from r to the firmware.  The size of the
+// program in bytes is used for progress reporting and may be zero if
+// unknown.  Print returns after the firmware acknowledges the last command,
+// or ErrCancelled if Cancel is called.
+func (p *Printer) Print(r io.Reader, size int64) error {
+	p.status.Size = size
+	p.status.BytesSent = 0
+
+	// reset the firmware's line number.
+	p.lineno = 0
+	err := p.sendNumbered(0, "M110 N0")
+	if err != nil {
+		return err
+	}
+
+	lastTemp := time.Now()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		select {
+		case <-p.cancel:
+			return ErrCancelled
+		default:
+		}
+		raw := s.Text()
+		p.status.BytesSent += int64(len(raw)) + 1
+		cmd := stripComment(raw)
+		if cmd == "" {
+			continue
+		}
+		err := p.send(cmd)
+		if err != nil {
+			return err
+		}
+		if p.TempInterval > 0 && time.Since(lastTemp) >= p.TempInterval {
+			lastTemp = time.Now()
+			err := p.send("M105")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.Err()
+}
+
+// Send sends a single command to the firmware and waits for it to be
+// acknowledged.
+func (p *Printer) Send(cmd string) error {
+	cmd = stripComment(cmd)
+	if cmd == "" {
+		return nil
+	}
+	return p.send(cmd)
+}
+
+func (p *Printer) send(cmd string) error {
+	p.lineno++
+	return p.sendNumbered(p.lineno, cmd)
+}
+
+// sendNumbered sends cmd as line n and waits for the firmware to acknowledge
+// it.  Firmware requests lines to be sent again with "Resend: n" followed by
+// "ok", after which lines are sent again, one per acknowledgement, until line
+// n has been resent.
+func (p *Printer) sendNumbered(n int, cmd string) error {
+	p.history[n] = cmd
+	delete(p.history, n-historyLen)
+	err := p.write(n, cmd)
+	if err != nil {
+		return err
+	}
+	resend := -1
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return err
+		}
+		p.log(line)
+		p.parseTemps(line)
+		switch {
+		case strings.HasPrefix(line, "ok"):
+			if resend >= 0 {
+				err := p.write(resend, p.history[resend])
+				if err != nil {
+					return err
+				}
+				resend++
+				if resend > n {
+					resend = -1
+				}
+				continue
+			}
+			p.status.Line = n
+			if p.StatusFunc != nil {
+				p.StatusFunc(&p.status)
+			}
+			return nil
+		case isResend(line):
+			rn, ok := parseResend(line)
+			if !ok {
+				return fmt.Errorf("invalid resend request: %q", line)
+			}
+			if _, ok := p.history[rn]; !ok || rn > n {
+				return fmt.Errorf("resend: line %d is not available", rn)
+			}
+			p.status.Resends++
+			resend = rn
+		case isFatal(line):
+			return fmt.Errorf("firmware: %s", line)
+		}
+	}
+}
+
+func (p *Printer) write(n int, cmd string) error {
+	_, err := io.WriteString(p.rw, FormatLine(n, cmd)+"\n")
+	return err
+}
+
+func (p *Printer) readLine() (string, error) {
+	select {
+	case line := <-p.lines:
+		return line, nil
+	case err := <-p.readErr:
+		p.readErr <- err
+		return "", err
+	case <-time.After(p.Timeout):
+		return "", fmt.Errorf("timeout waiting for firmware")
+	}
+}
+
+func (p *Printer) log(line string) {
+	if p.Log != nil {
+		p.Log(line)
+	}
+}
+
+// parseTemps records temperatures in a line of firmware output like
+// "ok T:201.3 /210.0 B:59.8 /60.0 @:127".
+func (p *Printer) parseTemps(line string) {
+	for _, field := range strings.Fields(line) {
+		i := strings.Index(field, ":")
+		if i <= 0 || i == len(field)-1 {
+			continue
+		}
+		name := field[:i]
+		if name[0] != 'T' && name[0] != 'B' && name[0] != 'C' {
+			continue
+		}
+		cur, err := strconv.ParseFloat(field[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		p.status.Temps[name] = Temp{Current: cur}
+	}
+	// targets follow the current temperature as "/target".
+	fields := strings.Fields(line)
+	for i := 1; i < len(fields); i++ {
+		if !strings.HasPrefix(fields[i], "/") {
+			continue
+		}
+		target, err := strconv.ParseFloat(fields[i][1:], 64)
+		if err != nil {
+			continue
+		}
+		prev := fields[i-1]
+		j := strings.Index(prev, ":")
+		if j <= 0 {
+			continue
+		}
+		if t, ok := p.status.Temps[prev[:j]]; ok {
+			t.Target = target
+			p.status.Temps[prev[:j]] = t
+		}
+	}
+}
+
+// FormatLine returns cmd prefixed by the line number n and followed by a
+// checksum, the XOR of all preceding bytes.
+//
+//	N12 G1 X10*85
+func FormatLine(n int, cmd string) string {
+	line := "N" + strconv.Itoa(n) + " " + cmd
+	var cs byte
+	for i := 0; i < len(line); i++ {
+		cs ^= line[i]
+	}
+	return line + "*" + strconv.Itoa(int(cs))
+}
+
+// stripComment removes comments and surrounding space from a line of
+// G-code.
+func stripComment(line string) string {
+	if i := strings.Index(line, ";"); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+func isResend(line string) bool {
+	return strings.HasPrefix(line, "Resend:") || strings.HasPrefix(line, "rs ")
+}
+
+// parseResend returns the line number requested by "Resend: 12" or "rs N12".
+func parseResend(line string) (int, bool) {
+	i := strings.IndexAny(line, ": ")
+	s := strings.TrimSpace(line[i+1:])
+	s = strings.TrimPrefix(s, "N")
+	n, err := strconv.Atoi(strings.Fields(s + " ")[0])
+	return n, err == nil
+}
+
+// isFatal returns true if line reports an error that stops the printer.
+// Errors for corrupt lines are followed by a resend request and are not
+// fatal.
+func isFatal(line string) bool {
+	if line == "!!" || strings.HasPrefix(line, "!! ") {
+		return true
+	}
+	if !strings.HasPrefix(line, "Error:") {
+		return false
+	}
+	msg := strings.ToLower(line)
+	return strings.Contains(msg, "halted") || strings.Contains(msg, "kill") || strings.Contains(msg, "stopped")
+}
@@ -0,0 +1,189 @@
+package printer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// openPTY returns the master side of a new pseudo-terminal and the path of
+// its slave device.
+func openPTY(t *testing.T) (*os.File, string) {
+	m, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("pty: %v", err)
+	}
+	var unlock int32
+	err = ioctl(m.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	if err != nil {
+		m.Close()
+		t.Skipf("pty unlock: %v", err)
+	}
+	var n uint32
+	err = ioctl(m.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	if err != nil {
+		m.Close()
+		t.Skipf("pty number: %v", err)
+	}
+	return m, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+// firmware simulates Marlin's serial protocol.  Each line in Corrupt is
+// rejected the first time it is received as if its checksum were wrong.
+type firmware struct {
+	Corrupt map[int]bool
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func (fw *firmware) run(rw *os.File) {
+	fmt.Fprintf(rw, "start\necho:Marlin simulator\n")
+	last := 0
+	s := bufio.NewScanner(rw)
+	for s.Scan() {
+		line := s.Text()
+		i := strings.LastIndex(line, "*")
+		if !strings.HasPrefix(line, "N") || i < 0 {
+			fmt.Fprintf(rw, "Error:No Line Number with checksum, Last Line: %d\nResend: %d\nok\n", last, last+1)
+			continue
+		}
+		var cs byte
+		for j := 0; j < i; j++ {
+			cs ^= line[j]
+		}
+		sp := strings.Index(line, " ")
+		n, _ := strconv.Atoi(line[1:sp])
+		if strconv.Itoa(int(cs)) != line[i+1:] || fw.Corrupt[n] {
+			delete(fw.Corrupt, n)
+			fmt.Fprintf(rw, "Error:checksum mismatch, Last Line: %d\nResend: %d\nok\n", last, last+1)
+			continue
+		}
+		cmd := line[sp+1 : i]
+		if strings.HasPrefix(cmd, "M110") {
+			last = n
+			fmt.Fprintf(rw, "ok\n")
+			continue
+		}
+		if n != last+1 {
+			fmt.Fprintf(rw, "Error:Line Number is not Last Line Number+1, Last Line: %d\nResend: %d\nok\n", last, last+1)
+			continue
+		}
+		last = n
+		fw.mu.Lock()
+		fw.commands = append(fw.commands, cmd)
+		fw.mu.Unlock()
+		switch {
+		case cmd == "M105":
+			fmt.Fprintf(rw, "ok T:201.5 /210.0 B:59.0 /60.0 @:127\n")
+		case strings.HasPrefix(cmd, "M109"):
+			fmt.Fprintf(rw, "T:180.0 /210.0 B:60.0 /60.0\nT:210.0 /210.0 B:60.0 /60.0\nok\n")
+		default:
+			fmt.Fprintf(rw, "ok\n")
+		}
+	}
+}
+
+const testProgram = `; test program
+M109 S210
+G28 ; home
+
+G1 X10 Y10 F3000
+G1 X20 Y10 E1
+G1 X20 Y20 E2
+G1 X10 Y20 E3
+M104 S0
+`
+
+func TestPrint(t *testing.T) {
+	master, slave := openPTY(t)
+	defer master.Close()
+	f, err := OpenSerial(slave, 115200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fw := &firmware{Corrupt: map[int]bool{3: true, 6: true}}
+	go fw.run(master)
+
+	p := New(f)
+	p.Timeout = 5 * time.Second
+	p.TempInterval = 0
+	var last Status
+	p.StatusFunc = func(s *Status) { last = *s }
+	err = p.WaitReady(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Print(strings.NewReader(testProgram), int64(len(testProgram)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Send("M105")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"M109 S210",
+		"G28",
+		"G1 X10 Y10 F3000",
+		"G1 X20 Y10 E1",
+		"G1 X20 Y20 E2",
+		"G1 X10 Y20 E3",
+		"M104 S0",
+		"M105",
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if strings.Join(fw.commands, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("commands:\n%s", strings.Join(fw.commands, "\n"))
+	}
+	if last.Resends != 2 {
+		t.Errorf("resends: %d", last.Resends)
+	}
+	if last.Line != 8 {
+		t.Errorf("line: %d", last.Line)
+	}
+	if last.Progress() != 1 {
+		t.Errorf("progress: %v", last.Progress())
+	}
+	if temp := last.Temps["T"]; temp.Current != 201.5 || temp.Target != 210 {
+		t.Errorf("hotend: %v", temp)
+	}
+	if temp := last.Temps["B"]; temp.Current != 59 || temp.Target != 60 {
+		t.Errorf("bed: %v", temp)
+	}
+}
+
+func TestOpenSerial(t *testing.T) {
+	master, slave := openPTY(t)
+	defer master.Close()
+	_, err := OpenSerial(slave, 0)
+	if err == nil {
+		t.Errorf("zero baud rate accepted")
+	}
+	if !customBaudRates {
+		t.Skip("custom baud rates unsupported")
+	}
+	// Marlin's default rate has no termios constant.
+	f, err := OpenSerial(slave, 250000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestFormatLine(t *testing.T) {
+	// the checksum is the XOR of every byte before the asterisk.
+	if line := FormatLine(123, "M104 S200"); line != "N123 M104 S200*103" {
+		t.Errorf("line: %q", line)
+	}
+}
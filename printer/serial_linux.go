@@ -0,0 +1,78 @@
+package printer
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// cbaud masks the baud rate bits of the termios c_cflag.
+const cbaud = 0010017
+
+var baudRates = map[int]uint32{
+	9600:    syscall.B9600,
+	19200:   syscall.B19200,
+	38400:   syscall.B38400,
+	57600:   syscall.B57600,
+	115200:  syscall.B115200,
+	230400:  syscall.B230400,
+	460800:  syscall.B460800,
+	500000:  syscall.B500000,
+	921600:  syscall.B921600,
+	1000000: syscall.B1000000,
+}
+
+// OpenSerial opens the serial device at path in raw mode with the given baud
+// rate, 8 data bits, no parity and one stop bit.  Rates without a standard
+// termios constant, like the 250000 used by Marlin, are set with termios2 on
+// architectures which support it.
+func OpenSerial(path string, baud int) (*os.File, error) {
+	speed, standard := baudRates[baud]
+	if !standard && (!customBaudRates || baud <= 0) {
+		return nil, fmt.Errorf("unsupported baud rate: %d", baud)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	var t syscall.Termios
+	err = ioctl(f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	// equivalent to cfmakeraw(3)
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB
+	t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL
+	if standard {
+		// custom rates are set below.  clearing the rate here would set it
+		// to zero, which hangs up the line.
+		t.Cflag = t.Cflag&^cbaud | speed
+		t.Ispeed = speed
+		t.Ospeed = speed
+	}
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	err = ioctl(f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+	if err == nil && !standard {
+		err = setCustomBaudRate(f.Fd(), baud)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return f, nil
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
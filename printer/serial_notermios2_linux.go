@@ -0,0 +1,14 @@
+//go:build linux && !(386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+// +build linux,!386,!amd64,!arm,!arm64,!loong64,!riscv64,!s390x
+
+package printer
+
+import "fmt"
+
+// customBaudRates is false because termios2 is not supported on this
+// architecture.
+const customBaudRates = false
+
+func setCustomBaudRate(fd uintptr, baud int) error {
+	return fmt.Errorf("unsupported baud rate: %d", baud)
+}
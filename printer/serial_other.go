@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package printer
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// OpenSerial opens the serial device at path with the given baud rate.
+// Serial devices are only supported on linux.
+func OpenSerial(path string, baud int) (*os.File, error) {
+	return nil, fmt.Errorf("serial devices are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,46 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+// +build linux
+// +build 386 amd64 arm arm64 loong64 riscv64 s390x
+
+package printer
+
+import "unsafe"
+
+// customBaudRates is true because termios2 is supported on this
+// architecture.
+const customBaudRates = true
+
+// termios2 and its ioctls are not defined by package syscall.  The values are
+// from the kernel's asm-generic headers.
+// The input rate bits of c_cflag are shifted by ibshift.
+const (
+	bother  = 0010000
+	ibshift = 16
+	tcgets2 = 0x802c542a
+	tcsets2 = 0x402c542b
+)
+
+type termios2 struct {
+	Iflag  uint32
+	Oflag  uint32
+	Cflag  uint32
+	Lflag  uint32
+	Line   uint8
+	Cc     [19]uint8
+	Ispeed uint32
+	Ospeed uint32
+}
+
+// setCustomBaudRate sets the input and output baud rates of the terminal fd
+// to any rate the driver supports.
+func setCustomBaudRate(fd uintptr, baud int) error {
+	var t termios2
+	err := ioctl(fd, tcgets2, uintptr(unsafe.Pointer(&t)))
+	if err != nil {
+		return err
+	}
+	t.Cflag = t.Cflag&^(cbaud|cbaud<<ibshift) | bother | bother<<ibshift
+	t.Ispeed = uint32(baud)
+	t.Ospeed = uint32(baud)
+	return ioctl(fd, tcsets2, uintptr(unsafe.Pointer(&t)))
+}
@@ -0,0 +1,565 @@
+/*
+Package slicerclient is a client for the REST API of a snuggied server.
+
+	c := slicerclient.New("localhost:8888")
+	job, err := c.SliceFile(ctx, "slic3r", "hq", "model.stl")
+	if err != nil {
+		return err
+	}
+	job, err = c.Wait(ctx, job)
+	if err != nil {
+		return err
+	}
+	if err := slicerclient.CheckJob(job); err != nil {
+		return err
+	}
+	_, err = c.DownloadGCode(ctx, job.ID, w)
+
+Every call takes a context which bounds the call, including any retries.
+Responses with unexpected HTTP statuses are returned as a *StatusError.
+Requests which fail for transient reasons (network errors and 429, 502, 503,
+and 504 responses) are retried according to the client's RetryPolicy.
+*/
+package slicerclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/mesh"
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// DefaultPrefix is the path of the API on snuggied servers.
+const DefaultPrefix = "/slicer"
+
+// Client makes requests to a snuggied server.  A Client is safe for
+// concurrent use once it is configured.
+type Client struct {
+	// BaseURL is the URL of the server's API, like
+	// "http://localhost:8888/slicer".
+	BaseURL string
+
+	// HTTPClient sends requests.  If nil http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Retry determines how requests which fail for transient reasons are
+	// retried.
+	Retry RetryPolicy
+
+	// PollInterval is the initial time between requests for a job's status
+	// in Wait.  The interval doubles after each request up to
+	// MaxPollInterval.  Zero values use 100ms and 5s.
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+
+	// RequestLog, if not nil, is called after each request attempt.
+	RequestLog func(*RequestInfo)
+}
+
+// New returns a Client for the server at addr, which is either a host and
+// port, like "localhost:8888", or the URL of the server or its API, like
+// "https://slicer.example.com/slicer".  A URL without a path uses
+// DefaultPrefix.
+func New(addr string) *Client {
+	base := addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	base = strings.TrimSuffix(base, "/")
+	if u, err := url.Parse(base); err == nil && u.Path == "" {
+		base += DefaultPrefix
+	}
+	return &Client{
+		BaseURL: base,
+		Retry:   DefaultRetry,
+	}
+}
+
+// RetryPolicy determines how failed requests are retried.  The delay before
+// the first retry is Backoff and it doubles for each retry after, up to
+// MaxBackoff.  A delay requested by the server with a Retry-After header is
+// used if it is longer.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is sent.  Values
+	// less than 2 disable retries.
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// DefaultRetry is the RetryPolicy of clients returned by New.
+var DefaultRetry = RetryPolicy{
+	MaxAttempts: 4,
+	Backoff:     500 * time.Millisecond,
+	MaxBackoff:  10 * time.Second,
+}
+
+// delay returns the time to wait before the given retry, the first retry
+// being 1.
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// RequestInfo describes an attempt to make a request.  Err is set if no
+// response was received or, as a *StatusError, if the response had an
+// unexpected status.
+type RequestInfo struct {
+	Method   string
+	URL      string
+	Attempt  int
+	Response *http.Response
+	Err      error
+	Dur      time.Duration
+}
+
+// StatusError is returned for responses with an unexpected HTTP status.
+// Message is the start of the response body, which describes the error.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Message    string
+
+	// RetryAfter is the delay requested by the server before the request is
+	// made again, or zero.
+	RetryAfter time.Duration
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s: %s", err.Method, err.URL, err.Status, err.Message)
+}
+
+// IsStatus returns true if err is a *StatusError with the given status code.
+func IsStatus(err error, code int) bool {
+	serr, ok := err.(*StatusError)
+	return ok && serr.StatusCode == code
+}
+
+// IsNotFound returns true if err is a 404 Not Found response, returned for
+// jobs which do not exist or have been deleted.
+func IsNotFound(err error) bool {
+	return IsStatus(err, http.StatusNotFound)
+}
+
+// JobError describes a job which terminated without completing.
+type JobError struct {
+	ID      string
+	Status  slicerjob.Status
+	Message string
+}
+
+func (err *JobError) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("job %v", err.Status)
+	}
+	return fmt.Sprintf("job %v: %s", err.Status, err.Message)
+}
+
+// CheckJob returns a *JobError if job has failed or been cancelled.
+func CheckJob(job *slicerjob.Job) error {
+	if job.Status == slicerjob.Failed || job.Status == slicerjob.Cancelled {
+		return &JobError{ID: job.ID, Status: job.Status, Message: job.Error}
+	}
+	return nil
+}
+
+// retryMode determines which failures of a request are retried.
+type retryMode int
+
+const (
+	// retryNone is used for requests whose body cannot be sent again.
+	retryNone retryMode = iota
+	// retryRejected retries only requests the server rejected without
+	// processing them, for requests which are not idempotent.
+	retryRejected
+	// retryAll retries all transient failures of idempotent requests.
+	retryAll
+)
+
+// bodyFunc returns a new request body and its content type for each attempt
+// to make a request.
+type bodyFunc func() (io.Reader, string, error)
+
+// do makes a request to the API path, retrying transient failures as allowed
+// by mode.  Responses with status codes other than 2xx are returned as a
+// *StatusError.
+func (c *Client) do(ctx context.Context, method, path string, body bodyFunc, mode retryMode) (*http.Response, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	url := c.BaseURL + path
+	for attempt := 1; ; attempt++ {
+		var r io.Reader
+		var ctype string
+		if body != nil {
+			var err error
+			r, ctype, err = body()
+			if err != nil {
+				return nil, err
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, r)
+		if err != nil {
+			return nil, err
+		}
+		if ctype != "" {
+			req.Header.Set("Content-Type", ctype)
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		info := &RequestInfo{
+			Method:   method,
+			URL:      url,
+			Attempt:  attempt,
+			Response: resp,
+			Err:      err,
+			Dur:      time.Since(start),
+		}
+		retry := attempt < c.Retry.MaxAttempts
+		var delay time.Duration
+		switch {
+		case err != nil:
+			c.logRequest(info)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			err = fmt.Errorf("%s %s: %v", method, url, err)
+			if !retry || mode != retryAll {
+				return nil, err
+			}
+		case resp.StatusCode/100 == 2:
+			c.logRequest(info)
+			return resp, nil
+		default:
+			serr := statusError(req, resp)
+			info.Err = serr
+			c.logRequest(info)
+			err = serr
+			if !retry || !retryable(serr.StatusCode, mode) {
+				return nil, err
+			}
+			delay = serr.RetryAfter
+		}
+		if d := c.Retry.delay(attempt); d > delay {
+			delay = d
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable returns true if responses with status code may be retried.
+func retryable(code int, mode retryMode) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return mode != retryNone
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return mode == retryAll
+	}
+	return false
+}
+
+// statusError reads the error from resp and closes its body.
+func statusError(req *http.Request, resp *http.Response) *StatusError {
+	defer resp.Body.Close()
+	p, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	serr := &StatusError{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Message:    strings.TrimSpace(string(p)),
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		serr.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return serr
+}
+
+func (c *Client) logRequest(info *RequestInfo) {
+	if c.RequestLog != nil {
+		c.RequestLog(info)
+	}
+}
+
+// getJSON requests the API path and decodes the response into v.
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.do(ctx, "GET", path, nil, retryAll)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("GET %s: response: %v", path, err)
+	}
+	return nil
+}
+
+// Presets returns the names of the presets available for the backend
+// slicer.
+func (c *Client) Presets(ctx context.Context, slicer string) ([]string, error) {
+	var presets *slicerjob.SlicerPreset
+	err := c.getJSON(ctx, "/presets/"+url.PathEscape(slicer), &presets)
+	if err != nil {
+		return nil, err
+	}
+	return presets.Presets, nil
+}
+
+// SliceRequest describes a job to create.  Slicer, Preset, Filename, and Mesh
+// are required.  The file extension of Filename identifies the format of
+// Mesh.
+type SliceRequest struct {
+	Slicer   string
+	Preset   string
+	Filename string
+	Mesh     io.Reader
+
+	PostProcess []string      // post-processors, as "name:arg"
+	Thumbnails  string        // sizes of embedded thumbnails, like "16x16,220x124"
+	Target      string        // output target to receive the G-code
+	Print       *bool         // start printing after delivery to Target
+	TTL         time.Duration // time the job is kept after it terminates
+}
+
+// Slice creates a job to slice req.Mesh.  The mesh is streamed to the server.
+// The request is retried if the server rejects it as busy only when Mesh
+// implements io.Seeker, so that it can be sent again.
+func (c *Client) Slice(ctx context.Context, req *SliceRequest) (*slicerjob.Job, error) {
+	if req.Slicer == "" || req.Preset == "" || req.Mesh == nil {
+		return nil, fmt.Errorf("slicer, preset, and mesh are required")
+	}
+	if !mesh.IsMeshFile(req.Filename) {
+		return nil, fmt.Errorf("not a mesh file: %v", req.Filename)
+	}
+	mode := retryNone
+	seeker, ok := req.Mesh.(io.Seeker)
+	if ok {
+		mode = retryRejected
+	}
+	var prev *io.PipeReader
+	var done chan struct{}
+	body := func() (io.Reader, string, error) {
+		if prev != nil {
+			// the form of the previous attempt must stop reading the mesh
+			// before it is rewound.
+			prev.Close()
+			<-done
+			_, err := seeker.Seek(0, 0)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		pr, pw := io.Pipe()
+		w := multipart.NewWriter(pw)
+		prev, done = pr, make(chan struct{})
+		go func(done chan struct{}) {
+			defer close(done)
+			pw.CloseWithError(writeSliceForm(w, req))
+		}(done)
+		return pr, w.FormDataContentType(), nil
+	}
+	resp, err := c.do(ctx, "POST", "/jobs", body, mode)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var job *slicerjob.Job
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	if err != nil {
+		return nil, fmt.Errorf("POST /jobs: response: %v", err)
+	}
+	return job, nil
+}
+
+func writeSliceForm(w *multipart.Writer, req *SliceRequest) error {
+	fields := [][2]string{
+		{"slicer", req.Slicer},
+		{"preset", req.Preset},
+		{"thumbnails", req.Thumbnails},
+		{"target", req.Target},
+	}
+	for _, pp := range req.PostProcess {
+		fields = append(fields, [2]string{"postprocess", pp})
+	}
+	if req.Print != nil {
+		fields = append(fields, [2]string{"print", strconv.FormatBool(*req.Print)})
+	}
+	if req.TTL > 0 {
+		fields = append(fields, [2]string{"ttl", req.TTL.String()})
+	}
+	for _, f := range fields {
+		if f[1] == "" {
+			continue
+		}
+		err := w.WriteField(f[0], f[1])
+		if err != nil {
+			return err
+		}
+	}
+	file, err := w.CreateFormFile("meshfile", filepath.Base(req.Filename))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, req.Mesh)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// SliceFile creates a job to slice the mesh file at path with a preset of
+// the backend slicer.
+func (c *Client) SliceFile(ctx context.Context, slicer, preset, path string) (*slicerjob.Job, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return c.Slice(ctx, &SliceRequest{
+		Slicer:   slicer,
+		Preset:   preset,
+		Filename: path,
+		Mesh:     f,
+	})
+}
+
+// Job returns the current state of the job with the given id.
+func (c *Client) Job(ctx context.Context, id string) (*slicerjob.Job, error) {
+	if id == "" {
+		return nil, fmt.Errorf("job missing id")
+	}
+	var job *slicerjob.Job
+	err := c.getJSON(ctx, "/jobs/"+url.PathEscape(id), &job)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// History returns the events recorded for the job with the given id.
+func (c *Client) History(ctx context.Context, id string) (*slicerjob.History, error) {
+	if id == "" {
+		return nil, fmt.Errorf("job missing id")
+	}
+	var history *slicerjob.History
+	err := c.getJSON(ctx, "/jobs/"+url.PathEscape(id)+"/history", &history)
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// Cancel cancels the job with the given id.  Jobs which have already
+// terminated cannot be cancelled and a 409 Conflict *StatusError is returned.
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	if id == "" {
+		return fmt.Errorf("job missing id")
+	}
+	resp, err := c.do(ctx, "DELETE", "/jobs/"+url.PathEscape(id), nil, retryAll)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Wait polls the server until job terminates and returns its final state.
+// The returned job may have failed, see CheckJob.  If ctx is done first the
+// last known state of the job is returned with the context's error.  The job
+// is not cancelled.
+func (c *Client) Wait(ctx context.Context, job *slicerjob.Job) (*slicerjob.Job, error) {
+	return c.Watch(ctx, job, nil)
+}
+
+// Watch is like Wait but calls fn, if it is not nil, with job and with each
+// state of the job received from the server.
+func (c *Client) Watch(ctx context.Context, job *slicerjob.Job, fn func(job *slicerjob.Job)) (*slicerjob.Job, error) {
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	maxInterval := c.MaxPollInterval
+	if maxInterval <= 0 {
+		maxInterval = 5 * time.Second
+	}
+	for {
+		if fn != nil {
+			fn(job)
+		}
+		if !job.Status.IsWaiting() {
+			return job, nil
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return job, ctx.Err()
+		case <-timer.C:
+		}
+		current, err := c.Job(ctx, job.ID)
+		if err != nil {
+			return job, err
+		}
+		job = current
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// GCode returns the G-code of the completed job with the given id as it is
+// received from the server.  The caller must close the returned reader.
+func (c *Client) GCode(ctx context.Context, id string) (io.ReadCloser, error) {
+	if id == "" {
+		return nil, fmt.Errorf("job missing id")
+	}
+	resp, err := c.do(ctx, "GET", "/gcodes/"+url.PathEscape(id), nil, retryAll)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DownloadGCode writes the G-code of the completed job with the given id to
+// w and returns the number of bytes written.
+func (c *Client) DownloadGCode(ctx context.Context, id string, w io.Writer) (int64, error) {
+	r, err := c.GCode(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	n, err := io.Copy(w, r)
+	if err != nil && ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	return n, err
+}
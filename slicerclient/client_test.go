@@ -0,0 +1,294 @@
+package slicerclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/matching-snuggies/slicerjob"
+)
+
+// fakeServer responds to API requests with handlers for each method and
+// path, which are called in turn for repeated requests.  The last handler
+// for a request is reused once the others have been called.
+type fakeServer struct {
+	mu       sync.Mutex
+	handlers map[string][]http.HandlerFunc
+	requests map[string]int
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		handlers: make(map[string][]http.HandlerFunc),
+		requests: make(map[string]int),
+	}
+}
+
+func (s *fakeServer) handle(route string, fns ...http.HandlerFunc) {
+	s.handlers[route] = append(s.handlers[route], fns...)
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := r.Method + " " + r.URL.Path
+	s.mu.Lock()
+	fns := s.handlers[route]
+	n := s.requests[route]
+	s.requests[route]++
+	s.mu.Unlock()
+	if len(fns) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if n >= len(fns) {
+		n = len(fns) - 1
+	}
+	fns[n](w, r)
+}
+
+func (s *fakeServer) count(route string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[route]
+}
+
+func status(code int, msg string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, msg, code)
+	}
+}
+
+func respondJSON(v interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func testClient(t *testing.T, s *fakeServer) *Client {
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	c := New(server.URL)
+	c.Retry = RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	c.PollInterval = time.Millisecond
+	c.MaxPollInterval = 5 * time.Millisecond
+	return c
+}
+
+func TestNew(t *testing.T) {
+	for addr, expect := range map[string]string{
+		"localhost:8888":                     "http://localhost:8888/slicer",
+		"http://10.0.0.2:8888/":              "http://10.0.0.2:8888/slicer",
+		"https://example.com/api/slicer":     "https://example.com/api/slicer",
+		"https://example.com/api/slicer/":    "https://example.com/api/slicer",
+		"http://localhost:8888/slicer?x=abc": "http://localhost:8888/slicer?x=abc",
+	} {
+		if c := New(addr); c.BaseURL != expect {
+			t.Errorf("%s: %s", addr, c.BaseURL)
+		}
+	}
+}
+
+func TestSlice(t *testing.T) {
+	s := newFakeServer()
+	var form map[string][]string
+	var content string
+	s.handle("POST /slicer/jobs",
+		status(http.StatusServiceUnavailable, "draining"),
+		func(w http.ResponseWriter, r *http.Request) {
+			f, header, err := r.FormFile("meshfile")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p, _ := ioutil.ReadAll(f)
+			content = header.Filename + ":" + string(p)
+			form = r.MultipartForm.Value
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(&slicerjob.Job{ID: "job1", Status: slicerjob.Accepted})
+		})
+	c := testClient(t, s)
+
+	print := true
+	job, err := c.Slice(context.Background(), &SliceRequest{
+		Slicer:      "slic3r",
+		Preset:      "hq",
+		Filename:    "parts/cube.stl",
+		Mesh:        strings.NewReader("solid cube"),
+		PostProcess: []string{"pause:3", "temp_ramp:200:210"},
+		Print:       &print,
+		TTL:         time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "job1" || s.count("POST /slicer/jobs") != 2 {
+		t.Errorf("job %q after %d requests", job.ID, s.count("POST /slicer/jobs"))
+	}
+	if content != "cube.stl:solid cube" {
+		t.Errorf("mesh: %q", content)
+	}
+	for name, expect := range map[string]string{
+		"slicer":      "slic3r",
+		"preset":      "hq",
+		"postprocess": "pause:3,temp_ramp:200:210",
+		"print":       "true",
+		"ttl":         "1h0m0s",
+		"target":      "",
+	} {
+		if v := strings.Join(form[name], ","); v != expect {
+			t.Errorf("%s: %q", name, v)
+		}
+	}
+
+	// meshes which cannot be sent again are not retried.
+	s = newFakeServer()
+	s.handle("POST /slicer/jobs", status(http.StatusServiceUnavailable, "draining"))
+	c = testClient(t, s)
+	_, err = c.Slice(context.Background(), &SliceRequest{
+		Slicer:   "slic3r",
+		Preset:   "hq",
+		Filename: "cube.stl",
+		Mesh:     bytes.NewBufferString("solid cube"),
+	})
+	if !IsStatus(err, http.StatusServiceUnavailable) || s.count("POST /slicer/jobs") != 1 {
+		t.Errorf("unseekable mesh: %v after %d requests", err, s.count("POST /slicer/jobs"))
+	}
+
+	// rejected meshes are not retried.
+	s = newFakeServer()
+	s.handle("POST /slicer/jobs", status(http.StatusRequestEntityTooLarge, "upload exceeds 1 MB"))
+	c = testClient(t, s)
+	_, err = c.Slice(context.Background(), &SliceRequest{
+		Slicer:   "slic3r",
+		Preset:   "hq",
+		Filename: "cube.stl",
+		Mesh:     strings.NewReader("solid cube"),
+	})
+	serr, ok := err.(*StatusError)
+	if !ok || serr.StatusCode != http.StatusRequestEntityTooLarge || serr.Message != "upload exceeds 1 MB" {
+		t.Errorf("rejected: %v", err)
+	}
+	if s.count("POST /slicer/jobs") != 1 {
+		t.Errorf("rejected mesh sent %d times", s.count("POST /slicer/jobs"))
+	}
+
+	_, err = c.Slice(context.Background(), &SliceRequest{
+		Slicer:   "slic3r",
+		Preset:   "hq",
+		Filename: "cube.txt",
+		Mesh:     strings.NewReader("solid cube"),
+	})
+	if err == nil {
+		t.Errorf("text file sliced")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	s := newFakeServer()
+	s.handle("GET /slicer/jobs/job1",
+		status(http.StatusBadGateway, "bad gateway"),
+		status(http.StatusServiceUnavailable, "busy"),
+		respondJSON(&slicerjob.Job{ID: "job1", Status: slicerjob.Processing}))
+	s.handle("GET /slicer/jobs/job2", status(http.StatusBadGateway, "bad gateway"))
+	s.handle("DELETE /slicer/jobs/job1", status(http.StatusConflict, "job complete: cannot cancel"))
+	c := testClient(t, s)
+
+	var attempts []int
+	c.RequestLog = func(info *RequestInfo) {
+		attempts = append(attempts, info.Attempt)
+	}
+	job, err := c.Job(context.Background(), "job1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != slicerjob.Processing || len(attempts) != 3 || attempts[2] != 3 {
+		t.Errorf("job %v after attempts %v", job.Status, attempts)
+	}
+
+	// requests fail after the maximum number of attempts.
+	_, err = c.Job(context.Background(), "job2")
+	if !IsStatus(err, http.StatusBadGateway) || s.count("GET /slicer/jobs/job2") != 3 {
+		t.Errorf("job2: %v after %d requests", err, s.count("GET /slicer/jobs/job2"))
+	}
+
+	_, err = c.Job(context.Background(), "missing")
+	if !IsNotFound(err) {
+		t.Errorf("missing job: %v", err)
+	}
+	err = c.Cancel(context.Background(), "job1")
+	if !IsStatus(err, http.StatusConflict) || s.count("DELETE /slicer/jobs/job1") != 1 {
+		t.Errorf("cancel: %v", err)
+	}
+
+	// retries end when the context is done.
+	s = newFakeServer()
+	s.handle("GET /slicer/jobs/job1", status(http.StatusServiceUnavailable, "busy"))
+	c = testClient(t, s)
+	c.Retry = RetryPolicy{MaxAttempts: 10, Backoff: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = c.Job(ctx, "job1")
+	if err != context.DeadlineExceeded {
+		t.Errorf("deadline: %v", err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	s := newFakeServer()
+	s.handle("GET /slicer/jobs/job1",
+		respondJSON(&slicerjob.Job{ID: "job1", Status: slicerjob.Accepted}),
+		respondJSON(&slicerjob.Job{ID: "job1", Status: slicerjob.Processing, Progress: 0.8}),
+		respondJSON(&slicerjob.Job{ID: "job1", Status: slicerjob.Failed, Error: "bad mesh"}))
+	s.handle("GET /slicer/jobs/job2", respondJSON(&slicerjob.Job{ID: "job2", Status: slicerjob.Processing}))
+	c := testClient(t, s)
+
+	var seen []slicerjob.Status
+	job, err := c.Watch(context.Background(), &slicerjob.Job{ID: "job1"}, func(job *slicerjob.Job) {
+		seen = append(seen, job.Status)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 4 || seen[2] != slicerjob.Processing {
+		t.Errorf("statuses: %v", seen)
+	}
+	err = CheckJob(job)
+	if jerr, ok := err.(*JobError); !ok || jerr.Status != slicerjob.Failed || jerr.Error() != "job failed: bad mesh" {
+		t.Errorf("job error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	job, err = c.Wait(ctx, &slicerjob.Job{ID: "job2"})
+	if err != context.DeadlineExceeded || job.Status != slicerjob.Processing {
+		t.Errorf("wait: %v %v", job.Status, err)
+	}
+}
+
+func TestDownloadGCode(t *testing.T) {
+	gcode := strings.Repeat("G1 X10 Y10 E1\n", 10000)
+	s := newFakeServer()
+	s.handle("GET /slicer/gcodes/job1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(gcode))
+	})
+	c := testClient(t, s)
+
+	var buf bytes.Buffer
+	n, err := c.DownloadGCode(context.Background(), "job1", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(gcode)) || buf.String() != gcode {
+		t.Errorf("downloaded %d bytes", n)
+	}
+	_, err = c.DownloadGCode(context.Background(), "missing", &buf)
+	if !IsNotFound(err) {
+		t.Errorf("missing gcode: %v", err)
+	}
+}
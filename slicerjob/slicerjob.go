@@ -47,14 +47,122 @@ func JobPage(cursor Cursor, jobs []*Job) *Page {
 }
 
 type Job struct {
-	ID         string     `json:"id"`
-	Status     Status     `json:"status"`
-	Progress   float64    `json:"progress"`
-	URL        string     `json:"url"`
-	GCodeURL   string     `json:"gcode_url"`
-	Created    *time.Time `json:"created_time,omitempty"`
-	Updated    *time.Time `json:"updated_time,omitempty"`
-	Terminated *time.Time `json:"terminated_time,omitempty"`
+	ID          string          `json:"id"`
+	Status      Status          `json:"status"`
+	Progress    float64         `json:"progress"`
+	URL         string          `json:"url"`
+	GCodeURL    string          `json:"gcode_url"`
+	Slicer      string          `json:"slicer,omitempty"`
+	Preset      string          `json:"preset,omitempty"`
+	PostProcess []PostProcessor `json:"postprocess,omitempty"`
+	Thumbnails  string          `json:"thumbnails,omitempty"`
+	MeshName    string          `json:"mesh_name,omitempty"`
+	Delivery    *Delivery       `json:"delivery,omitempty"`
+	GCodeStats  *GCodeStats     `json:"gcode_stats,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    []*Attempt      `json:"attempts,omitempty"`
+	Created     *time.Time      `json:"created_time,omitempty"`
+	Updated     *time.Time      `json:"updated_time,omitempty"`
+	Terminated  *time.Time      `json:"terminated_time,omitempty"`
+	TTL         float64         `json:"ttl,omitempty"` // seconds retained after termination, or zero for the server default
+}
+
+// SetStatus changes the status of j at time t.  A TransitionError is
+// returned if j may not change to status.  Terminal statuses set the time j
+// terminated.
+func (j *Job) SetStatus(status Status, t time.Time) error {
+	if !j.Status.CanTransition(status) {
+		return &TransitionError{j.Status, status}
+	}
+	j.Status = status
+	j.Updated = &t
+	if status.IsTerminal() {
+		j.Terminated = &t
+	}
+	return nil
+}
+
+// Event types recorded in a job's history.
+const (
+	EventAccepted  = "accepted"
+	EventStarted   = "started"
+	EventProgress  = "progress"
+	EventRetrying  = "retrying"
+	EventComplete  = "complete"
+	EventFailed    = "failed"
+	EventCancelled = "cancelled"
+)
+
+// Event is an entry in the history of a job.  Status and Progress are those
+// of the job after the event.  Message describes progress milestones and
+// failures.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Status   Status    `json:"status"`
+	Node     string    `json:"node,omitempty"`
+	Progress float64   `json:"progress,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// History is the sequence of events for a job, oldest first.
+type History struct {
+	JobID  string   `json:"job_id"`
+	Events []*Event `json:"events"`
+}
+
+// PostProcessor is a built-in G-code post-processor applied to a job's
+// output.  Arg configures the processor and its meaning depends on Name.
+type PostProcessor struct {
+	Name string `json:"name"`
+	Arg  string `json:"arg"`
+}
+
+// Delivery statuses.
+const (
+	DeliveryPending  = "pending"
+	DeliveryRetrying = "retrying"
+	DeliveryComplete = "complete"
+	DeliveryFailed   = "failed"
+)
+
+// Delivery describes the transfer of a job's G-code to printer host software
+// (an output target) after slicing completes.
+type Delivery struct {
+	Target   string     `json:"target"`
+	Print    bool       `json:"print"`
+	Status   string     `json:"status"`
+	Attempts int        `json:"attempts"`
+	Error    string     `json:"error,omitempty"`
+	Updated  *time.Time `json:"updated_time,omitempty"`
+}
+
+// Attempt records one attempt to slice a job.  Retryable is true if the
+// attempt failed for a transient reason.  A failed attempt which will be
+// retried has the time of the next attempt.
+type Attempt struct {
+	Number    int        `json:"number"`
+	Node      string     `json:"node,omitempty"`
+	Started   *time.Time `json:"started_time"`
+	Ended     *time.Time `json:"ended_time,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Retryable bool       `json:"retryable,omitempty"`
+	RetryAt   *time.Time `json:"retry_time,omitempty"`
+}
+
+// GCodeStats describes the resources needed to print a job's G-code.
+type GCodeStats struct {
+	// PrintTime is the estimated time to print in seconds.
+	PrintTime float64 `json:"print_time"`
+
+	// FilamentLength is given in millimeters, FilamentVolume in cubic
+	// centimeters, and FilamentWeight in grams.
+	FilamentLength float64 `json:"filament_length"`
+	FilamentVolume float64 `json:"filament_volume"`
+	FilamentWeight float64 `json:"filament_weight"`
+
+	Layers int     `json:"layers"`
+	MaxZ   float64 `json:"max_z"`
 }
 
 type SlicerPreset struct {
@@ -1,6 +1,9 @@
 package slicerjob
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestSlicerJob(t *testing.T) {
 	job := New()
@@ -8,3 +11,32 @@ func TestSlicerJob(t *testing.T) {
 		t.Fatalf("new job missing ID")
 	}
 }
+
+func TestSetStatus(t *testing.T) {
+	now := time.Now()
+	job := New()
+	for _, status := range []Status{Processing, Accepted, Processing, Complete} {
+		err := job.SetStatus(status, now)
+		if err != nil {
+			t.Fatalf("%v: %v", status, err)
+		}
+	}
+	if job.Terminated == nil {
+		t.Errorf("terminated time not set")
+	}
+	err := job.SetStatus(Cancelled, now)
+	if _, ok := err.(*TransitionError); !ok {
+		t.Errorf("complete job cancelled: %v", err)
+	}
+	if job.Status != Complete {
+		t.Errorf("status: %v", job.Status)
+	}
+
+	job = New()
+	if err := job.SetStatus(Complete, now); err == nil {
+		t.Errorf("accepted job completed without processing")
+	}
+	if err := job.SetStatus(Accepted, now); err == nil {
+		t.Errorf("accepted job accepted again")
+	}
+}
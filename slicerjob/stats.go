@@ -0,0 +1,76 @@
+package slicerjob
+
+import "time"
+
+// ServerStats summarizes the activity of a slicing server.
+type ServerStats struct {
+	Time    time.Time `json:"time"`
+	Queued  int       `json:"queued"`
+	Running int       `json:"running"`
+
+	// Windows counts the jobs which terminated within recent periods of
+	// time, keyed by the period ("1m", "1h", ...).
+	Windows map[string]*WindowStats `json:"windows"`
+
+	// Presets gives timing information for the jobs run with each preset
+	// since the server started.
+	Presets map[string]*PresetStats `json:"presets"`
+
+	Disk *DiskUsage `json:"disk_usage,omitempty"`
+	GC   *GCStats   `json:"gc,omitempty"`
+}
+
+// WindowStats counts the jobs terminated in a window of time.
+type WindowStats struct {
+	Complete  int `json:"complete"`
+	Failed    int `json:"failed"`
+	Cancelled int `json:"cancelled"`
+}
+
+// PresetStats describes the jobs run with a preset.  Durations are given in
+// seconds.
+type PresetStats struct {
+	Started       int     `json:"started"`
+	Complete      int     `json:"complete"`
+	Failed        int     `json:"failed"`
+	MeanQueueWait float64 `json:"mean_queue_wait"`
+	MeanSliceTime float64 `json:"mean_slice_time"`
+}
+
+// DiskUsage is the space used by a server's data directory, in bytes.
+type DiskUsage struct {
+	Files     int64 `json:"files"`
+	FileCount int   `json:"file_count"`
+	Database  int64 `json:"database"`
+	Total     int64 `json:"total"`
+}
+
+// Reasons the garbage collector deletes a job.
+const (
+	GCExpired = "expired"
+	GCQuota   = "quota"
+)
+
+// GCStats describes the work of a server's garbage collector.  Counts are
+// totals since the server started.
+type GCStats struct {
+	LastRun      *time.Time `json:"last_run_time,omitempty"`
+	Quota        int64      `json:"quota,omitempty"`
+	Usage        int64      `json:"usage"`
+	ExpiredJobs  int        `json:"expired_jobs"`
+	EvictedJobs  int        `json:"evicted_jobs"`
+	EvictedBytes int64      `json:"evicted_bytes"`
+	RemovedFiles int        `json:"removed_files"`
+
+	// Recent lists the latest jobs deleted, newest first.
+	Recent []*GCDecision `json:"recent,omitempty"`
+}
+
+// GCDecision records the deletion of a job by the garbage collector.
+type GCDecision struct {
+	Time   time.Time `json:"time"`
+	JobID  string    `json:"job_id"`
+	Status Status    `json:"status"`
+	Reason string    `json:"reason"`
+	Bytes  int64     `json:"bytes,omitempty"`
+}
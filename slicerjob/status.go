@@ -9,7 +9,9 @@ import (
 type Status int
 
 // Jobs typically begin in Accepted and transition to Processing, followed
-// by Complete.  A job may enter a Failed state from any other.
+// by Complete.  A waiting job may become Failed or Cancelled, and a
+// Processing job returns to Accepted when it will be sliced again.  Complete,
+// Failed, and Cancelled are terminal.  See CanTransition.
 const (
 	Accepted Status = iota
 	Processing
@@ -41,6 +43,38 @@ func (s Status) IsWaiting() bool {
 	return s == Accepted || s == Processing
 }
 
+// IsTerminal returns true if s is a final status from which a job cannot
+// transition.
+func (s Status) IsTerminal() bool {
+	return s == Complete || s == Failed || s == Cancelled
+}
+
+var transitions = map[Status][]Status{
+	Accepted:   {Processing, Failed, Cancelled},
+	Processing: {Accepted, Complete, Failed, Cancelled},
+}
+
+// CanTransition returns true if a job with status s may change to status
+// next.
+func (s Status) CanTransition(next Status) bool {
+	for _, t := range transitions[s] {
+		if t == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError is returned when a job cannot change to a status.
+type TransitionError struct {
+	From Status
+	To   Status
+}
+
+func (err *TransitionError) Error() string {
+	return fmt.Sprintf("job cannot change from %v to %v", err.From, err.To)
+}
+
 // IsValid returns true if s is one of the defined Status constants
 // excluding Invalid.
 func (s Status) IsValid() bool {